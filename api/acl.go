@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	tools "../tools"
+)
+
+// 访问控制: 管理员可以访问所有数据，其他用户:
+//   文件(按md5访问): owners中引用数大于0的用户可读可删，acl中的用户只读
+//   bucket及其中的key: owner可读写，acl中的用户只读
+// 未启用鉴权时当前用户为nil，不做限制
+// 启用鉴权前上传的文件和创建的bucket没有owner，只有管理员可以访问，可通过/acl授权
+
+const P_ACL = "acl" // 逗号分隔的用户名
+
+// 用户是否在acl中
+func inACL(acl []string, name string) bool {
+	for _, n := range acl {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为文件的owner(持有按md5上传的引用)
+func (o *ObjFile) isOwner(u *User) bool {
+	return isAdmin(u) || o.Owners[u.Name] > 0
+}
+
+func (o *ObjFile) canRead(u *User) bool {
+	return o.isOwner(u) || inACL(o.ACL, u.Name)
+}
+
+func (b *Bucket) canWrite(u *User) bool {
+	return isAdmin(u) || (len(b.Owner) != 0 && b.Owner == u.Name)
+}
+
+func (b *Bucket) canRead(u *User) bool {
+	return b.canWrite(u) || inACL(b.ACL, u.Name)
+}
+
+// 获取bucket文档，不存在时返回nil
+func getBucket(name string) *Bucket {
+	var (
+		b    = new(Bucket)
+		body []byte
+		err  error
+	)
+	if body, err = MetaStore.Get(ES_TYPE_BUCKET, name); err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, b); err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return b
+}
+
+// 检查当前用户对bucket的权限，bucket不存在时视为有权限，由后续流程返回404
+func bucketAllowed(req *http.Request, bucket string, write bool) bool {
+	var (
+		u = reqUser(req)
+		b *Bucket
+	)
+	if isAdmin(u) {
+		return true
+	}
+	if b = getBucket(bucket); b == nil {
+		return true
+	}
+	if write {
+		return b.canWrite(u)
+	}
+	return b.canRead(u)
+}
+
+// 检查当前用户是否可以读取文件，文件不存在时视为有权限，由后续流程返回404
+func fileAllowed(req *http.Request, md5 string) bool {
+	var (
+		u = reqUser(req)
+		o = &ObjFile{Md5: md5}
+	)
+	if isAdmin(u) {
+		return true
+	}
+	if err := o.loadMeta(); err != nil {
+		return true
+	}
+	return o.canRead(u)
+}
+
+// 查看或设置访问授权，只有owner和管理员可以操作
+//
+//	GET /acl?md5=|bucket=           查看owner和acl
+//	PUT /acl?md5=|bucket=&acl=u1,u2 设置只读用户，acl为空时取消所有授权
+func handlerACL(resp http.ResponseWriter, req *http.Request) {
+	var (
+		u      = reqUser(req)
+		md5    = strings.ToLower(req.FormValue(P_MD5))
+		bucket = req.FormValue(P_BUCKET)
+		acl    = []string{}
+		err    error
+	)
+	if req.Method != "GET" && req.Method != "PUT" {
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+		return
+	}
+	for _, n := range strings.Split(req.FormValue(P_ACL), ",") {
+		if n = strings.TrimSpace(n); len(n) != 0 && !inACL(acl, n) {
+			acl = append(acl, n)
+		}
+	}
+	switch {
+	case len(bucket) != 0:
+		b := getBucket(bucket)
+		if b == nil {
+			resp.Write(tools.Json2Byte(404, ErrBucketNotFound.Error()))
+			return
+		}
+		if !b.canWrite(u) {
+			resp.Write(tools.Json2Byte(403, Err403.Error()))
+			return
+		}
+		if req.Method == "PUT" {
+			b.ACL = acl
+			if _, err = MetaStore.Add(ES_TYPE_BUCKET, bucket, b); err != nil {
+				log.Println("保存bucket授权出错: ", bucket, err.Error())
+				resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+				return
+			}
+			log.Printf("设置bucket授权: %s %v\n", bucket, acl)
+		}
+		resp.Write(tools.Json2ByteObj(200, map[string]interface{}{"owner": b.Owner, "acl": b.ACL}))
+	case len(md5) == 32:
+		o := &ObjFile{Md5: md5}
+		if err = o.loadMeta(); err == ErrNotFound {
+			resp.Write(tools.Json2Byte(404, ErrNotFound.Error()))
+			return
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+			return
+		}
+		if !o.isOwner(u) {
+			resp.Write(tools.Json2Byte(403, Err403.Error()))
+			return
+		}
+		if req.Method == "PUT" {
+			o.ACL = acl
+			if _, err = updateFile(md5, func(f *ObjFile) error { f.ACL = acl; return nil }); err != nil {
+				log.Println("保存文件授权出错: ", md5, err.Error())
+				resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+				return
+			}
+			log.Printf("设置文件授权: %s %v\n", md5, acl)
+		}
+		resp.Write(tools.Json2ByteObj(200, map[string]interface{}{"owners": o.Owners, "acl": o.ACL}))
+	default:
+		resp.Write(tools.Json2Byte(400, Err400.Error()))
+	}
+}
@@ -1,55 +1,193 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	tools "../tools"
-	nsq "github.com/nsqio/go-nsq"
 )
 
 const (
-	NSQ_ADDR      = "127.0.0.1:4150"
-	CONSUMER_TYPE = "API" // 消费者类型
+	CONSUMER_TYPE  = "API"        // 消费者类型
+	CHANNEL_REPAIR = "API_REPAIR" // 所有api共用的channel，每条异常切片消息只由一个api处理
 )
 
 var (
-	DataServer           = make(map[string]int64, 8) // 用于保存data节点的时间信息
-	DataMu               = &sync.RWMutex{}           // DataServer的读写锁
-	HBSendInterval       = time.Millisecond * 1000   // 发送心跳时间间隔
-	WarnCount            = 5                         // 发送心跳次数超过5次，会打印警报信息
-	VaildTime      int64 = time.Second.Nanoseconds() // data超时时间，默认：1s
-	DealTimeOut          = time.Second * 5           // 3秒钟清理一次过期的DataServer
+	NSQ_ADDR             = "127.0.0.1:4150"
+	DataServer           = make(map[string]*DataNode, 8) // 用于保存data节点的时间及状态信息
+	DataMu               = &sync.RWMutex{}               // DataServer的读写锁
+	HBSendInterval       = time.Millisecond * 1000       // 发送心跳时间间隔
+	WarnCount            = 5                             // 发送心跳次数超过5次，会打印警报信息
+	VaildTime      int64 = time.Second.Nanoseconds()     // data超时时间，默认：1s
+	DealTimeOut          = time.Second * 5               // 3秒钟清理一次过期的DataServer
 	Topic                = map[string]string{
-		"hbapi":  "HBApiServers",  // api服务器的addr
-		"hbdata": "HBDataServers", // data服务器的addr
+		"hbapi":   "HBApiServers",  // api服务器的addr
+		"hbdata":  "HBDataServers", // data服务器的addr
+		"corrupt": "CorruptShards", // data巡检发现的异常切片
 	}
 	// 格式为: 消费者类型_IP_PORT, 其中: 消费者类型为Api|Data
 	// 例如: API_19216810101_4015
-	ChannelDataHB string           // channel，用于获取Data心跳信息
-	APISERVER     *APIServerStruct // api的api接口服务器
+	ChannelDataHB string             // channel，用于获取Data心跳信息
+	ChannelAPIHB  string             // channel，用于获取其他api节点的心跳信息(Bolt后端时检查)
+	APISERVER     *APIServerStruct   // api的api接口服务器
+	MemberBackend = tools.MEMBER_NSQ // 集群成员类型: nsq|static|gossip
+	MemberAddr    string             // UDP后端的监听地址，默认与ListenAddr相同
+	Seeds         []string           // static的所有节点或gossip的种子节点
 )
 
 func main() {
 	var (
-		hb       *tools.HeartBeat
-		datacons = &DataConsumer{ // 消费者
-			vaildTime:   VaildTime,
-			dealTimeOut: DealTimeOut}
+		hb       tools.Membership
+		err      error
+		datacons *DataConsumer // 消费者
 	)
+	loadConfig() // 加载配置，dump-config时打印后退出
+	prepare()
+	initAdmin()       // 启用鉴权时创建管理员
+	initKeys()        // 加密旧版本明文保存的API key
+	go reloadConfig() // 收到SIGHUP时重新加载配置
+
+	datacons = &DataConsumer{
+		vaildTime:   VaildTime,
+		dealTimeOut: DealTimeOut}
 	ChannelDataHB = fmt.Sprintf("%s_%s", CONSUMER_TYPE, strings.Replace(strings.Replace(ListenAddr, ".", "", -1), ":", "_", -1))
-	hb = tools.NewHeartBeat(NSQ_ADDR, Topic["hbapi"], ListenAddr, WarnCount, HBSendInterval)
+	hb, err = tools.NewMembership(MemberBackend, tools.HBConf{
+		ProdTopic:    Topic["hbapi"],
+		ProdMsg:      ListenAddr,
+		WarnCount:    WarnCount,
+		ProdInterval: HBSendInterval,
+		Legacy:       HBLegacy,
+	}, NSQ_ADDR, MemberAddr, Seeds)
+	if err != nil {
+		log.Fatalln("初始化集群成员出错: ", err)
+	}
 	go hb.SendHeart()
-	hb.AddConsumer(Topic["hbdata"], ChannelDataHB, datacons)
+	if err = hb.AddConsumer(Topic["hbdata"], ChannelDataHB, datacons); err != nil {
+		log.Fatalln(err)
+	}
+	if err = hb.AddConsumer(Topic["corrupt"], CHANNEL_REPAIR, &CorruptConsumer{}); err != nil {
+		log.Fatalln(err)
+	}
+	if MetaBackend == tools.STORE_BOLT {
+		checkSingleAPI(hb) // Bolt后端只支持单个apiserv
+	}
 	go datacons.dealDataServer() // 启动清理dataserver进程
+	recoverUploads()             // 根据上传日志继续或回滚重启前未完成的上传
+	recoverJobs()                // 处理重启前未结束的上传任务
+	go cleanJobs()
+	go cleanUploads() // 清理超时或未清理完的分段上传
+	go cleanTus()     // 清理过期的断点续传
+	go repairDaemon() // 修复缺失或损坏的切片
 
 	// restful
 	APISERVER = NewAPIServer()
-	APISERVER.Start()
+	go APISERVER.Start()
+	shutdown(hb)
+}
+
+// 收到SIGTERM或SIGINT后退出:
+//
+//	①停止心跳并通知其他节点本节点离开
+//	②停止接收新请求，等待正在处理的请求结束
+//	③等待后台上传，超时未完成的保留本地切片及上传日志，重启后继续上传(见journal.go)
+func shutdown(hb tools.Membership) {
+	var (
+		ch       = make(chan os.Signal, 1)
+		deadline time.Time
+		err      error
+	)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	log.Println("收到退出信号: ", <-ch)
+	deadline = time.Now().Add(live().ShutdownTimeout)
+	if err = hb.Leave(); err != nil {
+		log.Println("通知其他节点离开时出错: ", err.Error())
+	}
+	if err = APISERVER.Stop(deadline); err != nil {
+		log.Println("等待请求结束超时: ", err.Error())
+	}
+	if !tools.WaitTimeout(UploadWG, deadline.Sub(time.Now())) {
+		RunningMU.RLock()
+		for md5 := range RunningMap {
+			if tools.FileExist(filepath.Join(TmpDir, JOURNAL_DIR, md5+".json")) {
+				log.Println("上传未完成，重启后根据上传日志继续: ", md5)
+			}
+		}
+		RunningMU.RUnlock()
+	}
+	log.Println("API服务已退出")
+}
+
+// Bolt后端的元数据文件只属于本节点，多个apiserv各自使用自己的元数据，同一文件或key在不同节点上不一致
+// 启动时等待几个心跳间隔，收到其他api节点的心跳则拒绝启动；运行中发现其他api节点时打印错误(对方启动时会拒绝)
+func checkSingleAPI(hb tools.Membership) {
+	var peers = &APIConsumer{peers: make(map[string]int64)}
+	ChannelAPIHB = fmt.Sprintf("%s_PEER_%s", CONSUMER_TYPE, strings.Replace(strings.Replace(ListenAddr, ".", "", -1), ":", "_", -1))
+	if err := hb.AddConsumer(Topic["hbapi"], ChannelAPIHB, peers); err != nil {
+		log.Fatalln(err)
+	}
+	time.Sleep(3 * HBSendInterval)
+	if addrs := peers.alive(); len(addrs) != 0 {
+		log.Fatalf("元数据存储为bolt时只支持单个apiserv, 发现其他api节点: %v\n", addrs)
+	}
+	peers.mu.Lock()
+	peers.started = true
+	peers.mu.Unlock()
+}
+
+// 消费其他api节点的心跳信息
+type APIConsumer struct {
+	mu      sync.Mutex
+	peers   map[string]int64 // 其他api节点最后一次心跳的时间
+	started bool             // 启动检查已结束，之后发现的节点只打印错误
+}
+
+func (c *APIConsumer) HandleMessage(body []byte) error {
+	var (
+		m   *tools.HBMsg
+		err error
+	)
+	if m, err = tools.ParseHB(body); err != nil {
+		log.Println(err, string(body))
+		return err
+	}
+	if m.Addr == ListenAddr {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.Leave {
+		delete(c.peers, m.Addr)
+		return nil
+	}
+	if _, ok := c.peers[m.Addr]; !ok && c.started {
+		log.Printf("元数据存储为bolt时只支持单个apiserv, 发现其他api节点: [%s]\n", m.Addr)
+	}
+	c.peers[m.Addr] = m.Time
+	return nil
+}
+
+// 心跳未超时的其他api节点
+func (c *APIConsumer) alive() []string {
+	var (
+		addrs []string
+		now   = time.Now().UnixNano()
+	)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, t := range c.peers {
+		if now-t <= VaildTime {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
 // 消费Data节点信息
@@ -58,30 +196,40 @@ type DataConsumer struct {
 	dealTimeOut time.Duration // 处理过期data服的时间间隔
 }
 
-func (c *DataConsumer) HandleMessage(msg *nsq.Message) error {
+func (c *DataConsumer) HandleMessage(body []byte) error {
 	var (
-		m          = msg.Body
-		err        error
-		t          int64            // unix时间戳
-		dataServer = string(m[20:]) // IP地址信息
-		now        = time.Now().UnixNano()
+		m   *tools.HBMsg
+		err error
+		now = time.Now().UnixNano()
 	)
-	if t, err = strconv.ParseInt(string(m[:19]), 10, 64); err != nil {
-		log.Println(err)
+	if m, err = tools.ParseHB(body); err != nil {
+		log.Println(err, string(body))
 		return err
 	}
-	if now-t > c.vaildTime {
-		log.Printf("Data节点超时(剔除该节点): [%s] %d\n", dataServer, t)
+	if m.Leave {
+		log.Printf("Data节点离开: [%s]\n", m.Addr)
 		DataMu.Lock()
-		delete(DataServer, dataServer)
+		delete(DataServer, m.Addr)
 		DataMu.Unlock()
-		return err
+		return nil
+	}
+	if now-m.Time > c.vaildTime {
+		log.Printf("Data节点超时(剔除该节点): [%s] %d\n", m.Addr, m.Time)
+		DataMu.Lock()
+		delete(DataServer, m.Addr)
+		DataMu.Unlock()
+		return nil
 	}
 	DataMu.Lock()
-	if _, ok := DataServer[dataServer]; !ok {
-		log.Printf("添加Data节点: [%s]\n", dataServer)
+	node, ok := DataServer[m.Addr]
+	if !ok {
+		log.Printf("添加Data节点: [%s] %s\n", m.Addr, m.Version)
+		node = &DataNode{}
+		DataServer[m.Addr] = node
 	}
-	DataServer[dataServer] = t
+	node.HB = m.Time
+	node.V = m.V
+	node.Stat = m.NodeStat
 	DataMu.Unlock()
 	return nil
 }
@@ -90,15 +238,15 @@ func (c *DataConsumer) HandleMessage(msg *nsq.Message) error {
 func (c *DataConsumer) dealDataServer() {
 	var (
 		now        int64 // 当前时间
-		t          int64 // map中时间
+		node       *DataNode
 		dataServer string
 	)
 	for {
 		now = time.Now().UnixNano()
 		DataMu.Lock()
-		for dataServer, t = range DataServer {
-			if now-t > c.vaildTime {
-				log.Printf("Data节点超时(DataServer): [%s] %d\n", dataServer, t)
+		for dataServer, node = range DataServer {
+			if now-node.HB > c.vaildTime {
+				log.Printf("Data节点超时(DataServer): [%s] %d\n", dataServer, node.HB)
 				delete(DataServer, dataServer)
 			}
 		}
@@ -106,3 +254,22 @@ func (c *DataConsumer) dealDataServer() {
 		time.Sleep(c.dealTimeOut)
 	}
 }
+
+// 消费data节点上报的异常切片，加入修复队列
+type CorruptConsumer struct{}
+
+func (c *CorruptConsumer) HandleMessage(body []byte) error {
+	var r = &tools.ShardReport{}
+	if err := json.Unmarshal(body, r); err != nil {
+		log.Println("异常切片消息格式有误: ", string(body))
+		return nil
+	}
+	log.Printf("Data节点上报异常切片: [%s] %s %s\n", r.Server, r.SerPath, r.Reason)
+	if len(r.FileMd5) == 0 {
+		r.FileMd5 = findFileByShard(r.Server, r.Md5)
+	}
+	if len(r.FileMd5) != 0 {
+		TriggerRepair(r.FileMd5)
+	}
+	return nil
+}
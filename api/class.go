@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 存储类型: 上传时按类型选择切片布局(数据块+校验块)，并记录在file文档中，
+// 下载、还原读取和修复都使用文件上传时的布局，修改配置不影响已有文件
+//   STANDARD  data_count+parity_count(默认4+2)
+//   WIDE      8+3，存储开销较低，适合大文件
+//   REPLICA   1+2，RS(1,2)的两个校验块与数据块相同，即3副本，适合小的热点文件
+// 可以通过storage_classes增加或覆盖(NAME=数据块+校验块)，通过X-Storage-Class头部选择
+
+const (
+	H_STORAGE_CLASS    = "X-Storage-Class"
+	H_S3_STORAGE_CLASS = "X-Amz-Storage-Class"
+
+	CLASS_STANDARD = "STANDARD"
+	CLASS_WIDE     = "WIDE"
+	CLASS_REPLICA  = "REPLICA"
+)
+
+var (
+	DefaultClass = CLASS_STANDARD            // 未指定存储类型时使用
+	Classes      = map[string]StorageClass{} // 所有存储类型，启动时由配置生成
+	className    = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,31}$`)
+)
+
+var (
+	ErrStorageClass = errors.New("无效的存储类型")
+)
+
+// 存储类型
+type StorageClass struct {
+	Name   string `json:"name"`
+	Data   int    `json:"data"`   // 数据块数目
+	Parity int    `json:"parity"` // 校验块数目
+}
+
+func (c StorageClass) String() string {
+	return fmt.Sprintf("%s(%d+%d)", c.Name, c.Data, c.Parity)
+}
+
+// 生成所有存储类型: 内置类型，STANDARD为data+parity，再按defs增加或覆盖
+func buildClasses(data, parity int, defs []string) (map[string]StorageClass, error) {
+	var classes = map[string]StorageClass{
+		CLASS_STANDARD: {CLASS_STANDARD, data, parity},
+		CLASS_WIDE:     {CLASS_WIDE, 8, 3},
+		CLASS_REPLICA:  {CLASS_REPLICA, 1, 2},
+	}
+	for _, def := range defs {
+		c, err := parseClass(def)
+		if err != nil {
+			return nil, err
+		}
+		classes[c.Name] = c
+	}
+	return classes, nil
+}
+
+// 解析NAME=数据块+校验块
+func parseClass(def string) (StorageClass, error) {
+	var (
+		c   StorageClass
+		kv  = strings.SplitN(strings.TrimSpace(def), "=", 2)
+		err error
+	)
+	if len(kv) != 2 {
+		return c, fmt.Errorf("storage_classes有误: %s", def)
+	}
+	c.Name = strings.ToUpper(strings.TrimSpace(kv[0]))
+	dp := strings.SplitN(kv[1], "+", 2)
+	if !className.MatchString(c.Name) || len(dp) != 2 {
+		return c, fmt.Errorf("storage_classes有误: %s", def)
+	}
+	if c.Data, err = strconv.Atoi(strings.TrimSpace(dp[0])); err != nil {
+		return c, fmt.Errorf("storage_classes有误: %s", def)
+	}
+	if c.Parity, err = strconv.Atoi(strings.TrimSpace(dp[1])); err != nil {
+		return c, fmt.Errorf("storage_classes有误: %s", def)
+	}
+	if c.Data < 1 || c.Parity < 1 || c.Data+c.Parity > 256 {
+		return c, fmt.Errorf("storage_classes有误: %s", def)
+	}
+	return c, nil
+}
+
+// 按名字获取存储类型，名字为空时使用默认类型
+func getClass(name string) (StorageClass, error) {
+	if len(name) == 0 {
+		name = DefaultClass
+	}
+	c, ok := Classes[strings.ToUpper(name)]
+	if !ok {
+		return c, ErrStorageClass
+	}
+	return c, nil
+}
+
+// 打印所有存储类型
+func logClasses() {
+	var names []string
+	for _, c := range Classes {
+		names = append(names, c.String())
+	}
+	sort.Strings(names)
+	log.Printf("存储类型: %s，默认: %s\n", strings.Join(names, ", "), DefaultClass)
+}
+
+// 设置本次上传的存储类型，文件已存在时仍使用原有的布局
+func (o *ObjFile) setClass(name string) error {
+	c, err := getClass(name)
+	if err != nil {
+		return err
+	}
+	o.Class, o.DataCount, o.ParityCount = c.Name, c.Data, c.Parity
+	return nil
+}
+
+// 文件的切片布局，未记录时(旧文件)为data_count+parity_count
+func (o *ObjFile) layout() (int, int) {
+	if o.DataCount == 0 {
+		return DATA_C, PARITY_C
+	}
+	return o.DataCount, o.ParityCount
+}
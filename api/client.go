@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +13,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	tools "../tools"
@@ -20,7 +22,7 @@ import (
 
 // 实现上传/下载切片
 // ①下载切片
-//    md5: 文件的md5
+//    md5: 切片的md5，path: 切片在data中的路径，token: 见tools/token.go
 //
 // ②上传切片
 //    md5: 文件的md5
@@ -29,16 +31,30 @@ import (
 //
 // ③删除切片
 //    md5/path
+//
+// 除上传的文件内容外，参数都放在query中，以便参与请求签名(见tools/internal.go)
+// 各切片并行传输并单独重试(见transfer.go)
 
 var (
-	CheckGoroutine = time.Second               // 检查频率
-	FailCount      = 5                         // 容忍fail次数
-	UploadTimeOut  = time.Second * 10          // 上传超时
-	URL_PUT        = "http://%s/shard"         // 上传文件
-	URL_DELETE     = "http://%s/shard"         // 删除切片
-	URL_GET        = "http://%s/shard?%s"      // 下载文件
-	URL_CHECK      = "http://%s/checkshard?%s" // 检查切片
-	LastServer     string                      // 上一次返回的data服，用于随机返回
+	FailCount     = 5                         // 每个切片的尝试次数
+	UploadTimeOut = time.Second * 10          // 上传超时
+	URL_PUT       = "http://%s/shard?%s"      // 上传文件
+	URL_DELETE    = "http://%s/shard?%s"      // 删除切片
+	URL_GET       = "http://%s/shard?%s"      // 下载文件
+	URL_CHECK     = "http://%s/checkshard?%s" // 检查切片
+	TokenTimeOut  = 30 * time.Second          // 签发的token的有效时间(默认值，生效的值见live)
+	TLSCert       string                      // 设置后使用https访问data(见tools/internal.go)
+	TLSKey        string
+	TLSCA         string // 校验data证书的CA，为空时使用系统根证书
+	// 访问data的客户端，上传整个切片，限制总时间
+	InternalClient = &http.Client{Timeout: UploadTimeOut, Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}}
+	// 流式读取切片的客户端，读取时间与文件大小有关，只限制等待响应头的时间
+	StreamClient = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: UploadTimeOut,
+	}}
 )
 var (
 	ErrNoDataServer   = errors.New("无DataServer服务器")
@@ -56,35 +72,19 @@ type ObjShard struct {
 
 type Sha []ObjShard
 
-// 删除
-func (s *Sha) DeleteShard() error {
-	var (
-		shard   *ObjShard
-		length  = len(*s)
-		succ    int
-		succArr = make([]int, length)
-		err     error
-	)
-	for i := 0; i < FailCount; i++ {
-		succ = length
-		for j := 0; j < length; j++ {
-			shard = &(*s)[j]
-			if succArr[j] == 1 {
-				continue
-			}
-			if err = deleteOne(shard); err != nil {
-				log.Println(err.Error())
-				succ--
-			} else {
-				succArr[j] = 1
-			}
-		}
-		if succ == length {
-			break
+// 并行删除所有切片
+func (s *Sha) DeleteShard(ctx context.Context) error {
+	var failed int
+	errs := transferAll(ctx, len(*s), func(i int) error {
+		return deleteOne(ctx, &(*s)[i])
+	})
+	for i, err := range errs {
+		if err != nil {
+			log.Println("删除切片失败: ", (*s)[i].Server, (*s)[i].BaseName, err.Error())
+			failed++
 		}
 	}
-
-	if succ != length {
+	if failed != 0 {
 		return ErrServer500
 	}
 	// 并没有ES中file类型的文档,等core代码中执行
@@ -92,30 +92,22 @@ func (s *Sha) DeleteShard() error {
 }
 
 // 只要不存在数据，即返回nil，相当于删除成功
-func deleteOne(s *ObjShard) error {
+func deleteOne(ctx context.Context, s *ObjShard) error {
 	var (
 		res  = &tools.Res{}
 		body []byte
-		buf  = &bytes.Buffer{}
-		w    = multipart.NewWriter(buf)
+		v    = url.Values{}
 		req  *http.Request
 		resp *http.Response
 		err  error
 	)
-	w.WriteField(P_MD5, s.Md5)
-	w.WriteField(P_PATH, s.BaseName)
-	boundary := w.Boundary()
-	if err = w.Close(); err != nil {
-		log.Println("制作form出错: ", err.Error())
-		return err
-	}
-	// 生成req请求之前，先关闭表单,留body
-	if req, err = http.NewRequest("DELETE", fmt.Sprintf(URL_DELETE, s.Server), buf); err != nil {
+	v.Set(P_MD5, s.Md5)
+	v.Set(P_PATH, s.BaseName)
+	if req, err = http.NewRequest("DELETE", fmt.Sprintf(URL_DELETE, s.Server, v.Encode()), nil); err != nil {
 		log.Println("构造request出错: ", err.Error())
 		return err
 	}
-	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
-	if resp, err = http.DefaultClient.Do(req); err != nil {
+	if resp, err = doInternal(InternalClient, req.WithContext(ctx)); err != nil {
 		return err
 	}
 	defer resp.Body.Close()
@@ -127,7 +119,7 @@ func deleteOne(s *ObjShard) error {
 	}
 	log.Printf("成功删除切片: [%s] %s\n", s.Server, s.BaseName)
 	tmp := filepath.Join(TmpDir, s.BaseName)
-	log.Println("临时文件: ", tmp)
+	tools.Debugln("临时文件: ", tmp)
 	if tools.FileExist(tmp) {
 		log.Println("删除临时文件: ", tmp)
 		os.Remove(tmp) // 删除api中的临时文件
@@ -135,179 +127,313 @@ func deleteOne(s *ObjShard) error {
 	return nil
 }
 
-// 下载
-func (s *Sha) DownloadShard() error {
+// 下载切片的参数: 设置了cluster_secret时由api直接签发token，只需一次请求；
+// 否则先请求checkshard，由data节点校验md5后签发token
+func shardQuery(s *ObjShard) (url.Values, error) {
 	var (
-		shard     ObjShard
-		length    = len(*s)
-		shardPath string // 切片存放位置
-		succ      int    // 成功次数
-		err       error
+		v     = url.Values{}
+		token string
+		err   error
 	)
-	for i := 0; i < FailCount; i++ {
-		succ = length
-		for _, shard = range *s {
-			shardPath = filepath.Join(TmpDir, shard.BaseName)
-			if tools.FileExist(shardPath) && isNotZero(shardPath) {
-				log.Println("存在该切片: ", shardPath)
-				continue
-			}
-			if err = downOne(&shard); err != nil {
-				log.Println("下载切片出错: ", shard.BaseName)
-				succ--
-			}
-		}
-		// 提前退出
-		if succ == length {
-			break
-		}
-		time.Sleep(CheckGoroutine)
+	v.Set(P_MD5, s.Md5)
+	v.Set(P_PATH, s.BaseName)
+	if c := live(); len(c.ClusterSecret) != 0 {
+		v.Set(P_TOKEN, tools.SignShardToken(c.ClusterSecret, s.Md5, s.BaseName, time.Now().Add(c.TokenTimeout)))
+		return v, nil
 	}
-	if succ < DATA_C {
-		log.Println("有效切片过少: ", succ)
-		return ErrShardNotEnough
+	if token, err = checkRemote(s); err != nil {
+		return nil, err
 	}
-	return nil
+	v.Set(P_TOKEN, token)
+	return v, nil
 }
 
-func downOne(s *ObjShard) error {
+// 请求data节点校验切片md5，返回下载token
+// 旧版data忽略path，按md5查找shard文档
+func checkRemote(s *ObjShard) (string, error) {
 	var (
-		dest = filepath.Join(TmpDir, s.BaseName)
-		f, _ = os.Create(dest)
 		resp *http.Response
 		v    = url.Values{}
-		body []byte
 		res  = &tools.Res{}
 		err  error
 	)
-	v.Add(P_MD5, s.Md5)
-	if resp, err = http.Get(fmt.Sprintf(URL_CHECK, s.Server, v.Encode())); err != nil {
-		log.Println(err)
-		return ErrGetShard
+	if len(s.Server) == 0 {
+		return "", ErrGetShard
 	}
-	defer resp.Body.Close()
-	body, _ = ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, res)
-	if res.Code != 302 {
+	v.Set(P_MD5, s.Md5)
+	v.Set(P_PATH, s.BaseName) // 副本的切片md5相同，按路径校验
+	if resp, err = getInternal(fmt.Sprintf(URL_CHECK, s.Server, v.Encode())); err != nil {
+		return "", err
+	}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	resp.Body.Close()
+	if err != nil || res.Code != 302 {
 		log.Println(res.Msg, s.BaseName)
-		return ErrGetShard
+		return "", ErrGetShard
 	}
-	// 添加token，获取文件
-	v.Add(P_TOKEN, res.Msg)
-	if resp, err = http.Get(fmt.Sprintf(URL_GET, s.Server, v.Encode())); err != nil {
-		log.Println(err)
-		return ErrServer500
+	return res.Msg, nil
+}
+
+// 获取切片[start, end]区间的数据流，调用方负责关闭；ctx取消后请求及数据流随之中断
+func openShard(ctx context.Context, s *ObjShard, start, end int64) (io.ReadCloser, error) {
+	var (
+		resp *http.Response
+		req  *http.Request
+		v    url.Values
+		err  error
+	)
+	if len(s.Server) == 0 {
+		return nil, ErrGetShard
 	}
-	// 复制响应到指定临时文件
-	body, _ = ioutil.ReadAll(resp.Body)
-	f.Write(body)
-	log.Println("切片获取成功: ", dest)
-	return nil
+	if v, err = shardQuery(s); err != nil {
+		return nil, err
+	}
+	if req, err = http.NewRequest("GET", fmt.Sprintf(URL_GET, s.Server, v.Encode()), nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if resp, err = doInternal(StreamClient, req.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		log.Println("分片不支持Range请求: ", s.Server, s.BaseName, resp.Status)
+		return nil, ErrGetShard
+	}
+	return resp.Body, nil
+}
+
+// 根据配置设置访问data的TLS，须在加载配置后调用
+func setupInternal() {
+	if len(TLSCert) == 0 {
+		return
+	}
+	conf, err := tools.ClientTLS(TLSCert, TLSKey, TLSCA)
+	if err != nil {
+		log.Fatalln("加载TLS证书出错: ", err)
+	}
+	InternalClient.Transport.(*http.Transport).TLSClientConfig = conf
+	StreamClient.Transport.(*http.Transport).TLSClientConfig = conf
+	for _, u := range []*string{&URL_PUT, &URL_DELETE, &URL_GET, &URL_CHECK} {
+		*u = "https" + strings.TrimPrefix(*u, "http")
+	}
+	log.Println("使用TLS访问data节点")
 }
 
-// 判断文件是否非0
-func isNotZero(filePath string) bool {
-	f, _ := os.Open(filePath)
-	finfo, _ := f.Stat()
-	return finfo.Size() != 0
+// 发送请求到data节点，设置了cluster_secret时为请求签名
+func doInternal(cli *http.Client, req *http.Request) (*http.Response, error) {
+	if secret := live().ClusterSecret; len(secret) != 0 {
+		tools.SignInternal(req, secret)
+	}
+	return cli.Do(req)
+}
+
+func getInternal(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doInternal(InternalClient, req)
 }
 
 // 该包主要用于向DataServer提交数据
-func (s *Sha) UploadShard(obj *ObjFile, shardArr []string) {
+// 所有分片都上传成功后才提交file文档，否则删除已上传的分片，并返回失败的分片
+// 同一条带的分片放在不同的节点上(placeShards)，可用节点不足时不上传
+// 分条带的文件边切片边上传(见stripe.go)
+// 带bucket/key上传时，提交file文档后、删除日志前绑定key，上传任务完成时key已可用
+func (s *Sha) UploadShard(ctx context.Context, obj *ObjFile, shardArr []string) error {
+	var err error
+	if err = s.uploadShards(ctx, obj, shardArr); err != nil {
+		return err
+	}
+	obj.ObjShard = *s
+	if err = MetaStore.Create(ES_TYPE_FILE, obj.Md5, obj); err == tools.ErrConflict {
+		return obj.adopt()
+	} else if err != nil {
+		log.Println("提交到ES时出错: ", err.Error())
+		obj.journal.rollback(obj.job)
+		return fmt.Errorf("提交元数据失败: %s", err.Error())
+	}
+	log.Println("提交至ES: ", obj.Md5)
+	if err = obj.bindPending(); err != nil { // 失败时已释放本次上传的引用
+		obj.journal.commit()
+		return fmt.Errorf("绑定key失败: %s", err.Error())
+	}
+	obj.journal.commit()
+	return nil
+}
+
+// 其他apiserv已提交同一md5的文件: 删除本次上传的切片，改为增加已有文件的引用，再绑定key
+// 先回滚再增加引用，回滚未完成时由日志继续回滚，不会重复增加引用
+func (o *ObjFile) adopt() error {
+	log.Println("其他apiserv已提交该文件，增加引用: ", o.Md5)
+	o.journal.rollback(o.job)
+	if _, err := holdRef(o.Md5, o.owner(), o.keyed); err != nil {
+		return fmt.Errorf("增加引用失败: %s", err.Error())
+	}
+	if err := o.bindPending(); err != nil {
+		return fmt.Errorf("绑定key失败: %s", err.Error())
+	}
+	return nil
+}
+
+// file文档是否由本次上传提交，Name为本次上传的临时文件名
+func (o *ObjFile) committed() bool {
+	var doc = new(ObjFile)
+	body, err := MetaStore.Get(ES_TYPE_FILE, o.Md5)
+	return err == nil && json.Unmarshal(body, doc) == nil && doc.Name == o.Name
+}
+
+// 上传所有分片，失败时删除已上传的分片；各条带的分片共用一个请求的并发限制
+func (s *Sha) uploadShards(ctx context.Context, obj *ObjFile, shardArr []string) error {
+	var err error
+	ctx = withLimit(ctx)
+	if obj.stripeCount() > 1 || len(obj.journal.Source) != 0 {
+		err = s.uploadStripes(ctx, obj, shardArr)
+	} else {
+		err = s.uploadGroup(ctx, obj, shardArr, 0, len(shardArr))
+	}
+	if err != nil {
+		obj.journal.rollback(obj.job)
+	}
+	return err
+}
+
+// 上传shardArr[lo:hi]这一组(一个条带)的分片，同一组的分片放在不同的节点上，失败时返回失败的分片
+// 各分片并行上传，失败后换一个节点重试
+func (s *Sha) uploadGroup(ctx context.Context, obj *ObjFile, shardArr []string, lo, hi int) error {
 	var (
-		length = len(shardArr)
-		succ   int // 成功次数
-		//shard  = make([]ObjShard, DATA_C+PARITY_C)
+		failed  []string                // 上传失败的分片
+		plan    = make([]string, hi-lo) // 每个分片的目标节点，下标为j-lo
+		pending []int                   // 需要上传的分片
+		down    = map[string]struct{}{} // 上传失败过的节点，重新选择时尽量避开
+		mu      sync.Mutex              // 保护plan及down
+		servers []string
+		err     error
 	)
-	for i := 0; i < FailCount; i++ {
-		succ = length
-		for j := 0; j < length; j++ {
-			if shardArr[j] == "" { // 跳过已经置""的string
-				continue
+	for j := lo; j < hi; j++ {
+		if shardArr[j] != "" {
+			pending = append(pending, j)
+		} else {
+			plan[j-lo] = (*s)[j].Server // 继续上传时，已上传的分片
+		}
+	}
+	if servers, err = placeShards(len(pending), planned(plan, nil)); err != nil {
+		return fmt.Errorf("放置切片失败: %s", err.Error())
+	}
+	for i, j := range pending {
+		plan[j-lo] = servers[i]
+	}
+	errs := transferAll(ctx, len(pending), func(i int) error {
+		var (
+			j      = pending[i]
+			server string
+			err    error
+		)
+		mu.Lock()
+		if len(plan[j-lo]) == 0 { // 上次失败，重新选择节点
+			if plan[j-lo], err = placeOne(planned(plan, down)); err != nil {
+				plan[j-lo], err = placeOne(planned(plan, nil))
 			}
-			//shard[j] = ObjShard{}
-			(*s)[j] = ObjShard{}
-			// uploadOne(&shardArr[j], &shard[j])
-			uploadOne(&shardArr[j], &(*s)[j])
-			if shardArr[j] != "" {
-				succ--
-				log.Println("分片上传失败: ", shardArr[j])
+		}
+		server = plan[j-lo]
+		mu.Unlock()
+		// 先在日志中记录目标位置，再上传
+		if err == nil {
+			if (*s)[j], err = obj.journal.place(j, server); err == nil {
+				err = uploadOne(ctx, obj.Md5, &shardArr[j], &(*s)[j])
+			}
+		}
+		if err != nil {
+			log.Println("分片上传失败: ", shardArr[j], err.Error())
+			mu.Lock()
+			if len(server) != 0 {
+				down[server] = struct{}{}
 			}
+			plan[j-lo] = ""
+			mu.Unlock()
+			(*s)[j] = ObjShard{}
+			obj.job.SetShard(j, SHARD_FAILED, "")
+			return err
 		}
-		// 提前跳出循环体
-		if succ == length {
-			break
+		obj.journal.placed(j, (*s)[j])
+		obj.job.SetShard(j, SHARD_UPLOADED, (*s)[j].Server)
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, filepath.Base(shardArr[pending[i]]))
 		}
-		time.Sleep(CheckGoroutine)
 	}
-	// obj.ObjShard = shard
-	obj.ObjShard = *s
-	if _, err := ESearch.Add(ES_TYPE_FILE, obj.Md5, obj); err != nil {
-		log.Println("提交到ES时出错: ", err.Error())
+	if len(failed) == 0 {
+		return nil
 	}
-	log.Println("提交至ES: ", obj.Md5)
+	return fmt.Errorf("%d个分片上传失败: %s", len(failed), strings.Join(failed, ","))
 }
 
-// 上传一个分片
-func uploadOne(src *string, s *ObjShard) {
+// 上传一个分片至s.Server，s.Md5为切片的md5，fileMd5为所属文件的md5
+// 成功后删除本地切片并将*src置为""
+func uploadOne(ctx context.Context, fileMd5 string, src *string, s *ObjShard) error {
 	var (
-		body     = &bytes.Buffer{}
-		w        = multipart.NewWriter(body)
-		server   string // Data Server地址
-		md5      string
-		boundary string // 需要设置http头部
-		f        *os.File
-		path     = filepath.Base(*src)
-		req      *http.Request  // 请求体
-		resp     *http.Response // 响应体
-		res      = &tools.Res{}
-		part     io.Writer
-		err      error
+		pr, pw    = io.Pipe() // 边读取切片边发送，不在内存中缓存整个切片
+		w         = multipart.NewWriter(pw)
+		errc      = make(chan error, 1) // 制作表单的结果
+		server    = s.Server            // Data Server地址
+		md5       = s.Md5
+		f         *os.File
+		path      = filepath.Base(*src)
+		v         = url.Values{} // query参数
+		req       *http.Request  // 请求体
+		resp      *http.Response // 响应体
+		res       = &tools.Res{}
+		err, werr error
 	)
-	if server, err = getOneServer(); err != nil {
-		log.Println(err.Error())
-		return
-	}
-	if md5, err = tools.Md5Get(*src); err != nil {
-		log.Println("获取MD5失败: ", err.Error())
-		return
-	}
-	// 制作表单
-	f, _ = os.Open(*src)
-	if part, err = w.CreateFormFile(P_FILE, path); err != nil {
-		log.Println(err.Error())
-		return
+	if f, err = os.Open(*src); err != nil {
+		return err
 	}
-	io.Copy(part, f)
+	defer f.Close()
 	// 其他额外数据
-	w.WriteField(P_MD5, md5)
-	w.WriteField(P_PATH, path)
-	boundary = w.Boundary()
-	if err = w.Close(); err != nil {
-		log.Println("制作form表单时出错: ", err.Error())
-		return
+	v.Set(P_MD5, md5)
+	v.Set(P_PATH, path)
+	v.Set(P_FILEMD5, fileMd5)
+	if req, err = http.NewRequest("PUT", fmt.Sprintf(URL_PUT, server, v.Encode()), pr); err != nil {
+		return fmt.Errorf("构造request时出错: %s", err.Error())
 	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	// 制作表单，出错时中断请求体
+	go func() {
+		part, err := w.CreateFormFile(P_FILE, path)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+		errc <- err
+	}()
 
 	// 上传数据
-	if req, err = http.NewRequest("PUT", fmt.Sprintf(URL_PUT, server), body); err != nil {
-		log.Println("构造request时出错: ", err.Error())
-		return
-	}
-	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
-	cli := http.DefaultClient
-	cli.Timeout = UploadTimeOut // 上传超时
-	if resp, err = cli.Do(req); err != nil {
-		log.Println(err.Error())
-		return
+	resp, err = doInternal(InternalClient, req.WithContext(ctx))
+	if err != nil {
+		pr.Close()
+		if werr = <-errc; werr != nil {
+			return fmt.Errorf("制作form表单时出错: %s", werr.Error())
+		}
+		return err
 	}
 	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
-		log.Println("切片上传失败: ", *src, err.Error())
-		return
+	err = json.NewDecoder(resp.Body).Decode(res)
+	pr.Close() // 节点提前返回时停止发送
+	if werr = <-errc; werr != nil && werr != io.ErrClosedPipe {
+		return fmt.Errorf("制作form表单时出错: %s", werr.Error())
+	}
+	if err != nil {
+		return err
 	}
 	if res.Code != 200 {
-		log.Println("执行PUT失败: ", res.Msg)
-		return
+		return fmt.Errorf("执行PUT失败: %s", res.Msg)
 	}
 	s.BaseName = path
 	s.Md5 = md5
@@ -316,26 +442,19 @@ func uploadOne(src *string, s *ObjShard) {
 	// 清除切片信息
 	os.Remove(*src)
 	*src = "" // 将slice中相对应字段置nil
-	return
+	return nil
 }
 
-// 从DataServer中获取一个dataserver，如果len为0，则返回nil
-func getOneServer() (string, error) {
-	var (
-		l int = len(DataServer)
-		i int
-	)
-	if l == 0 {
-		return "", ErrNoDataServer
-	}
-	// 是否需要加读锁
-	for server, _ := range DataServer {
-		i++
-		if i != l && LastServer == server {
-			continue
+// 已分配给分片的节点及extra中的节点，选择新节点时需要排除
+func planned(plan []string, extra map[string]struct{}) map[string]struct{} {
+	var m = make(map[string]struct{}, len(plan)+len(extra))
+	for _, server := range plan {
+		if len(server) != 0 {
+			m[server] = struct{}{}
 		}
-		LastServer = server
-		return server, nil
 	}
-	return "", nil
+	for server := range extra {
+		m[server] = struct{}{}
+	}
+	return m
 }
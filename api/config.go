@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	tools "../tools"
+)
+
+// api服务的配置，共用部分见tools.Config
+// 默认值为各个包变量的初始值，加载后再写回包变量；可重新加载的配置只发布到liveConf(见live)
+
+type Config struct {
+	tools.Config       `yaml:",inline"`
+	DataCount          int           `yaml:"data_count" env:"DATA_C" usage:"数据块数目，已有文件后不能修改"`
+	ParityCount        int           `yaml:"parity_count" env:"PARITY_C" usage:"校验块数目，已有文件后不能修改"`
+	StorageClasses     []string      `yaml:"storage_classes" env:"STORAGE_CLASSES" usage:"增加或覆盖存储类型，格式为NAME=数据块+校验块，逗号分隔"`
+	DefaultClass       string        `yaml:"default_storage_class" env:"DEFAULT_STORAGE_CLASS" usage:"未指定存储类型时使用的存储类型"`
+	StripeSize         int64         `yaml:"stripe_size" env:"STRIPE_SIZE" usage:"条带大小(字节，最小1MB)，大于该值的文件分条带编码，为0时不分条带"`
+	StripeParallel     int           `yaml:"stripe_parallel" env:"STRIPE_PARALLEL" usage:"上传时同时切片和上传的条带数"`
+	ShardParallel      int           `yaml:"shard_parallel" env:"SHARD_PARALLEL" usage:"每个请求同时上传、下载或删除的切片数"`
+	ShardParallelTotal int           `yaml:"shard_parallel_total" env:"SHARD_PARALLEL_TOTAL" usage:"所有请求同时上传、下载或删除的切片数"`
+	RetryBackoff       time.Duration `yaml:"retry_backoff" env:"RETRY_BACKOFF" usage:"切片传输失败后第一次重试前的等待时间，之后每次翻倍"`
+	RepairInterval     time.Duration `yaml:"repair_interval" env:"REPAIR_INTERVAL" usage:"定期扫描切片的间隔，为0时不扫描"`
+	S3AccessKey        string        `yaml:"s3_access_key" env:"S3_ACCESS_KEY" reload:"true" usage:"S3访问密钥ID(管理员权限)，与admin_user都为空时S3接口拒绝所有请求，除非设置了s3_anonymous"`
+	S3SecretKey        string        `yaml:"s3_secret_key" env:"S3_SECRET_KEY" reload:"true" secret:"true" usage:"S3访问密钥"`
+	S3Anonymous        bool          `yaml:"s3_anonymous" env:"S3_ANONYMOUS" reload:"true" usage:"s3_access_key与admin_user都为空时允许不签名访问S3接口"`
+	PresignKey         string        `yaml:"presign_key" env:"PRESIGN_KEY" reload:"true" secret:"true" usage:"预签名URL的签名密钥，多个apiserv须相同，为空时不能生成预签名URL"`
+	AdminUser          string        `yaml:"admin_user" env:"ADMIN_USER" usage:"管理员用户名，为空时接口不做鉴权"`
+	AdminPassword      string        `yaml:"admin_password" env:"ADMIN_PASSWORD" secret:"true" usage:"管理员初始密码，只在管理员不存在时使用"`
+	KeyEncryptKey      string        `yaml:"apikey_encrypt_key" env:"APIKEY_ENCRYPT_KEY" secret:"true" usage:"加密保存API key的secret的密钥，多个apiserv须相同且不能修改，为空时不能创建API key"`
+}
+
+var (
+	Loader   *tools.ConfigLoader // 重新加载时使用
+	Conf     *Config             // 当前生效的配置
+	liveConf atomic.Value        // *liveConfig，可重新加载的配置
+)
+
+// 可重新加载的配置，重新加载时整体替换为新的快照，不修改已发布的快照
+// 请求中通过live()读取，同一次处理中应只读取一次
+type liveConfig struct {
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	TokenTimeout    time.Duration
+	ClusterSecret   string
+	S3AccessKey     string
+	S3SecretKey     string
+	S3Anonymous     bool
+	PresignKey      string
+}
+
+// 当前生效的可重新加载配置，加载配置前为默认值
+func live() *liveConfig {
+	if c, ok := liveConf.Load().(*liveConfig); ok {
+		return c
+	}
+	return &liveConfig{
+		ReadTimeout:     ReadTimeout,
+		WriteTimeout:    WriteTimeout,
+		ShutdownTimeout: ShutdownTimeout,
+		TokenTimeout:    TokenTimeOut,
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Config: tools.Config{
+			ListenAddr:      ListenAddr,
+			BaseDir:         BaseDir,
+			ElasticURL:      ELASTIC_URL,
+			ESIndex:         ES_INDEX,
+			MetaBackend:     MetaBackend,
+			NSQAddr:         NSQ_ADDR,
+			Membership:      MemberBackend,
+			HBInterval:      HBSendInterval,
+			HBTimeout:       time.Duration(VaildTime),
+			ReadTimeout:     ReadTimeout,
+			WriteTimeout:    WriteTimeout,
+			ShutdownTimeout: ShutdownTimeout,
+			LogLevel:        tools.LOG_INFO,
+			TokenTimeout:    TokenTimeOut,
+		},
+		DataCount:          DATA_C,
+		ParityCount:        PARITY_C,
+		DefaultClass:       DefaultClass,
+		StripeSize:         StripeSize,
+		StripeParallel:     StripeParallel,
+		ShardParallel:      ShardParallel,
+		ShardParallelTotal: ShardParallelTotal,
+		RetryBackoff:       RetryBackoff,
+		RepairInterval:     RepairInterval,
+	}
+}
+
+// 校验配置，并填充依赖其他配置的默认值
+func (c *Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.DataCount < 1 || c.ParityCount < 1 || c.DataCount+c.ParityCount > 256 {
+		return fmt.Errorf("data_count或parity_count有误: %d+%d", c.DataCount, c.ParityCount)
+	}
+	classes, err := buildClasses(c.DataCount, c.ParityCount, c.StorageClasses)
+	if err != nil {
+		return err
+	}
+	c.DefaultClass = strings.ToUpper(c.DefaultClass)
+	if _, ok := classes[c.DefaultClass]; !ok {
+		return errors.New("default_storage_class不存在: " + c.DefaultClass)
+	}
+	if c.StripeSize < 0 || (c.StripeSize > 0 && c.StripeSize < 1<<20) || c.StripeParallel < 1 {
+		return fmt.Errorf("stripe_size或stripe_parallel有误: %d %d", c.StripeSize, c.StripeParallel)
+	}
+	if c.ShardParallel < 1 || c.ShardParallelTotal < c.ShardParallel || c.RetryBackoff <= 0 {
+		return fmt.Errorf("shard_parallel、shard_parallel_total或retry_backoff有误: %d %d %s", c.ShardParallel, c.ShardParallelTotal, c.RetryBackoff)
+	}
+	if c.RepairInterval < 0 {
+		return errors.New("repair_interval不能小于0")
+	}
+	if (len(c.S3AccessKey) == 0) != (len(c.S3SecretKey) == 0) {
+		return errors.New("s3_access_key和s3_secret_key须同时设置")
+	}
+	if len(c.AdminUser) != 0 && !userName.MatchString(c.AdminUser) {
+		return errors.New("admin_user有误: " + c.AdminUser)
+	}
+	c.fill()
+	return nil
+}
+
+// 填充依赖其他配置的默认值
+func (c *Config) fill() {
+	if len(c.TmpDir) == 0 {
+		c.TmpDir = filepath.Join(c.BaseDir, strings.Replace(c.ListenAddr, ":", ".", -1))
+	}
+	if len(c.MemberAddr) == 0 {
+		c.MemberAddr = c.ListenAddr
+	}
+}
+
+// 解析命令行参数并加载配置，失败时退出
+func loadConfig() {
+	var (
+		conf = new(Config)
+		err  error
+	)
+	if Loader, err = tools.NewConfigLoader("apiserv", defaultConfig(), os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatalln("解析命令行参数出错: ", err)
+	}
+	if err = Loader.Load(conf); err != nil {
+		log.Fatalln("加载配置出错: ", err)
+	}
+	if Loader.Dump {
+		fmt.Print(tools.DumpConfig(conf))
+		os.Exit(0)
+	}
+	if len(Loader.Path) != 0 {
+		log.Println("加载配置文件: ", Loader.Path)
+	}
+	applyConfig(conf)
+}
+
+// 收到SIGHUP时重新加载配置，只有可重新加载的配置立即生效
+func reloadConfig() {
+	var ch = make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		conf := new(Config)
+		if err := Loader.Load(conf); err != nil {
+			log.Println("重新加载配置出错，仍使用原配置: ", err)
+			continue
+		}
+		if keys := tools.KeepRestart(Conf, conf); len(keys) != 0 {
+			log.Println("以下配置需要重启才能生效: ", strings.Join(keys, ","))
+		}
+		applyConfig(conf)
+		log.Println("已重新加载配置")
+	}
+}
+
+// 写回包变量，重新加载时只修改可重新加载的配置
+// Conf始终为当前生效的配置
+func applyConfig(c *Config) {
+	if Conf == nil {
+		ListenAddr = c.ListenAddr
+		BaseDir = c.BaseDir
+		TmpDir = c.TmpDir
+		ELASTIC_URL = c.ElasticURL
+		ES_INDEX = c.ESIndex
+		MetaBackend = c.MetaBackend
+		NSQ_ADDR = c.NSQAddr
+		MemberBackend = c.Membership
+		MemberAddr = c.MemberAddr
+		Seeds = c.Seeds
+		HBSendInterval = c.HBInterval
+		VaildTime = c.HBTimeout.Nanoseconds()
+		HBLegacy = c.HBLegacy
+		DATA_C = c.DataCount
+		PARITY_C = c.ParityCount
+		Classes, _ = buildClasses(c.DataCount, c.ParityCount, c.StorageClasses)
+		DefaultClass = c.DefaultClass
+		logClasses()
+		StripeSize = c.StripeSize
+		StripeParallel = c.StripeParallel
+		ShardParallel = c.ShardParallel
+		ShardParallelTotal = c.ShardParallelTotal
+		RetryBackoff = c.RetryBackoff
+		RepairInterval = c.RepairInterval
+		TLSCert = c.TLSCert
+		TLSKey = c.TLSKey
+		TLSCA = c.TLSCA
+		AdminUser = c.AdminUser
+		AdminPassword = c.AdminPassword
+		KeyEncryptKey = c.KeyEncryptKey
+	}
+	// 读写超时按请求设置(见withDeadline)，不修改运行中的http.Server
+	liveConf.Store(&liveConfig{
+		ReadTimeout:     c.ReadTimeout,
+		WriteTimeout:    c.WriteTimeout,
+		ShutdownTimeout: c.ShutdownTimeout,
+		TokenTimeout:    c.TokenTimeout,
+		ClusterSecret:   c.ClusterSecret,
+		S3AccessKey:     c.S3AccessKey,
+		S3SecretKey:     c.S3SecretKey,
+		S3Anonymous:     c.S3Anonymous,
+		PresignKey:      c.PresignKey,
+	})
+	tools.SetLogLevel(c.LogLevel)
+	if len(c.S3AccessKey) == 0 && !AuthEnabled() {
+		if c.S3Anonymous {
+			log.Println("未设置s3_access_key和admin_user, S3接口允许匿名访问")
+		} else {
+			log.Println("未设置s3_access_key和admin_user且未允许匿名访问, S3接口拒绝所有请求")
+		}
+	}
+	Conf = c
+}
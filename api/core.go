@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -13,65 +16,86 @@ import (
 	"time"
 
 	tools "../tools"
-	elastic "gopkg.in/olivere/elastic.v5"
 )
 
 // ①上传流程，文件上传至随机文件名，确认好md5后，切片，分片上传至随机data端，最后写ES索引
 // ②下载流程，根据提供的md5，生成下载文件，下载给用户
 const (
-	ELASTIC_URL   = "http://192.168.10.150:9200"
-	ES_INDEX      = "objstorage" // 索引名，所有服务共用一个索引
-	ES_TYPE_SHARD = "shard"      // 分片类型
-	ES_TYPE_FILE  = "file"       // 文件类型
-	ES_TYPE_USER  = "user"       // 用户类型
-	DATA_C        = 4            // 数据块数目
-	PARITY_C      = 2            // 校验块
+	META_DB       = "meta.db" // Bolt后端时，元数据文件名(存放于TmpDir)
+	ES_TYPE_SHARD = "shard"   // 分片类型
+	ES_TYPE_FILE  = "file"    // 文件类型
+	ES_TYPE_USER  = "user"    // 用户类型
 )
 
+// 以下为默认值，启动时由配置覆盖(见config.go)
 var (
-	BaseDir    string                               = "/data1"
-	TmpDir     string                               // 存放临时文件目录，一般为:/data/ip.port/
-	RunningMap = map[string]struct{}{}              // 保存正在执行任务的md5(全局)
-	RunningMU  = &sync.RWMutex{}                    // 保护RunningMap
-	ESearch    = tools.NewES(ELASTIC_URL, ES_INDEX) // ES实例
+	ELASTIC_URL = "http://192.168.10.150:9200"
+	ES_INDEX    = "objstorage" // 索引名，所有服务共用一个索引
+	DATA_C      = 4            // STANDARD存储类型的数据块数目，已有文件后不能修改
+	PARITY_C    = 2            // STANDARD存储类型的校验块，已有文件后不能修改
+	BaseDir     = "/data1"
+	TmpDir      string                  // 存放临时文件目录，一般为:/data/ip.port/
+	MetaBackend = tools.STORE_ES        // 元数据存储类型: es|bolt
+	RunningMap  = map[string]struct{}{} // 保存正在执行任务的md5(全局)
+	RunningMU   = &sync.RWMutex{}       // 保护RunningMap
+	UploadWG    = &sync.WaitGroup{}     // 正在上传切片的任务，退出时等待
+	MetaStore   tools.MetadataStore     // 元数据存储实例
 )
 var (
 	ErrNotFound = errors.New("不存在该文件")
 	ErrUpload   = errors.New("上传文件时出错")
+	ErrExist    = errors.New("已存在该文件")
+	ErrRunning  = errors.New("该文件正在上传")
 )
 
-func init() {
+// 创建临时目录及元数据存储，须在加载配置后调用
+func prepare() {
 	var (
-		tmp string
 		err error
 		f   os.FileInfo
 	)
-	if tmp = os.Getenv("TmpDir"); len(tmp) != 0 {
-		TmpDir = tmp
-	} else {
-		TmpDir = filepath.Join(BaseDir, strings.Replace(ListenAddr, ":", ".", -1))
-	}
 	if f, err = os.Stat(TmpDir); err != nil {
 		if os.IsNotExist(err) {
 			log.Println("创建新的临时目录: ", TmpDir)
 			os.MkdirAll(TmpDir, 0755)
-			return
 		}
-	}
-	if f.IsDir() {
+	} else if f.IsDir() {
 		log.Println("已存在临时目录: ", TmpDir)
 	} else {
 		log.Fatalln("非目录类型: ", TmpDir)
 	}
+
+	// 元数据存储，默认使用ES
+	MetaStore = tools.NewStore(MetaBackend, ELASTIC_URL, ES_INDEX, filepath.Join(TmpDir, META_DB))
+	setupInternal()
+	setupTransfer()
 }
 
 // 文件
 type ObjFile struct {
-	Size     int64      `json:"size"`
-	Create   int64      `json:"create"`
-	Md5      string     `json:"md5"`
-	Name     string     `json:"name"`
-	ObjShard []ObjShard `json:"obj_shard"` // 所有分片的md5
+	Size     int64            `json:"size"`
+	Create   int64            `json:"create"`
+	Md5      string           `json:"md5"`
+	Name     string           `json:"name"`
+	Refs     int64            `json:"refs"`               // 引用数，为0时删除切片
+	Md5Refs  *int64           `json:"md5_refs,omitempty"` // 按md5上传持有的引用数，旧文档没有该字段
+	Owners   map[string]int64 `json:"owners,omitempty"`   // 每个用户按md5上传持有的引用数
+	ACL      []string         `json:"acl,omitempty"`      // 只读用户
+	ObjShard []ObjShard       `json:"obj_shard"`          // 所有分片的md5
+	// 存储类型及切片布局，旧文件没有记录，布局为data_count+parity_count(见class.go)
+	Class       string  `json:"class,omitempty"`
+	DataCount   int     `json:"data_count,omitempty"`
+	ParityCount int     `json:"parity_count,omitempty"`
+	StripeSize  int64   `json:"stripe_size,omitempty"` // 条带大小，只有一个条带时为0(见stripe.go)
+	Stripes     []int64 `json:"stripes,omitempty"`     // 每个条带的大小，条带大小不一致时记录
+	Parts       int     `json:"parts,omitempty"`       // 分段上传的段数，md5为各段md5的md5(见multipart.go)
+
+	job     *Job     // 本次上传对应的任务，不保存
+	journal *Journal // 本次上传的日志，不保存
+	user    string   // 上传者，不保存
+	part    string   // 分段上传时段的id，不保存
+	keyed   bool     // 本次上传的引用由bucket/key持有，不计入owners
+	bind    *ObjKey  // 上传提交后要绑定的bucket/key，不保存
 }
 
 // 检查元数据信息
@@ -79,19 +103,18 @@ func (o *ObjFile) HeadFile(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err  error
 		body []byte
-		res  *elastic.GetResult
 	)
-	if !ESearch.IsExists(ES_TYPE_FILE, o.Md5) {
+	if !MetaStore.IsExists(ES_TYPE_FILE, o.Md5) {
 		log.Println("不存在该文件: ", o.Md5)
 		resp.Write(tools.Json2Byte(404, ErrNotFound.Error()))
 		return
 	}
-	if res, err = ESearch.GetOne(ES_TYPE_FILE, o.Md5); err != nil {
+	if body, err = MetaStore.Get(ES_TYPE_FILE, o.Md5); err != nil {
 		log.Println(err.Error())
 		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
 		return
 	}
-	json.Unmarshal(*res.Source, o)
+	json.Unmarshal(body, o)
 	if body, err = json.Marshal(o); err != nil {
 		log.Println(err.Error())
 		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
@@ -108,146 +131,288 @@ func (o *ObjFile) HeadFile(resp http.ResponseWriter, req *http.Request) {
 	resp.Write(body)
 }
 
+// 删除文件: 带bucket/key时删除该key，否则释放当前用户一次按md5上传的引用
+// 文件的引用数为0时才删除所有切片；管理员没有引用时释放一次不属于任何用户的引用
 func (o *ObjFile) DeleteFile(resp http.ResponseWriter, req *http.Request) {
 	var (
-		sha Sha
-		res *elastic.GetResult
-		err error
+		bucket = req.FormValue(P_BUCKET)
+		key    = req.FormValue(P_KEY)
+		u      = reqUser(req)
+		owner  string
+		refs   int64
+		err    error
 	)
-	if !ESearch.IsExists(ES_TYPE_FILE, o.Md5) {
+	if len(key) != 0 {
+		if err = unbindKey(bucket, key); err == ErrKeyNotFound {
+			resp.Write(tools.Json2Byte(404, err.Error()))
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		} else {
+			resp.Write(tools.Json2Byte(200, "成功删除key: "+bucket+"/"+key))
+		}
+		return
+	}
+	if err = o.loadMeta(); err == ErrNotFound {
 		log.Println("不存在该文件: ", o.Md5)
 		resp.Write(tools.Json2Byte(404, ErrNotFound.Error()))
 		return
-	}
-	if res, err = ESearch.GetOne(ES_TYPE_FILE, o.Md5); err != nil {
+	} else if err != nil {
 		log.Println(err.Error())
 		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
 		return
 	}
-	json.Unmarshal(*res.Source, o)
-	sha = o.ObjShard
-	if err = (&sha).DeleteShard(); err != nil {
-		log.Println(err.Error())
+	if u != nil && (!u.Admin || o.Owners[u.Name] > 0) {
+		owner = u.Name
+	}
+	if refs, err = releaseRef(o.Md5, owner, false); err == Err403 {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	} else if err != nil {
 		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
 		return
 	}
-	// 删除ES中file表
-	if ESearch.IsExists(ES_TYPE_FILE, o.Md5) {
-		if ESearch.Delete(ES_TYPE_FILE, o.Md5); err != nil {
-			log.Println(err.Error())
-			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
-			return
-		}
-		log.Println("ES中删除文档: ", o.Md5)
+	if refs > 0 {
+		resp.Write(tools.Json2Byte(200, fmt.Sprintf("成功释放引用: %s, 剩余引用数: %d", o.Md5, refs)))
+		return
 	}
-	os.Remove(filepath.Join(TmpDir, o.Name)) // 删除合并提供下载的那个文件
 	resp.Write(tools.Json2Byte(200, "成功删除文件: "+o.Md5))
 }
 
+// 发送文件，支持Range以及If-None-Match/If-Modified-Since等条件请求
 func (o *ObjFile) SendFile(resp http.ResponseWriter, req *http.Request) {
-	var (
-		dest string // 最终合成的文件
-		err  error
-		res  *elastic.GetResult // ES返回的结果
-		sha  Sha
-	)
-	if !ESearch.IsExists(ES_TYPE_FILE, o.Md5) {
+	var err error
+	if err = o.loadMeta(); err == ErrNotFound {
 		resp.Write(tools.Json2Byte(404, "不存在该文件: "+o.Md5))
 		return
-	}
-	res, _ = ESearch.GetOne(ES_TYPE_FILE, o.Md5)
-	if err = json.Unmarshal(*res.Source, o); err != nil {
+	} else if err != nil {
 		log.Println(err.Error())
 		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
 		return
 	}
-	// 获取所有切片
-	sha = o.ObjShard
-	if err = (&sha).DownloadShard(); err != nil {
-		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
-		return
+	o.serveContent(resp, req)
+}
+
+// 通过ObjReader发送已加载元数据的文件，ETag见etag()，Last-Modified为上传时间
+// 大文件的发送时间与大小相关，清除写超时，客户端断开时请求的ctx取消，切片请求随之中断
+func (o *ObjFile) serveContent(resp http.ResponseWriter, req *http.Request) {
+	var (
+		r = NewObjReader(req.Context(), o)
+		h = resp.Header()
+	)
+	defer r.Close()
+	http.NewResponseController(resp).SetWriteDeadline(time.Time{})
+	h.Set("ETag", `"`+o.etag()+`"`)
+	if len(h.Get("Content-Type")) == 0 { // 避免ServeContent为探测类型多读一次数据
+		h.Set("Content-Type", "application/octet-stream")
 	}
-	// 整合成文件
-	dest = filepath.Join(TmpDir, o.Name)
-	log.Println("合并文件: ", dest)
-	rs := tools.NewrsFile(o.Name, TmpDir, DATA_C, PARITY_C)
-	if err = rs.GenerateFile(dest, true); err != nil {
-		log.Println(err.Error())
-		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
-		return
+	http.ServeContent(resp, req, o.Name, time.Unix(0, o.Create), r)
+}
+
+// ETag: 文件md5，分段上传的文件为"md5-段数"(与S3相同)
+func (o *ObjFile) etag() string {
+	if o.Parts > 0 {
+		return fmt.Sprintf("%s-%d", o.Md5, o.Parts)
+	}
+	return o.Md5
+}
+
+// 从元数据存储中读取文件信息
+func (o *ObjFile) loadMeta() error {
+	var (
+		body []byte
+		err  error
+	)
+	if !MetaStore.IsExists(ES_TYPE_FILE, o.Md5) {
+		return ErrNotFound
 	}
-	http.ServeFile(resp, req, dest)
+	if body, err = MetaStore.Get(ES_TYPE_FILE, o.Md5); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, o)
 }
 
 // 获取put新建的文件，与dataserver中的FileServer不同的是，该FileServer需要向nsq消息队列提交自己正在
 // 运行的md5，该消息队列相当于全局锁
+// 带sync=1参数或X-Upload-Mode: sync头部时同步上传，所有切片和元数据提交后才返回
 func (o *ObjFile) FileServer(resp http.ResponseWriter, req *http.Request) error {
+	var (
+		err  error
+		pf   multipart.File // form文件
+		sync = req.FormValue(P_SYNC) == "1" || strings.ToLower(req.Header.Get(H_UPLOAD_MODE)) == "sync"
+	)
+	//1. 获取postform文件，复制文件进相关目录
+	if pf, _, err = req.FormFile(P_FILE); err != nil {
+		log.Println("获取form文件时出错: ", err.Error())
+		return ErrUpload
+	}
+	defer pf.Close()
+	return o.storeFile(pf, sync)
+}
+
+// 保存文件内容: 写入临时文件，校验md5后切片，并上传至data server
+// o.Md5为空时，以实际计算出的md5为准
+// 成功时调用方持有该文件的一次引用；已存在该文件时增加引用数并返回ErrExist，此时o.Size已设置
+// sync为true时等待所有切片上传并提交元数据后才返回，否则在后台上传
+func (o *ObjFile) storeFile(r io.Reader, sync bool) error {
 	var (
 		tmp      = filepath.Join(TmpDir, tools.RandomString(8))
 		md5      string
 		shardDir string   // 分片数据存放的位置，一般为/tmpdir/md5sum
+		source   string   // 分条带时的源文件，位于shardDir中
 		shardArr []string // 所有分片的路径全名，用于上传至data server
 		err      error
 		f        *os.File
-		pf       multipart.File // form文件
 	)
 	o.Create = time.Now().UnixNano()
 	o.Name = filepath.Base(tmp)
-	//1. 获取postform文件，复制文件进相关目录
-	if pf, _, err = req.FormFile(P_FILE); err != nil {
-		log.Println("获取form文件时出错: ", err.Error())
-		return ErrUpload
-	}
 	// 复制到临时文件
 	tools.DirExist(filepath.Dir(tmp))
-	f, _ = os.Create(tmp) // 创建临时文件
+	if f, err = os.Create(tmp); err != nil { // 创建临时文件
+		log.Println("创建临时文件出错: ", err.Error())
+		return ErrUpload
+	}
 	defer func() {
 		f.Close()
 		os.Remove(tmp)
 	}()
 
 	//2. MD5判断，是否已经存在ES和正在运行的队列中
-	md5 = tools.Storage(pf, f) // md5判断
+	if md5, err = tools.Storage(r, f); err != nil {
+		log.Println("保存上传文件时出错: ", err.Error())
+		return err
+	}
+	if len(o.Md5) == 0 {
+		o.Md5 = md5
+	}
 	if o.Md5 != md5 {
 		log.Println("上传文件MD5不一致: ", o.Md5, md5)
-		return ErrUpload
+		return ErrMD5
 	}
-	RunningMU.RLock()
+	finfo, _ := f.Stat()
+	o.Size = finfo.Size() // 设置大小
+	RunningMU.Lock()
 	_, ok := RunningMap[o.Md5]
-	RunningMU.RUnlock()
+	if !ok {
+		RunningMap[o.Md5] = struct{}{} // 加运行锁，上传结束后去掉
+	}
+	RunningMU.Unlock()
 	if ok {
 		log.Println("该MD5存在于运行队列: ", o.Md5)
-		return ErrUpload
-	}
-	if ESearch.IsExists(ES_TYPE_FILE, o.Md5) {
-		log.Println("ES中已存在该文档: ", o.Md5)
-		return ErrUpload
+		return ErrRunning
 	}
-
-	finfo, _ := f.Stat()
-	o.Size = finfo.Size() // 设置大小
 	shardDir = filepath.Join(TmpDir, o.Md5)
-	tools.DirExist(shardDir)
+	if MetaStore.IsExists(ES_TYPE_FILE, o.Md5) {
+		log.Println("ES中已存在该文档，增加引用: ", o.Md5)
+		o.finishUpload(shardDir)
+		if _, err = holdRef(o.Md5, o.owner(), o.keyed); err != nil {
+			return ErrUpload
+		}
+		return ErrExist
+	}
+	o.initRefs()
+	if o.DataCount == 0 {
+		o.setClass("")
+	}
 
 	// 开始切片
-	RunningMU.Lock()
-	RunningMap[o.Md5] = struct{}{}
-	RunningMU.Unlock()
-	defer func() {
-		RunningMU.Lock() // 去掉运行锁
-		delete(RunningMap, o.Md5)
-		log.Println("RuningMap中删除Key: ", o.Md5)
-		RunningMU.Unlock()
-	}()
-	rs := tools.NewrsFile(tmp, shardDir, DATA_C, PARITY_C)
-	if shardArr, err = rs.RSSplit(); err != nil { // 切片，并返回所有切片数组
-		log.Println("切片时出错: ", err.Error())
+	tools.DirExist(shardDir)
+	dataCount, parityCount := o.layout()
+	if StripeSize > 0 && o.Size > StripeSize {
+		// 分条带: 源文件移到切片目录，上传时再逐个条带切片
+		o.StripeSize = StripeSize
+		source = filepath.Join(shardDir, o.Name)
+		if err = os.Rename(tmp, source); err != nil {
+			log.Println("移动源文件出错: ", err.Error())
+			o.finishUpload(shardDir)
+			return ErrUpload
+		}
+		rs := tools.NewrsFile(source, shardDir, dataCount, parityCount)
+		shardArr = make([]string, o.stripeCount()*(dataCount+parityCount))
+		for k := range shardArr {
+			shardArr[k] = rs.ShardName(k)
+		}
+		log.Printf("分条带上传: %s %s(%d+%d) 条带数: %d\n", shardDir, o.Class, dataCount, parityCount, o.stripeCount())
+	} else {
+		rs := tools.NewrsFile(tmp, shardDir, dataCount, parityCount)
+		if shardArr, err = rs.RSSplit(); err != nil { // 切片，并返回所有切片数组
+			log.Println("切片时出错: ", err.Error())
+			o.finishUpload(shardDir)
+			return ErrUpload
+		}
+		log.Printf("success, 切片成功: %s %s(%d+%d)\n", shardDir, o.Class, dataCount, parityCount)
+	}
+	o.job = NewJob(o.Md5, o.user, shardArr)
+	if o.journal, err = NewJournal(o, shardDir, source, shardArr); err != nil { // 日志落盘后才开始上传
+		o.job.SetStatus(JOB_FAILED, err)
+		o.finishUpload(shardDir)
 		return ErrUpload
 	}
-	log.Println("success, 切片成功: ", shardDir)
 
 	// 上传切片至data server
-	sha := make(Sha, DATA_C+PARITY_C)
-	go (&sha).UploadShard(o, shardArr)
+	UploadWG.Add(1)
+	if sync {
+		return o.uploadShard(make(Sha, len(shardArr)), shardArr, shardDir)
+	}
+	go o.uploadShard(make(Sha, len(shardArr)), shardArr, shardDir)
+	return nil
+}
+
+// 上传切片并提交元数据，结束后清理临时切片并去掉运行锁
+// sha中已有的切片位置对应shardArr中的""，不再上传(继续上传时使用)
+// 调用前须UploadWG.Add(1)
+func (o *ObjFile) uploadShard(sha Sha, shardArr []string, shardDir string) error {
+	var err error
+	defer UploadWG.Done()
+	defer o.finishUpload(shardDir)
+	o.job.SetStatus(JOB_RUNNING, nil)
+	if err = (&sha).UploadShard(context.Background(), o, shardArr); err != nil {
+		log.Printf("文件上传失败: %s %s\n", o.Md5, err.Error())
+		o.job.SetStatus(JOB_FAILED, err)
+		return err
+	}
+	o.job.SetStatus(JOB_DONE, nil)
 	return nil
 }
+
+// 绑定o.bind到本次上传的文件，调用前本次上传须已持有一次引用
+func (o *ObjFile) bindPending() error {
+	if o.bind == nil {
+		return nil
+	}
+	return bindKey(&ObjKey{
+		Bucket: o.bind.Bucket,
+		Key:    o.bind.Key,
+		Md5:    o.Md5,
+		Size:   o.Size,
+		Create: time.Now().UnixNano(),
+	})
+}
+
+// 本次上传持有的引用所属的用户，带key上传或未启用鉴权时为空
+// 新文件的引用: 本次上传持有一次引用
+func (o *ObjFile) initRefs() {
+	var md5Refs int64
+	o.Refs = 1
+	if !o.keyed {
+		md5Refs = 1
+	}
+	o.Md5Refs = &md5Refs
+	if owner := o.owner(); len(owner) != 0 {
+		o.Owners = map[string]int64{owner: 1}
+	}
+}
+
+func (o *ObjFile) owner() string {
+	if o.keyed {
+		return ""
+	}
+	return o.user
+}
+
+func (o *ObjFile) finishUpload(shardDir string) {
+	os.RemoveAll(shardDir)
+	RunningMU.Lock() // 去掉运行锁
+	delete(RunningMap, o.Md5)
+	log.Println("RuningMap中删除Key: ", o.Md5)
+	RunningMU.Unlock()
+}
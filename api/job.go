@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tools "../tools"
+)
+
+// 上传任务: 每次切片上传对应一个job，记录每个分片的上传状态
+// job保存在元数据存储中，api服务重启后仍然可以查询
+// GET /jobs/{id} 查询任务状态
+
+const (
+	ES_TYPE_JOB = "job" // 上传任务类型
+
+	JOB_PENDING = "pending" // 已切片，等待上传
+	JOB_RUNNING = "running" // 正在上传
+	JOB_DONE    = "done"    // 所有分片和元数据已提交
+	JOB_FAILED  = "failed"  // 上传失败
+
+	SHARD_PENDING  = "pending"  // 等待上传
+	SHARD_UPLOADED = "uploaded" // 已上传至data server
+	SHARD_FAILED   = "failed"   // 上传失败(可能还会重试)
+	SHARD_ROLLBACK = "rollback" // 任务失败，已从data server删除
+)
+
+var (
+	JobTTL           = 7 * 24 * time.Hour // 已结束的任务保留时间
+	JobCleanInterval = time.Hour          // 清理已结束任务的时间间隔
+)
+
+var (
+	ErrJobNotFound = errors.New("不存在该任务")
+	ErrJobAbort    = errors.New("api服务重启，上传中断")
+)
+
+type Job struct {
+	ID     string     `json:"id"`
+	Md5    string     `json:"md5"`
+	Server string     `json:"server"`         // 执行任务的api服务
+	User   string     `json:"user,omitempty"` // 上传者，只有上传者和管理员可以查询
+	Status string     `json:"status"`
+	Error  string     `json:"error"`
+	Create int64      `json:"create"`
+	Update int64      `json:"update"`
+	Shards []JobShard `json:"shards"`
+
+	mu *sync.Mutex
+}
+
+type JobShard struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"` // 切片文件名
+	Status string `json:"status"`
+	Server string `json:"server"` // 上传到的data server
+}
+
+// 新建任务，user为上传者，shardArr为所有切片的路径
+func NewJob(md5, user string, shardArr []string) *Job {
+	var now = time.Now().UnixNano()
+	j := &Job{
+		ID:     tools.RandomString(16),
+		Md5:    md5,
+		Server: ListenAddr,
+		User:   user,
+		Status: JOB_PENDING,
+		Create: now,
+		Update: now,
+		Shards: make([]JobShard, len(shardArr)),
+		mu:     &sync.Mutex{},
+	}
+	for i := range shardArr {
+		j.Shards[i] = JobShard{
+			Index:  i,
+			Name:   filepath.Base(shardArr[i]),
+			Status: SHARD_PENDING,
+		}
+	}
+	j.save()
+	return j
+}
+
+// 修改任务状态，err不为nil时记录错误信息
+func (j *Job) SetStatus(status string, err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.Status = status
+	if err != nil {
+		j.Error = err.Error()
+	}
+	j.mu.Unlock()
+	j.save()
+}
+
+// 修改分片状态
+func (j *Job) SetShard(index int, status, server string) {
+	if j == nil || index >= len(j.Shards) {
+		return
+	}
+	j.mu.Lock()
+	j.Shards[index].Status = status
+	j.Shards[index].Server = server
+	j.mu.Unlock()
+	j.save()
+}
+
+func (j *Job) save() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Update = time.Now().UnixNano()
+	if _, err := MetaStore.Add(ES_TYPE_JOB, j.ID, j); err != nil {
+		log.Println("保存任务出错: ", j.ID, err.Error())
+	}
+}
+
+// 读取任务
+func GetJob(id string) (*Job, error) {
+	var (
+		j    = &Job{mu: &sync.Mutex{}}
+		body []byte
+		err  error
+	)
+	if body, err = MetaStore.Get(ES_TYPE_JOB, id); err != nil {
+		return nil, ErrJobNotFound
+	}
+	if err = json.Unmarshal(body, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// 启动时处理本节点未结束的任务: 上传goroutine已不存在，标记为失败
+// 已通过上传日志继续上传的任务(在RunningMap中)除外
+func recoverJobs() {
+	var jobs []*Job
+	RunningMU.RLock()
+	MetaStore.Scan(ES_TYPE_JOB, "", func(id string, doc []byte) bool {
+		j := &Job{mu: &sync.Mutex{}}
+		if json.Unmarshal(doc, j) == nil && j.Server == ListenAddr &&
+			(j.Status == JOB_PENDING || j.Status == JOB_RUNNING) {
+			if _, ok := RunningMap[j.Md5]; !ok {
+				jobs = append(jobs, j)
+			}
+		}
+		return true
+	})
+	RunningMU.RUnlock()
+	for _, j := range jobs {
+		log.Println("上传任务被中断: ", j.ID, j.Md5)
+		j.SetStatus(JOB_FAILED, ErrJobAbort)
+	}
+}
+
+// 定期清理已结束的任务
+func cleanJobs() {
+	for {
+		var (
+			ids []string
+			now = time.Now().UnixNano()
+		)
+		MetaStore.Scan(ES_TYPE_JOB, "", func(id string, doc []byte) bool {
+			var j Job
+			if json.Unmarshal(doc, &j) == nil && (j.Status == JOB_DONE || j.Status == JOB_FAILED) &&
+				now-j.Update > JobTTL.Nanoseconds() {
+				ids = append(ids, id)
+			}
+			return true
+		})
+		for _, id := range ids {
+			MetaStore.Delete(ES_TYPE_JOB, id)
+		}
+		if len(ids) != 0 {
+			log.Println("清理已结束的上传任务: ", len(ids))
+		}
+		time.Sleep(JobCleanInterval)
+	}
+}
+
+// 查询任务: GET /jobs/{id}
+func handlerJob(resp http.ResponseWriter, req *http.Request) {
+	var (
+		id  = strings.TrimPrefix(req.URL.Path, "/jobs/")
+		j   *Job
+		err error
+	)
+	if req.Method != "GET" {
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+		return
+	}
+	if j, err = GetJob(id); err == ErrJobNotFound {
+		resp.Write(tools.Json2Byte(404, err.Error()+": "+id))
+		return
+	} else if err != nil {
+		log.Println(err.Error())
+		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		return
+	}
+	if u := reqUser(req); !isAdmin(u) && j.User != u.Name {
+		resp.Write(tools.Json2Byte(404, ErrJobNotFound.Error()+": "+id))
+		return
+	}
+	resp.Write(tools.Json2ByteObj(200, j))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tools "../tools"
+)
+
+// 上传日志(write-ahead journal): 切片完成后到元数据提交前，记录上传中的文件
+//   ①切片后写入日志，记录本地切片路径及其md5
+//   ②每次向data server上传切片前，先记录目标服务器(attempts)，上传成功后记录位置(placed)
+//   ③元数据提交后删除上传失败的位置上残留的切片，全部删除成功后删除日志；
+//     失败时删除所有尝试过的切片，全部删除成功后删除日志
+// 每次修改都先写临时文件并落盘，再rename覆盖，api服务异常退出后不会读到半个日志
+//
+// api服务启动时处理所有遗留日志:
+//   元数据已提交的删除残留切片后清理；本地切片完整的继续上传；否则回滚已上传的切片
+
+const (
+	JOURNAL_DIR      = "journal"  // 日志目录(存放于TmpDir)
+	JOURNAL_UPLOAD   = "upload"   // 正在上传
+	JOURNAL_ROLLBACK = "rollback" // 回滚未完成，需要再次删除已上传的切片
+	JOURNAL_COMMIT   = "commit"   // 元数据已提交，残留的切片未删除完
+)
+
+var (
+	JournalResumeDelay = 3 * time.Second // 启动后等待data节点心跳再继续上传
+)
+
+var (
+	ErrJournal = errors.New("写上传日志出错")
+)
+
+type Journal struct {
+	File     ObjFile        `json:"file"`
+	Job      string         `json:"job"` // 上传任务id
+	State    string         `json:"state"`
+	ShardDir string         `json:"shard_dir"`        // 本地切片目录
+	Source   string         `json:"source,omitempty"` // 分条带上传时的源文件，切片在上传前才切出
+	Part     string         `json:"part,omitempty"`   // 分段上传时段的id，重启后不继续上传
+	ShardArr []string       `json:"shard_arr"`        // 本地切片路径
+	ShardMd5 []string       `json:"shard_md5"`        // 切片md5，续传前用于校验本地切片，分条带时切片后才记录
+	Placed   []ObjShard     `json:"placed"`           // 已确认上传的切片，下标与ShardArr对应
+	Attempts []JournalShard `json:"attempts"`         // 所有尝试上传过的位置，回滚时全部删除
+	Bind     *ObjKey        `json:"bind,omitempty"`   // 提交后要绑定的bucket/key
+
+	path string
+	mu   *sync.Mutex
+}
+
+type JournalShard struct {
+	Index int `json:"index"`
+	ObjShard
+}
+
+// 切片完成后新建日志，日志落盘后才开始上传
+// source不为空时为分条带上传，此时还没有切片
+func NewJournal(o *ObjFile, shardDir, source string, shardArr []string) (*Journal, error) {
+	var (
+		j = &Journal{
+			File:     *o,
+			State:    JOURNAL_UPLOAD,
+			ShardDir: shardDir,
+			Source:   source,
+			Part:     o.part,
+			Bind:     o.bind,
+			ShardArr: shardArr,
+			ShardMd5: make([]string, len(shardArr)),
+			Placed:   make([]ObjShard, len(shardArr)),
+			path:     filepath.Join(TmpDir, JOURNAL_DIR, o.Md5+".json"),
+			mu:       &sync.Mutex{},
+		}
+		err error
+	)
+	if o.job != nil {
+		j.Job = o.job.ID
+	}
+	if len(o.part) != 0 { // 段的md5可能与其他文件或段相同，同一段也可能同时上传多次
+		j.path = filepath.Join(TmpDir, JOURNAL_DIR, o.part+"."+o.Name+".json")
+	}
+	for i := 0; i < len(shardArr) && len(source) == 0; i++ {
+		if j.ShardMd5[i], err = tools.Md5Get(shardArr[i]); err != nil {
+			log.Println("获取切片MD5失败: ", shardArr[i], err.Error())
+			return nil, err
+		}
+	}
+	if err = j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// 记录第index个切片将上传到server，返回切片位置
+func (j *Journal) place(index int, server string) (ObjShard, error) {
+	var (
+		s = ObjShard{
+			Md5:      j.ShardMd5[index],
+			BaseName: filepath.Base(j.ShardArr[index]),
+			Server:   server,
+		}
+		err error
+	)
+	j.mu.Lock()
+	exist := false
+	for _, a := range j.Attempts {
+		if a.Index == index && a.Server == s.Server {
+			exist = true
+			break
+		}
+	}
+	if !exist {
+		j.Attempts = append(j.Attempts, JournalShard{Index: index, ObjShard: s})
+	}
+	j.mu.Unlock()
+	if !exist {
+		if err = j.save(); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// 记录第index个切片已上传成功
+func (j *Journal) placed(index int, s ObjShard) {
+	j.mu.Lock()
+	j.Placed[index] = s
+	j.mu.Unlock()
+	j.save()
+}
+
+// 元数据已提交，后台删除上传失败的位置上可能残留的切片，全部成功后删除日志，否则留待重启后再次删除
+// data节点上切片文档属于其他节点时只删除切片文件，不影响已提交的切片
+func (j *Journal) commit() {
+	var stray []ObjShard
+	for _, a := range j.Attempts {
+		if j.Placed[a.Index].Server != a.Server {
+			stray = append(stray, a.ObjShard)
+		}
+	}
+	if len(stray) == 0 {
+		j.remove()
+		return
+	}
+	j.mu.Lock()
+	j.State = JOURNAL_COMMIT
+	j.mu.Unlock()
+	if j.save() != nil {
+		return
+	}
+	UploadWG.Add(1)
+	go func() {
+		defer UploadWG.Done()
+		ok := true
+		errs := transferAll(context.Background(), len(stray), func(i int) error {
+			return deleteOne(context.Background(), &stray[i])
+		})
+		for i, err := range errs {
+			if err != nil {
+				log.Println("删除残留切片失败: ", stray[i].Server, stray[i].BaseName, err.Error())
+				ok = false
+			}
+		}
+		if ok {
+			j.remove()
+		}
+	}()
+}
+
+// 删除所有尝试上传过的切片，全部成功后删除日志，否则留待重启后再次回滚
+func (j *Journal) rollback(job *Job) bool {
+	var ok = true
+	for _, a := range j.Attempts {
+		if err := deleteOne(context.Background(), &a.ObjShard); err != nil {
+			log.Println("回滚分片失败: ", a.Server, a.BaseName)
+			ok = false
+			continue
+		}
+		job.SetShard(a.Index, SHARD_ROLLBACK, a.Server)
+	}
+	if !ok {
+		j.mu.Lock()
+		j.State = JOURNAL_ROLLBACK
+		j.mu.Unlock()
+		j.save()
+		return false
+	}
+	j.remove()
+	return true
+}
+
+func (j *Journal) save() error {
+	var (
+		tmp  = j.path + ".tmp"
+		body []byte
+		f    *os.File
+		err  error
+	)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if body, err = json.Marshal(j); err != nil {
+		return err
+	}
+	tools.DirExist(filepath.Dir(j.path))
+	if f, err = os.Create(tmp); err != nil {
+		log.Println("创建上传日志出错: ", err.Error())
+		return ErrJournal
+	}
+	if _, err = f.Write(body); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		log.Println("写上传日志出错: ", j.path, err.Error())
+		os.Remove(tmp)
+		return ErrJournal
+	}
+	return nil
+}
+
+func (j *Journal) remove() {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		log.Println("删除上传日志出错: ", j.path, err.Error())
+	}
+}
+
+// 本地未上传的切片是否都还在，且与切片时的md5一致
+// 分条带上传时检查源文件，缺少的切片上传前从源文件重新切出
+func (j *Journal) resumable() bool {
+	if len(j.Source) != 0 {
+		if !tools.FileExist(j.Source) || !tools.MD5Diff(j.File.Md5, j.Source) {
+			log.Println("源文件缺失或已损坏: ", j.Source)
+			return false
+		}
+		return true
+	}
+	for i, src := range j.ShardArr {
+		if len(j.Placed[i].Server) != 0 {
+			continue
+		}
+		if !tools.FileExist(src) || !tools.MD5Diff(j.ShardMd5[i], src) {
+			log.Println("本地切片缺失或已损坏: ", src)
+			return false
+		}
+	}
+	return true
+}
+
+// 启动时处理上一次运行遗留的上传日志，需要在处理上传任务(recoverJobs)之前调用
+func recoverUploads() {
+	var (
+		dir   = filepath.Join(TmpDir, JOURNAL_DIR)
+		known = map[string]struct{}{} // 日志中记录的本地切片目录
+		infos []os.FileInfo
+		err   error
+	)
+	if infos, err = ioutil.ReadDir(dir); err != nil && !os.IsNotExist(err) {
+		log.Println("读取上传日志目录出错: ", err.Error())
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if !strings.HasSuffix(path, ".json") {
+			os.Remove(path) // 写了一半的临时文件
+			continue
+		}
+		j := &Journal{path: path, mu: &sync.Mutex{}}
+		body, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(body, j)
+		}
+		if err != nil || len(j.Placed) != len(j.ShardArr) || len(j.ShardMd5) != len(j.ShardArr) {
+			log.Println("无效的上传日志: ", path)
+			continue
+		}
+		known[filepath.Base(j.ShardDir)] = struct{}{}
+		j.recover()
+	}
+
+	os.RemoveAll(filepath.Join(TmpDir, MULTIPART_DIR)) // 分段上传的段不继续上传
+
+	// 切片后、写日志前退出时遗留的本地切片目录(以md5命名)
+	if infos, err = ioutil.ReadDir(TmpDir); err != nil {
+		return
+	}
+	for _, info := range infos {
+		if _, ok := known[info.Name()]; ok || !info.IsDir() || len(info.Name()) != 32 {
+			continue
+		}
+		log.Println("删除遗留的切片目录: ", info.Name())
+		os.RemoveAll(filepath.Join(TmpDir, info.Name()))
+	}
+}
+
+func (j *Journal) recover() {
+	var (
+		o   = j.File
+		job *Job
+	)
+	if len(j.Job) != 0 {
+		job, _ = GetJob(j.Job)
+	}
+	o.job = job
+	o.journal = j
+	o.bind = j.Bind
+	switch {
+	case j.State == JOURNAL_COMMIT:
+		log.Println("删除上次未删除完的残留切片: ", o.Md5)
+		os.RemoveAll(j.ShardDir)
+		j.commit()
+	case len(j.Part) != 0 && partCommitted(j.Part, o.Name):
+		log.Println("上传日志对应的段已提交: ", j.Part)
+		os.RemoveAll(j.ShardDir)
+		j.commit()
+	case len(j.Part) != 0: // 客户端没有收到成功响应，会重新上传该段
+		log.Println("回滚未完成的段: ", j.Part)
+		os.RemoveAll(j.ShardDir)
+		j.rollback(nil)
+	case j.State == JOURNAL_UPLOAD && MetaStore.IsExists(ES_TYPE_FILE, o.Md5) && !o.committed():
+		os.RemoveAll(j.ShardDir)
+		if err := o.adopt(); err != nil {
+			job.SetStatus(JOB_FAILED, err)
+		} else {
+			job.SetStatus(JOB_DONE, nil)
+		}
+	case j.State == JOURNAL_UPLOAD && MetaStore.IsExists(ES_TYPE_FILE, o.Md5):
+		log.Println("上传日志对应的元数据已提交: ", o.Md5)
+		os.RemoveAll(j.ShardDir)
+		// 退出前可能已绑定，新文件不会有其他key已指向它，已指向时不再绑定以免重复释放引用
+		if o.bind != nil {
+			if k := getObjKey(o.bind.Bucket, o.bind.Key); k != nil && k.Md5 == o.Md5 {
+				o.bind = nil
+			}
+		}
+		if err := o.bindPending(); err != nil {
+			job.SetStatus(JOB_FAILED, err)
+		} else {
+			job.SetStatus(JOB_DONE, nil)
+		}
+		j.commit()
+	case j.State == JOURNAL_UPLOAD && j.resumable():
+		log.Println("继续上传: ", o.Md5)
+		var (
+			sha      = make(Sha, len(j.ShardArr))
+			shardArr = make([]string, len(j.ShardArr))
+		)
+		for i := range j.ShardArr {
+			if len(j.Placed[i].Server) != 0 {
+				sha[i] = j.Placed[i] // 已上传的切片不再上传
+			} else {
+				shardArr[i] = j.ShardArr[i]
+			}
+		}
+		RunningMU.Lock()
+		RunningMap[o.Md5] = struct{}{}
+		RunningMU.Unlock()
+		UploadWG.Add(1)
+		go func() {
+			time.Sleep(JournalResumeDelay)
+			o.uploadShard(sha, shardArr, j.ShardDir)
+		}()
+	default:
+		log.Println("回滚未完成的上传: ", o.Md5)
+		os.RemoveAll(j.ShardDir)
+		job.SetStatus(JOB_FAILED, ErrJobAbort)
+		j.rollback(job)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tools "../tools"
+)
+
+// 分段上传: 大文件分成多段上传，每段到达后立即切片并上传至data节点，完成时合并为一个文件
+//   POST   /multipart?bucket=&key=            初始化，返回upload_id，可带X-Storage-Class头部
+//   PUT    /multipart?upload_id=&part=N&md5=  上传第N段(1-10000)，请求体为该段内容(或表单字段uploadfile)，md5可选
+//   GET    /multipart?upload_id=              查看已上传的段
+//   POST   /multipart?upload_id=              完成: 按段号顺序合并所有段，提交file文档
+//   DELETE /multipart?upload_id=              放弃: 删除已上传的段
+// 每段单独分条带切片，合并时只拼接条带清单(stripes)和切片，不需要重新编码
+// 合并后文件的md5与S3相同，为各段md5(二进制)拼接后的md5，ETag为"md5-段数"
+// 同一段号重复上传时以最后提交的为准，每次上传的临时目录和日志以段id加本次的切片名前缀命名，重试或并发上传同一段时互不影响
+// 段的大小不确定，上传段时不设置读写超时；超过MultipartTTL未完成的上传会被清理
+// 同一个上传的所有请求须发给同一个apiserv
+
+const (
+	ES_TYPE_UPLOAD = "upload"    // 分段上传类型
+	ES_TYPE_PART   = "part"      // 已上传的段，id为upload_id.段号
+	MULTIPART_DIR  = "multipart" // 段的临时目录(存放于TmpDir)
+
+	P_UPLOAD_ID = "upload_id"
+	P_PART      = "part"
+
+	UPLOAD_COMPLETED = "completed" // 已提交file文档，正在清理段
+	UPLOAD_ABORTED   = "aborted"   // 已放弃，正在删除段
+
+	MAX_PART_NUMBER = 10000
+)
+
+var (
+	MultipartTTL       = 7 * 24 * time.Hour // 未完成的上传保留时间
+	MaxPartSize  int64 = 5 << 30            // 每段的最大大小
+	UploadMU           = &sync.RWMutex{}    // 提交段时读锁，完成或放弃时写锁
+	PartMU             = &sync.Mutex{}      // 提交段时保护被覆盖的段，以免并发上传同一段时遗漏
+)
+
+var (
+	ErrUploadNotFound = errors.New("不存在该分段上传")
+	ErrPartNumber     = errors.New("无效的段号")
+	ErrPartSize       = errors.New("段的大小有误")
+	ErrNoParts        = errors.New("没有已上传的段")
+)
+
+// 分段上传
+type Upload struct {
+	ID          string `json:"id"`
+	Bucket      string `json:"bucket,omitempty"`
+	Key         string `json:"key,omitempty"`
+	User        string `json:"user,omitempty"` // 发起者，只有发起者和管理员可以操作
+	Class       string `json:"class"`
+	DataCount   int    `json:"data_count"`
+	ParityCount int    `json:"parity_count"`
+	State       string `json:"state,omitempty"` // 为空时正在上传
+	Md5         string `json:"md5,omitempty"`   // 合并后文件的md5
+	Create      int64  `json:"create"`
+}
+
+// 已上传的段
+type Part struct {
+	Upload   string     `json:"upload"`
+	Number   int        `json:"number"`
+	Name     string     `json:"name"` // 切片名前缀
+	Size     int64      `json:"size"`
+	Md5      string     `json:"md5"`
+	Stripes  []int64    `json:"stripes"` // 每个条带的大小
+	ObjShard []ObjShard `json:"obj_shard"`
+	Create   int64      `json:"create"`
+}
+
+func partID(upload string, n int) string {
+	return fmt.Sprintf("%s.%05d", upload, n)
+}
+
+func getUpload(id string) *Upload {
+	var u = new(Upload)
+	body, err := MetaStore.Get(ES_TYPE_UPLOAD, id)
+	if err != nil || json.Unmarshal(body, u) != nil {
+		return nil
+	}
+	return u
+}
+
+func getPart(id string) *Part {
+	var p = new(Part)
+	body, err := MetaStore.Get(ES_TYPE_PART, id)
+	if err != nil || json.Unmarshal(body, p) != nil {
+		return nil
+	}
+	return p
+}
+
+// 段是否已提交，name为段的切片名前缀
+func partCommitted(id, name string) bool {
+	p := getPart(id)
+	return p != nil && p.Name == name
+}
+
+// 按段号顺序返回所有已上传的段
+func (u *Upload) listParts() []*Part {
+	var parts []*Part
+	MetaStore.Scan(ES_TYPE_PART, u.ID+".", func(id string, doc []byte) bool {
+		p := new(Part)
+		if json.Unmarshal(doc, p) == nil && p.Upload == u.ID {
+			parts = append(parts, p)
+		}
+		return true
+	})
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts
+}
+
+// 删除段的所有切片
+func (p *Part) deleteShards() error {
+	sha := Sha(p.ObjShard)
+	return (&sha).DeleteShard(context.Background())
+}
+
+// 处理分段上传相关请求
+func handlerMultipart(resp http.ResponseWriter, req *http.Request) {
+	var (
+		id = req.URL.Query().Get(P_UPLOAD_ID) // 不解析表单，PUT的请求体为段的内容
+		u  *Upload
+	)
+	if len(id) == 0 {
+		if req.Method != "POST" {
+			resp.Write(tools.Json2Byte(405, Err405.Error()))
+			return
+		}
+		initiateUpload(resp, req)
+		return
+	}
+	if u = getUpload(id); u == nil || len(u.State) != 0 {
+		resp.Write(tools.Json2Byte(404, ErrUploadNotFound.Error()+": "+id))
+		return
+	}
+	if user := reqUser(req); !isAdmin(user) && user.Name != u.User {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	switch req.Method {
+	case "PUT":
+		u.putPart(resp, req)
+	case "GET":
+		var parts []map[string]interface{}
+		for _, p := range u.listParts() {
+			parts = append(parts, map[string]interface{}{
+				"part": p.Number, "md5": p.Md5, "size": p.Size, "create": p.Create,
+			})
+		}
+		resp.Write(tools.Json2ByteObj(200, map[string]interface{}{"upload": u, "parts": parts}))
+	case "POST":
+		u.complete(resp, req)
+	case "DELETE":
+		if err := u.abort(); err == ErrUploadNotFound {
+			resp.Write(tools.Json2Byte(404, err.Error()+": "+id))
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		} else {
+			resp.Write(tools.Json2Byte(200, "已放弃分段上传: "+id))
+		}
+	default:
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+	}
+}
+
+// 初始化分段上传，带bucket/key时完成后绑定该key
+func initiateUpload(resp http.ResponseWriter, req *http.Request) {
+	var (
+		u = &Upload{
+			ID:     tools.RandomString(16),
+			Bucket: req.FormValue(P_BUCKET),
+			Key:    req.FormValue(P_KEY),
+			Create: time.Now().UnixNano(),
+		}
+		c   StorageClass
+		err error
+	)
+	if len(u.Key) != 0 && !bucketAllowed(req, u.Bucket, true) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if len(u.Key) != 0 && !validBucket(u.Bucket) {
+		resp.Write(tools.Json2Byte(400, ErrBucketName.Error()+": "+u.Bucket)) // 完成时才创建bucket，提前检查
+		return
+	}
+	if c, err = getClass(req.Header.Get(H_STORAGE_CLASS)); err != nil {
+		resp.Write(tools.Json2Byte(400, err.Error()+": "+req.Header.Get(H_STORAGE_CLASS)))
+		return
+	}
+	u.Class, u.DataCount, u.ParityCount = c.Name, c.Data, c.Parity
+	if user := reqUser(req); user != nil {
+		u.User = user.Name
+	}
+	if _, err = MetaStore.Add(ES_TYPE_UPLOAD, u.ID, u); err != nil {
+		log.Println("保存分段上传出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		return
+	}
+	log.Printf("初始化分段上传: %s %s/%s\n", u.ID, u.Bucket, u.Key)
+	resp.Write(tools.Json2ByteObj(200, map[string]string{P_UPLOAD_ID: u.ID}))
+}
+
+// 上传一段: 保存到临时目录，按条带切片并上传，成功后提交段的文档
+func (u *Upload) putPart(resp http.ResponseWriter, req *http.Request) {
+	var (
+		q        = req.URL.Query()
+		want     = strings.ToLower(q.Get(P_MD5))
+		n, err   = strconv.Atoi(q.Get(P_PART))
+		p        = &Part{Upload: u.ID, Number: n, Name: tools.RandomString(8), Create: time.Now().UnixNano()}
+		dir      = filepath.Join(TmpDir, MULTIPART_DIR, partID(u.ID, n)+"."+p.Name) // 本次上传的临时目录
+		source   = filepath.Join(dir, p.Name)
+		body     io.Reader
+		shardArr []string
+		f        *os.File
+	)
+	if err != nil || n < 1 || n > MAX_PART_NUMBER {
+		resp.Write(tools.Json2Byte(400, ErrPartNumber.Error()+": "+q.Get(P_PART)))
+		return
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		pf, _, err := req.FormFile(P_FILE)
+		if err != nil {
+			log.Println("获取form文件时出错: ", err.Error())
+			resp.Write(tools.Json2Byte(400, ErrUpload.Error()))
+			return
+		}
+		defer pf.Close()
+		body = pf
+	} else {
+		body = req.Body
+	}
+
+	// 保存到临时文件并计算md5
+	tools.DirExist(dir)
+	defer os.RemoveAll(dir)
+	if f, err = os.Create(source); err != nil {
+		log.Println("创建临时文件出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, ErrUpload.Error()))
+		return
+	}
+	p.Md5, err = tools.Storage(io.LimitReader(body, MaxPartSize+1), f)
+	info, _ := f.Stat()
+	f.Close()
+	if err != nil {
+		log.Println("保存段时出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, ErrUpload.Error()))
+		return
+	}
+	if p.Size = info.Size(); p.Size == 0 || p.Size > MaxPartSize {
+		resp.Write(tools.Json2Byte(400, fmt.Sprintf("%s: %d", ErrPartSize.Error(), p.Size)))
+		return
+	}
+	if len(want) != 0 && want != p.Md5 {
+		resp.Write(tools.Json2Byte(400, ErrMD5.Error()))
+		return
+	}
+
+	// 切片并上传，与分条带上传的文件相同
+	o := &ObjFile{
+		Md5:         p.Md5,
+		Size:        p.Size,
+		Name:        p.Name,
+		Class:       u.Class,
+		DataCount:   u.DataCount,
+		ParityCount: u.ParityCount,
+		StripeSize:  StripeSize,
+		part:        partID(u.ID, n),
+	}
+	if o.StripeSize <= 0 || o.StripeSize > o.Size {
+		o.StripeSize = o.Size
+	}
+	dataCount, parityCount := o.layout()
+	rs := tools.NewrsFile(source, dir, dataCount, parityCount)
+	shardArr = make([]string, o.stripeCount()*(dataCount+parityCount))
+	for k := range shardArr {
+		shardArr[k] = rs.ShardName(k)
+	}
+	if o.journal, err = NewJournal(o, dir, source, shardArr); err != nil {
+		resp.Write(tools.Json2Byte(500, ErrUpload.Error()))
+		return
+	}
+	sha := make(Sha, len(shardArr))
+	UploadWG.Add(1)
+	err = sha.uploadShards(req.Context(), o, shardArr) // 客户端断开时取消并回滚
+	UploadWG.Done()
+	if err != nil {
+		log.Printf("段上传失败: %s %s\n", o.part, err.Error())
+		resp.Write(tools.Json2Byte(500, err.Error()))
+		return
+	}
+	p.Stripes = o.stripeSizes()
+	p.ObjShard = sha
+
+	// 提交段，上传期间可能已完成或放弃
+	UploadMU.RLock()
+	PartMU.Lock()
+	old := getPart(o.part)
+	if cur := getUpload(u.ID); cur == nil || len(cur.State) != 0 {
+		PartMU.Unlock()
+		UploadMU.RUnlock()
+		o.journal.rollback(nil)
+		resp.Write(tools.Json2Byte(404, ErrUploadNotFound.Error()+": "+u.ID))
+		return
+	}
+	if _, err = MetaStore.Add(ES_TYPE_PART, o.part, p); err != nil {
+		PartMU.Unlock()
+		UploadMU.RUnlock()
+		log.Println("提交段出错: ", err.Error())
+		o.journal.rollback(nil)
+		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		return
+	}
+	PartMU.Unlock()
+	UploadMU.RUnlock()
+	o.journal.commit()
+	if old != nil && old.deleteShards() != nil { // 重复上传的段
+		log.Println("删除被覆盖的段出错: ", o.part)
+	}
+	log.Printf("成功上传段: %s %s %d\n", o.part, p.Md5, p.Size)
+	resp.Write(tools.Json2ByteObj(200, map[string]interface{}{"part": n, "md5": p.Md5, "size": p.Size}))
+}
+
+// 合并所有段: 文件md5为各段md5拼接后的md5，切片及条带清单按段号顺序拼接
+func (u *Upload) assemble(parts []*Part) *ObjFile {
+	var (
+		o = &ObjFile{
+			Create:      time.Now().UnixNano(),
+			Name:        parts[0].Name,
+			Class:       u.Class,
+			DataCount:   u.DataCount,
+			ParityCount: u.ParityCount,
+			Parts:       len(parts),
+			user:        u.User,
+			keyed:       len(u.Key) != 0,
+		}
+		h = md5.New()
+	)
+	for _, p := range parts {
+		b, _ := hex.DecodeString(p.Md5)
+		h.Write(b)
+		o.Size += p.Size
+		o.Stripes = append(o.Stripes, p.Stripes...)
+		o.ObjShard = append(o.ObjShard, p.ObjShard...)
+	}
+	o.Md5 = hex.EncodeToString(h.Sum(nil))
+	return o
+}
+
+// 完成分段上传，已存在相同的文件时增加引用并删除所有段
+func (u *Upload) complete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		o     *ObjFile
+		parts []*Part
+		dup   bool
+		err   error
+	)
+	UploadMU.Lock()
+	if u = getUpload(u.ID); u == nil || len(u.State) != 0 {
+		UploadMU.Unlock()
+		resp.Write(tools.Json2Byte(404, ErrUploadNotFound.Error()))
+		return
+	}
+	if parts = u.listParts(); len(parts) == 0 {
+		UploadMU.Unlock()
+		resp.Write(tools.Json2Byte(400, ErrNoParts.Error()))
+		return
+	}
+	o = u.assemble(parts)
+	RunningMU.Lock()
+	_, running := RunningMap[o.Md5]
+	if !running {
+		RunningMap[o.Md5] = struct{}{}
+	}
+	RunningMU.Unlock()
+	if running {
+		UploadMU.Unlock()
+		resp.Write(tools.Json2Byte(409, ErrRunning.Error()))
+		return
+	}
+	defer func() {
+		RunningMU.Lock()
+		delete(RunningMap, o.Md5)
+		RunningMU.Unlock()
+	}()
+	u.State, u.Md5 = UPLOAD_COMPLETED, o.Md5
+	_, err = MetaStore.Add(ES_TYPE_UPLOAD, u.ID, u)
+	UploadMU.Unlock()
+	if err != nil {
+		log.Println("保存分段上传出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		return
+	}
+
+	if dup = MetaStore.IsExists(ES_TYPE_FILE, o.Md5); !dup {
+		o.initRefs()
+		if err = MetaStore.Create(ES_TYPE_FILE, o.Md5, o); err == tools.ErrConflict {
+			dup = true // 其他apiserv已提交该文件
+		}
+	}
+	if dup {
+		log.Println("ES中已存在该文档，增加引用: ", o.Md5)
+		_, err = holdRef(o.Md5, o.owner(), o.keyed)
+	}
+	if err != nil {
+		log.Println("提交分段上传的文件出错: ", o.Md5, err.Error())
+		u.State, u.Md5 = "", ""
+		MetaStore.Add(ES_TYPE_UPLOAD, u.ID, u) // 可以重新完成
+		resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		return
+	}
+	log.Printf("完成分段上传: %s -> %s 段数: %d\n", u.ID, o.Md5, len(parts))
+	if err = u.purge(dup); err != nil { // 失败时由cleanUploads继续清理
+		log.Println("清理分段上传出错: ", u.ID, err.Error())
+	}
+	if len(u.Key) != 0 {
+		if err = bindFileKey(o, u.Bucket, u.Key); err != nil {
+			resp.Write(tools.Json2Byte(500, err.Error()))
+			return
+		}
+	}
+	resp.Header().Set("ETag", `"`+o.etag()+`"`)
+	resp.Write(tools.Json2ByteObj(200, map[string]interface{}{
+		"md5":   o.Md5,
+		"etag":  o.etag(),
+		"size":  o.Size,
+		"parts": len(parts),
+	}))
+}
+
+// 放弃分段上传，删除所有段
+func (u *Upload) abort() error {
+	UploadMU.Lock()
+	if u = getUpload(u.ID); u == nil || u.State == UPLOAD_COMPLETED {
+		UploadMU.Unlock()
+		return ErrUploadNotFound
+	}
+	u.State = UPLOAD_ABORTED
+	_, err := MetaStore.Add(ES_TYPE_UPLOAD, u.ID, u)
+	UploadMU.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Println("放弃分段上传: ", u.ID)
+	return u.purge(true)
+}
+
+// 删除所有段的文档，shards为true时同时删除段的切片(未合并或已存在相同文件)，最后删除上传的文档
+func (u *Upload) purge(shards bool) error {
+	for _, p := range u.listParts() {
+		if shards {
+			if err := p.deleteShards(); err != nil {
+				return err
+			}
+		}
+		if _, err := MetaStore.Delete(ES_TYPE_PART, partID(u.ID, p.Number)); err != nil {
+			return err
+		}
+	}
+	_, err := MetaStore.Delete(ES_TYPE_UPLOAD, u.ID)
+	return err
+}
+
+// 定期清理: 超时未完成的上传、完成或放弃时未清理完的段，以及上传已不存在的段
+func cleanUploads() {
+	for {
+		var (
+			uploads []*Upload
+			orphans []*Part
+			now     = time.Now().UnixNano()
+		)
+		MetaStore.Scan(ES_TYPE_UPLOAD, "", func(id string, doc []byte) bool {
+			u := new(Upload)
+			if json.Unmarshal(doc, u) == nil {
+				uploads = append(uploads, u)
+			}
+			return true
+		})
+		for _, u := range uploads {
+			RunningMU.RLock()
+			_, running := RunningMap[u.Md5]
+			RunningMU.RUnlock()
+			switch {
+			case u.State == UPLOAD_COMPLETED && running: // 正在完成
+			case u.State == UPLOAD_COMPLETED && MetaStore.IsExists(ES_TYPE_FILE, u.Md5):
+				f := &ObjFile{Md5: u.Md5}
+				f.loadMeta()
+				parts := u.listParts()
+				u.purge(len(parts) != 0 && f.Name != parts[0].Name) // 合并时已存在相同文件
+			case u.State == UPLOAD_COMPLETED, u.State == UPLOAD_ABORTED:
+				u.purge(true)
+			case now-u.Create > MultipartTTL.Nanoseconds():
+				log.Println("分段上传超时: ", u.ID)
+				u.abort()
+			}
+		}
+		MetaStore.Scan(ES_TYPE_PART, "", func(id string, doc []byte) bool {
+			p := new(Part)
+			if json.Unmarshal(doc, p) == nil && !MetaStore.IsExists(ES_TYPE_UPLOAD, p.Upload) {
+				orphans = append(orphans, p)
+			}
+			return true
+		})
+		for _, p := range orphans {
+			log.Println("删除遗留的段: ", partID(p.Upload, p.Number))
+			if p.deleteShards() == nil {
+				MetaStore.Delete(ES_TYPE_PART, partID(p.Upload, p.Number))
+			}
+		}
+		time.Sleep(JobCleanInterval)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	tools "../tools"
+)
+
+// 命名层: bucket/key -> 文件md5
+// 文件(file文档)以md5为标识按内容存储，多个key可以指向同一个文件，
+// file文档中的refs记录引用数，引用数为0时才真正删除切片
+//
+// 每次成功的PUT(不管是否带key)都持有一次引用:
+//   ①按md5上传，由按md5删除释放，file文档中的md5_refs记录此类引用数，owners记录每个用户持有的此类引用数
+//   ②按bucket/key上传，由删除该key或覆盖该key时释放，引用数为refs-md5_refs
+// 按md5删除最多释放md5_refs次，不会释放key持有的引用
+// file及object文档的修改通过版本号比较后替换(见updateFile、bindKey)，多个apiserv同时修改时不会丢失
+// file文档只在不存在时创建，多个apiserv同时上传同一文件时，后提交的一方删除自己的切片并增加已有文件的引用
+
+const (
+	ES_TYPE_BUCKET = "bucket" // bucket类型
+	ES_TYPE_OBJECT = "object" // object类型，id为bucket/key
+)
+
+var (
+	CASRetry   = 16 // 修改file及object文档时版本冲突的最多重试次数
+	bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.\-]{1,61}[a-z0-9]$`)
+	// 这些名字已被原有接口的路径占用，不能作为bucket名
+	reservedBucket = map[string]struct{}{"file": {}, "checkfile": {}, "jobs": {}, "nodes": {}, "users": {}, "acl": {}, "presign": {}, "multipart": {}, "tus": {}}
+)
+
+var (
+	ErrBucketName     = errors.New("无效bucket名")
+	ErrBucketExist    = errors.New("已存在该bucket")
+	ErrBucketNotFound = errors.New("不存在该bucket")
+	ErrBucketNotEmpty = errors.New("bucket不为空")
+	ErrKeyNotFound    = errors.New("不存在该key")
+	errDeleting       = errors.New("文件正在删除") // 引用数已为0，切片尚未删除完
+)
+
+// bucket文档
+type Bucket struct {
+	Name   string   `json:"name"`
+	Create int64    `json:"create"`
+	Owner  string   `json:"owner,omitempty"` // 创建者，未启用鉴权时为空
+	ACL    []string `json:"acl,omitempty"`   // 只读用户
+}
+
+// object文档，记录key到文件md5的映射
+type ObjKey struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Md5         string `json:"md5"`
+	Size        int64  `json:"size"`
+	Create      int64  `json:"create"`
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag,omitempty"` // 见ObjFile.etag()，由bindKey记录
+}
+
+func (k *ObjKey) id() string {
+	return k.Bucket + "/" + k.Key
+}
+
+// ETag与GET返回的相同，旧版本的object文档没有记录时从文件文档获取
+func (k *ObjKey) etag() string {
+	if len(k.ETag) != 0 {
+		return k.ETag
+	}
+	o := &ObjFile{Md5: k.Md5}
+	if o.loadMeta() == nil {
+		return o.etag()
+	}
+	return k.Md5
+}
+
+// bucket名是否有效，不能与原有接口的路径冲突
+func validBucket(name string) bool {
+	_, ok := reservedBucket[name]
+	return !ok && bucketName.MatchString(name)
+}
+
+// 创建bucket，owner为创建者
+func createBucket(name, owner string) error {
+	if !validBucket(name) {
+		return ErrBucketName
+	}
+	if MetaStore.IsExists(ES_TYPE_BUCKET, name) {
+		return ErrBucketExist
+	}
+	b := &Bucket{
+		Name:   name,
+		Create: time.Now().UnixNano(),
+		Owner:  owner,
+	}
+	if _, err := MetaStore.Add(ES_TYPE_BUCKET, name, b); err != nil {
+		log.Println("创建bucket出错: ", err.Error())
+		return err
+	}
+	log.Println("创建bucket: ", name)
+	return nil
+}
+
+// 删除bucket，bucket中不能有key
+func deleteBucket(name string) error {
+	var empty = true
+	if !MetaStore.IsExists(ES_TYPE_BUCKET, name) {
+		return ErrBucketNotFound
+	}
+	MetaStore.Scan(ES_TYPE_OBJECT, name+"/", func(id string, doc []byte) bool {
+		empty = false
+		return false
+	})
+	if !empty {
+		return ErrBucketNotEmpty
+	}
+	if _, err := MetaStore.Delete(ES_TYPE_BUCKET, name); err != nil {
+		log.Println("删除bucket出错: ", err.Error())
+		return err
+	}
+	log.Println("删除bucket: ", name)
+	return nil
+}
+
+// 获取object文档，不存在时返回nil
+func getObjKey(bucket, key string) *ObjKey {
+	var (
+		k    = new(ObjKey)
+		body []byte
+		err  error
+	)
+	if body, err = MetaStore.Get(ES_TYPE_OBJECT, bucket+"/"+key); err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, k); err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return k
+}
+
+// 绑定key到k.Md5，调用前k.Md5需要已持有一次引用(storeFile)
+// 覆盖已有key时，释放旧文件的引用；object文档按版本号创建或替换(同updateFile)，多个apiserv同时绑定时只释放一次旧引用
+func bindKey(k *ObjKey) error {
+	var (
+		old  *ObjKey
+		body []byte
+		ver  int64
+		err  error
+	)
+	k.ETag = k.etag()
+	for i := 0; ; i++ {
+		old = nil
+		if body, ver, err = MetaStore.GetVersion(ES_TYPE_OBJECT, k.id()); err == tools.ErrDocNotFound {
+			err = MetaStore.Create(ES_TYPE_OBJECT, k.id(), k)
+		} else if err == nil {
+			old = new(ObjKey)
+			if err = json.Unmarshal(body, old); err == nil {
+				err = MetaStore.UpdateIf(ES_TYPE_OBJECT, k.id(), ver, k)
+			}
+		}
+		if err != tools.ErrConflict || i+1 >= CASRetry {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("绑定key出错: ", k.id(), err.Error())
+		releaseRef(k.Md5, "", true)
+		return err
+	}
+	log.Printf("绑定key: %s -> %s\n", k.id(), k.Md5)
+	if old != nil {
+		releaseRef(old.Md5, "", true)
+	}
+	return nil
+}
+
+// 解绑key，并释放文件的引用；按版本号删除，key已被覆盖时重新读取
+func unbindKey(bucket, key string) error {
+	var (
+		k    *ObjKey
+		id   = bucket + "/" + key
+		body []byte
+		ver  int64
+		err  error
+	)
+	for i := 0; ; i++ {
+		if body, ver, err = MetaStore.GetVersion(ES_TYPE_OBJECT, id); err == tools.ErrDocNotFound {
+			return ErrKeyNotFound
+		} else if err != nil {
+			return err
+		}
+		k = new(ObjKey)
+		if err = json.Unmarshal(body, k); err != nil {
+			return err
+		}
+		if err = MetaStore.DeleteIf(ES_TYPE_OBJECT, id, ver); err == tools.ErrConflict && i+1 < CASRetry {
+			continue
+		}
+		break
+	}
+	if err == tools.ErrDocNotFound { // 已被其他请求删除
+		return ErrKeyNotFound
+	} else if err != nil {
+		log.Println("删除key出错: ", id, err.Error())
+		return err
+	}
+	log.Println("删除key: ", id)
+	_, err = releaseRef(k.Md5, "", true)
+	return err
+}
+
+// 增加一次引用，返回增加后的引用数
+// keyed为true时为bucket/key持有的引用，否则为按md5上传的引用，owner不为空时记为该用户的引用
+func holdRef(md5, owner string, keyed bool) (int64, error) {
+	return changeRef(md5, owner, keyed, 1)
+}
+
+// 释放一次引用，引用数为0时删除文件，返回释放后的引用数
+// 按md5释放时(keyed为false)没有可释放的md5引用，或owner不为空而该用户没有引用时返回Err403
+func releaseRef(md5, owner string, keyed bool) (int64, error) {
+	return changeRef(md5, owner, keyed, -1)
+}
+
+func changeRef(md5, owner string, keyed bool, delta int64) (int64, error) {
+	o, err := updateFile(md5, func(o *ObjFile) error {
+		switch {
+		case o.Refs <= 0 && o.Md5Refs == nil: // 旧文档没有refs字段，视为一次按md5上传的引用
+			o.Refs = 1
+		case o.Refs <= 0:
+			return errDeleting
+		}
+		if o.Md5Refs == nil { // 旧文档没有md5_refs字段，key以外的引用都视为按md5上传
+			n := o.Refs - countKeys(md5)
+			if n < 0 {
+				n = 0
+			}
+			o.Md5Refs = &n
+		}
+		md5Refs := *o.Md5Refs
+		if keyed {
+			if o.Refs-md5Refs+delta < 0 {
+				log.Println("文件没有key持有的引用: ", md5)
+				return Err403
+			}
+		} else {
+			if md5Refs+delta < 0 {
+				return Err403
+			}
+			if len(owner) != 0 {
+				if o.Owners[owner]+delta < 0 {
+					return Err403
+				}
+				if o.Owners == nil {
+					o.Owners = make(map[string]int64, 1)
+				}
+				if o.Owners[owner] += delta; o.Owners[owner] == 0 {
+					delete(o.Owners, owner)
+				}
+			}
+			md5Refs += delta
+			o.Md5Refs = &md5Refs
+		}
+		o.Refs += delta
+		return nil
+	})
+	switch {
+	case err == errDeleting && delta < 0: // 上次删除未完成，重新删除
+		return 0, o.deleteBlob()
+	case err == errDeleting:
+		return 0, ErrNotFound
+	case err != nil:
+		if err != Err403 {
+			log.Println("修改引用数出错: ", md5, err.Error())
+		}
+		return 0, err
+	case o.Refs > 0:
+		log.Printf("文件引用数: %s %d\n", md5, o.Refs)
+		return o.Refs, nil
+	}
+	// 引用数已为0并保存，此后的holdRef会失败，再删除切片及文档
+	return 0, o.deleteBlob()
+}
+
+// 修改file文档: 读取文档及版本号，fn修改后在版本号未变时保存，版本冲突时重新读取并执行fn
+// fn返回错误时不保存，返回读取到的文档及该错误
+func updateFile(md5 string, fn func(o *ObjFile) error) (*ObjFile, error) {
+	var (
+		o    *ObjFile
+		body []byte
+		ver  int64
+		err  error
+	)
+	for i := 0; ; i++ {
+		if body, ver, err = MetaStore.GetVersion(ES_TYPE_FILE, md5); err != nil {
+			if !MetaStore.IsExists(ES_TYPE_FILE, md5) {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+		o = &ObjFile{}
+		if err = json.Unmarshal(body, o); err != nil {
+			return nil, err
+		}
+		o.Md5 = md5
+		if err = fn(o); err != nil {
+			return o, err
+		}
+		if err = MetaStore.UpdateIf(ES_TYPE_FILE, md5, ver, o); err == tools.ErrConflict && i+1 < CASRetry {
+			continue
+		}
+		return o, err
+	}
+}
+
+// 绑定到md5的key数，用于旧文档没有md5_refs时估算key持有的引用
+func countKeys(md5 string) int64 {
+	var n int64
+	MetaStore.Scan(ES_TYPE_OBJECT, "", func(id string, doc []byte) bool {
+		k := new(ObjKey)
+		if json.Unmarshal(doc, k) == nil && k.Md5 == md5 {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// 删除所有切片、file文档以及api中的临时文件
+func (o *ObjFile) deleteBlob() error {
+	var (
+		sha = Sha(o.ObjShard)
+		err error
+	)
+	if err = (&sha).DeleteShard(context.Background()); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	// 删除ES中file表
+	if MetaStore.IsExists(ES_TYPE_FILE, o.Md5) {
+		if _, err = MetaStore.Delete(ES_TYPE_FILE, o.Md5); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		log.Println("ES中删除文档: ", o.Md5)
+	}
+	os.Remove(filepath.Join(TmpDir, o.Name)) // 删除合并提供下载的那个文件
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	tools "../tools"
+)
+
+// 引用计数: 按md5上传的引用(md5_refs，按用户记在owners中)与bucket/key持有的引用分别计数，
+// 引用数为0时删除文件；旧文档没有refs或md5_refs字段
+
+// 每个测试使用新的Bolt元数据存储及临时目录
+func testMetaStore(t *testing.T) {
+	old, oldTmp := MetaStore, TmpDir
+	TmpDir = t.TempDir() // 删除文件时同时删除TmpDir中的临时文件
+	MetaStore = tools.NewBolt(filepath.Join(TmpDir, META_DB))
+	t.Cleanup(func() { MetaStore, TmpDir = old, oldTmp })
+}
+
+func testFile(t *testing.T, o *ObjFile, keys ...string) {
+	if _, err := MetaStore.Add(ES_TYPE_FILE, o.Md5, o); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		k := &ObjKey{Bucket: "bkt", Key: key, Md5: o.Md5, Size: o.Size}
+		if _, err := MetaStore.Add(ES_TYPE_OBJECT, k.id(), k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func getTestFile(t *testing.T, md5 string) *ObjFile {
+	var o = new(ObjFile)
+	body, err := MetaStore.Get(ES_TYPE_FILE, md5)
+	if err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, o); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func refs(n int64) *int64 {
+	return &n
+}
+
+func TestChangeRef(t *testing.T) {
+	const md5 = "0123456789abcdef0123456789abcdef"
+	type step struct {
+		owner string
+		keyed bool
+		delta int64
+		want  int64 // 修改后的引用数
+		err   error
+	}
+	var cases = []struct {
+		name    string
+		file    *ObjFile // 初始文档，为nil时文件不存在
+		keys    []string // 已绑定到该文件的key
+		steps   []step
+		refs    int64 // 最后的引用数，为0时文件已删除
+		md5Refs int64
+		owners  map[string]int64
+	}{
+		{
+			name: "按md5上传的引用按用户计数",
+			file: &ObjFile{Refs: 1, Md5Refs: refs(1), Owners: map[string]int64{"alice": 1}},
+			steps: []step{
+				{"alice", false, 1, 2, nil},
+				{"bob", false, 1, 3, nil},
+				{"carol", false, -1, 0, Err403},
+				{"", true, -1, 0, Err403},
+				{"alice", false, -1, 2, nil},
+			},
+			refs: 2, md5Refs: 2, owners: map[string]int64{"alice": 1, "bob": 1},
+		},
+		{
+			name: "释放最后一个引用时删除文件",
+			file: &ObjFile{Refs: 1, Md5Refs: refs(1), Owners: map[string]int64{"alice": 1}},
+			steps: []step{
+				{"alice", false, -1, 0, nil},
+				{"alice", false, 1, 0, ErrNotFound},
+			},
+		},
+		{
+			name: "key持有的引用不能按md5释放",
+			file: &ObjFile{Refs: 1, Md5Refs: refs(0)},
+			keys: []string{"a"},
+			steps: []step{
+				{"", false, -1, 0, Err403},
+				{"", true, 1, 2, nil},
+				{"alice", false, 1, 3, nil},
+				{"", true, -1, 2, nil},
+				{"alice", false, -1, 1, nil},
+				{"alice", false, -1, 0, Err403},
+			},
+			refs: 1, md5Refs: 0, owners: map[string]int64{},
+		},
+		{
+			name: "未启用鉴权时不记owners",
+			file: &ObjFile{Refs: 1, Md5Refs: refs(1)},
+			steps: []step{
+				{"", false, 1, 2, nil},
+				{"", false, -1, 1, nil},
+			},
+			refs: 1, md5Refs: 1,
+		},
+		{
+			name: "旧文档没有refs字段",
+			file: &ObjFile{},
+			steps: []step{
+				{"", false, 1, 2, nil},
+			},
+			refs: 2, md5Refs: 2,
+		},
+		{
+			name: "旧文档没有md5_refs字段时减去key数",
+			file: &ObjFile{Refs: 3},
+			keys: []string{"a", "b"},
+			steps: []step{
+				{"", false, -1, 2, nil},
+				{"", false, -1, 0, Err403},
+				{"", true, -1, 1, nil},
+			},
+			refs: 1, md5Refs: 0,
+		},
+		{
+			name: "删除中的文件不能增加引用",
+			file: &ObjFile{Refs: 0, Md5Refs: refs(0)},
+			steps: []step{
+				{"", false, 1, 0, ErrNotFound},
+				{"", false, -1, 0, nil}, // 重新删除
+			},
+		},
+		{
+			name:  "文件不存在",
+			steps: []step{{"", false, 1, 0, ErrNotFound}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testMetaStore(t)
+			if c.file != nil {
+				c.file.Md5 = md5
+				testFile(t, c.file, c.keys...)
+			}
+			for i, s := range c.steps {
+				n, err := changeRef(md5, s.owner, s.keyed, s.delta)
+				if err != s.err || n != s.want {
+					t.Fatalf("第%d步: %d, %v, 应为 %d, %v", i, n, err, s.want, s.err)
+				}
+			}
+			o := getTestFile(t, md5)
+			if c.refs == 0 {
+				if o != nil {
+					t.Fatalf("引用数为0时文件未删除: %+v", o)
+				}
+				return
+			}
+			if o == nil {
+				t.Fatal("文件已删除")
+			}
+			if o.Refs != c.refs || o.Md5Refs == nil || *o.Md5Refs != c.md5Refs {
+				t.Fatalf("引用数 %d/%v, 应为 %d/%d", o.Refs, o.Md5Refs, c.refs, c.md5Refs)
+			}
+			if len(o.Owners)+len(c.owners) != 0 && !reflect.DeepEqual(o.Owners, c.owners) {
+				t.Fatalf("owners %v, 应为 %v", o.Owners, c.owners)
+			}
+		})
+	}
+}
+
+// 覆盖key时释放旧文件的引用，删除key时释放当前文件的引用
+func TestBindKeyRefs(t *testing.T) {
+	const (
+		md5A = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		md5B = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	testMetaStore(t)
+	testFile(t, &ObjFile{Md5: md5A, Refs: 1, Md5Refs: refs(1)})
+	testFile(t, &ObjFile{Md5: md5B, Refs: 1, Md5Refs: refs(0)}) // 本次上传持有的引用
+	var steps = []struct {
+		fn    func() error
+		refsA int64 // 为0时文件已删除
+		refsB int64
+	}{
+		{func() error { // a的key引用
+			_, err := holdRef(md5A, "", true)
+			return err
+		}, 2, 1},
+		{func() error { return bindKey(&ObjKey{Bucket: "bkt", Key: "k", Md5: md5A}) }, 2, 1},
+		{func() error { return bindKey(&ObjKey{Bucket: "bkt", Key: "k", Md5: md5B}) }, 1, 1},
+		{func() error { return unbindKey("bkt", "k") }, 1, 0},
+		{func() error {
+			if err := unbindKey("bkt", "k"); err != ErrKeyNotFound {
+				t.Fatalf("删除不存在的key: %v", err)
+			}
+			return nil
+		}, 1, 0},
+	}
+	for i, s := range steps {
+		if err := s.fn(); err != nil {
+			t.Fatalf("第%d步: %v", i, err)
+		}
+		for _, f := range []struct {
+			md5  string
+			want int64
+		}{{md5A, s.refsA}, {md5B, s.refsB}} {
+			o := getTestFile(t, f.md5)
+			switch {
+			case f.want == 0 && o != nil:
+				t.Fatalf("第%d步: %s 引用数为0时未删除", i, f.md5)
+			case f.want != 0 && (o == nil || o.Refs != f.want):
+				t.Fatalf("第%d步: %s 引用数 %+v, 应为 %d", i, f.md5, o, f.want)
+			}
+		}
+	}
+}
+
+// 同时覆盖同一个key: 每次覆盖只释放一次旧引用，最后只剩一个key持有的引用
+func TestBindKeyConcurrent(t *testing.T) {
+	const md5 = "cccccccccccccccccccccccccccccccc"
+	testMetaStore(t)
+	testFile(t, &ObjFile{Md5: md5, Refs: 1, Md5Refs: refs(1)})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := holdRef(md5, "", true); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := bindKey(&ObjKey{Bucket: "bkt", Key: "k", Md5: md5}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if o := getTestFile(t, md5); o == nil || o.Refs != 2 {
+		t.Fatalf("引用数 %+v, 应为 2", o)
+	}
+}
+
+// ListObjectsV2按continuation-token分页，公共前缀只返回一次，ETag与GET相同
+func TestS3ListObjectsV2(t *testing.T) {
+	const md5 = "0123456789abcdef0123456789abcdef"
+	testMetaStore(t)
+	if err := createBucket("bkt", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	testFile(t, &ObjFile{Md5: md5, Refs: 6, Parts: 2}, "a", "b/1", "b/2", "c", "d/1", "e")
+	list := func(query string) *s3ListBucketResult {
+		var (
+			res  = new(s3ListBucketResult)
+			resp = httptest.NewRecorder()
+		)
+		s3ListObjectsV2(resp, httptest.NewRequest("GET", "/bkt?list-type=2&"+query, nil), "bkt")
+		if err := xml.Unmarshal(resp.Body.Bytes(), res); err != nil {
+			t.Fatal(err, resp.Body.String())
+		}
+		return res
+	}
+	var cases = []struct {
+		query string
+		pages [][]string // 每页的key及公共前缀(以/结尾)
+	}{
+		{"delimiter=/&max-keys=2", [][]string{{"a", "b/"}, {"c", "d/"}, {"e"}}},
+		{"max-keys=4", [][]string{{"a", "b/1", "b/2", "c"}, {"d/1", "e"}}},
+		{"delimiter=/&start-after=b/", [][]string{{"c", "d/", "e"}}},
+		{"prefix=b/&delimiter=/&max-keys=1", [][]string{{"b/1"}, {"b/2"}}},
+	}
+	for _, c := range cases {
+		var (
+			pages [][]string
+			token string
+		)
+		for {
+			q := c.query
+			if len(token) != 0 {
+				q += "&continuation-token=" + token
+			}
+			res := list(q)
+			var page []string
+			for _, k := range res.Contents {
+				if k.ETag != `"`+md5+`-2"` {
+					t.Errorf("%s: ETag %s", k.Key, k.ETag)
+				}
+				page = append(page, k.Key)
+			}
+			for _, cp := range res.CommonPrefixes {
+				page = append(page, cp.Prefix)
+			}
+			sort.Strings(page)
+			pages = append(pages, page)
+			if !res.IsTruncated {
+				break
+			}
+			token = res.NextContinuationToken
+		}
+		if !reflect.DeepEqual(pages, c.pages) {
+			t.Errorf("%s: 分页为%v，应为%v", c.query, pages, c.pages)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+
+	tools "../tools"
+)
+
+// 切片放置: 为一个文件的所有切片选择data节点
+//   ①同一个文件的切片必须放在不同节点上，可用节点不足时拒绝上传
+//   ②节点配置了zone/rack标签时，尽量平均分散到不同zone，其次不同rack
+//   ③在同等条件的节点中，按剩余空间加权随机选择；剩余空间不足MinFreeBytes的节点不再放置
+// 节点的磁盘空间和标签随data节点的心跳发送
+
+var (
+	MinFreeBytes  int64 = 1 << 30 // 剩余空间少于该值的节点不再放置切片
+	UnknownWeight int64 = 1 << 30 // 未知容量节点(旧版本data节点)的权重
+)
+
+var (
+	ErrPlacement = errors.New("可用data节点不足")
+)
+
+// data节点状态
+type DataNode struct {
+	HB   int64          `json:"hb"` // 最后一次心跳时间
+	V    int            `json:"v"`  // 心跳消息版本，旧版本data节点为0
+	Stat tools.NodeStat `json:"stat"`
+}
+
+// 为n个切片选择n个不同的节点，exclude中的节点不参与选择(已存放该文件其他切片的节点)
+func placeShards(n int, exclude map[string]struct{}) ([]string, error) {
+	var (
+		cands  []*tools.NodeStat
+		zones  = map[string]int{} // 已选择的节点中，各zone的切片数
+		racks  = map[string]int{}
+		chosen = make([]string, 0, n)
+	)
+	DataMu.RLock()
+	for addr, node := range DataServer {
+		if _, ok := exclude[addr]; ok {
+			continue
+		}
+		if node.Stat.Total != 0 && node.Stat.Free < MinFreeBytes {
+			continue
+		}
+		st := node.Stat
+		st.Addr = addr
+		cands = append(cands, &st)
+	}
+	for addr := range exclude { // 已放置的切片也计入zone/rack分布
+		if node, ok := DataServer[addr]; ok {
+			zones[node.Stat.Zone]++
+			racks[node.Stat.Zone+"/"+node.Stat.Rack]++
+		}
+	}
+	DataMu.RUnlock()
+	if len(cands) < n {
+		log.Printf("可用data节点不足: 需要%d个，可用%d个\n", n, len(cands))
+		return nil, ErrPlacement
+	}
+	for len(chosen) < n {
+		// 选出zone、rack中切片最少的那一批节点
+		var (
+			best   []*tools.NodeStat
+			bz, br = -1, -1
+			idx    int
+			sum, w int64
+		)
+		for _, c := range cands {
+			z, r := zones[c.Zone], racks[c.Zone+"/"+c.Rack]
+			switch {
+			case bz == -1 || z < bz || (z == bz && r < br):
+				best, bz, br = []*tools.NodeStat{c}, z, r
+			case z == bz && r == br:
+				best = append(best, c)
+			}
+		}
+		for _, c := range best {
+			sum += weight(c)
+		}
+		w = rand.Int63n(sum)
+		for idx = range best {
+			if w -= weight(best[idx]); w < 0 {
+				break
+			}
+		}
+		c := best[idx]
+		chosen = append(chosen, c.Addr)
+		zones[c.Zone]++
+		racks[c.Zone+"/"+c.Rack]++
+		for i := range cands { // 每个节点只放一个切片
+			if cands[i] == c {
+				cands = append(cands[:i], cands[i+1:]...)
+				break
+			}
+		}
+	}
+	return chosen, nil
+}
+
+// 为一个切片选择节点
+func placeOne(exclude map[string]struct{}) (string, error) {
+	var (
+		servers []string
+		err     error
+	)
+	if servers, err = placeShards(1, exclude); err != nil {
+		return "", err
+	}
+	return servers[0], nil
+}
+
+// 节点权重: 剩余空间，未知容量时使用UnknownWeight
+func weight(s *tools.NodeStat) int64 {
+	if s.Total == 0 {
+		return UnknownWeight
+	}
+	if s.Free <= 0 {
+		return 1
+	}
+	return s.Free
+}
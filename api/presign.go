@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tools "../tools"
+)
+
+// 预签名URL: 已登录的用户为/file的GET或PUT生成带有效期的链接，持有链接即可访问，不需要其他凭证
+//   POST /presign?method=GET|PUT&md5=|bucket=&key=&expires=秒
+// 链接中的所有参数都参与签名，签名为HMAC-SHA256(presign_key, method\npath\n排序编码后的query)
+// 访问时仍以签发者的身份做权限检查，签发者被删除或失去权限后链接随之失效
+// 多个apiserv须配置相同的presign_key，未设置时不能生成预签名URL
+
+const (
+	Q_PRESIGN_METHOD    = "X-Obj-Method"    // 允许的method，GET同时允许HEAD
+	Q_PRESIGN_EXPIRES   = "X-Obj-Expires"   // 过期时间，unix秒
+	Q_PRESIGN_USER      = "X-Obj-User"      // 签发者
+	Q_PRESIGN_SIGNATURE = "X-Obj-Signature" // 签名(hex)
+
+	P_METHOD  = "method"
+	P_EXPIRES = "expires" // 有效时间，秒
+)
+
+var (
+	PresignExpiry    = time.Hour          // 默认有效时间
+	PresignMaxExpiry = 7 * 24 * time.Hour // 最长有效时间
+)
+
+var (
+	ErrPresignDisabled = errors.New("未设置presign_key")
+	ErrURLExpired      = errors.New("链接已过期")
+)
+
+// 是否为预签名URL
+func isPresigned(req *http.Request) bool {
+	return len(req.URL.Query().Get(Q_PRESIGN_SIGNATURE)) != 0
+}
+
+// 计算预签名URL的签名，q中不含签名参数
+func presignSignature(key, method, path string, q url.Values) string {
+	var m = hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(strings.Join([]string{method, path, canonicalQuery(q)}, "\n")))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// 校验预签名URL，返回签发者，未启用鉴权时为nil
+func verifyPresign(req *http.Request) (*User, error) {
+	var (
+		q         = req.URL.Query()
+		method    = q.Get(Q_PRESIGN_METHOD)
+		signature = q.Get(Q_PRESIGN_SIGNATURE)
+		presign   = live().PresignKey
+		u         *User
+	)
+	if len(presign) == 0 {
+		return nil, ErrPresignDisabled
+	}
+	if method != req.Method && !(method == "GET" && req.Method == "HEAD") {
+		return nil, ErrSignature
+	}
+	expires, err := strconv.ParseInt(q.Get(Q_PRESIGN_EXPIRES), 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	q.Del(Q_PRESIGN_SIGNATURE)
+	if !hmac.Equal([]byte(presignSignature(presign, method, req.URL.Path, q)), []byte(signature)) {
+		return nil, ErrSignature
+	}
+	if time.Now().Unix() > expires {
+		return nil, ErrURLExpired
+	}
+	// 表单(包括PUT的multipart表单)中只能有已签名的参数，以免修改bucket/key等
+	if !formSigned(req, q, Q_PRESIGN_SIGNATURE) {
+		return nil, ErrSignature
+	}
+	if AuthEnabled() {
+		if u = getUser(q.Get(Q_PRESIGN_USER)); u == nil {
+			return nil, ErrUserNotFound
+		}
+	}
+	return u, nil
+}
+
+// 生成/file的预签名URL
+func handlerPresign(resp http.ResponseWriter, req *http.Request) {
+	var (
+		method  = strings.ToUpper(req.FormValue(P_METHOD))
+		md5     = strings.ToLower(req.FormValue(P_MD5))
+		bucket  = req.FormValue(P_BUCKET)
+		key     = req.FormValue(P_KEY)
+		expiry  = PresignExpiry
+		q       = url.Values{}
+		scheme  = "http"
+		presign = live().PresignKey
+		expires int64
+	)
+	if req.Method != "POST" {
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+		return
+	}
+	if len(presign) == 0 {
+		resp.Write(tools.Json2Byte(403, ErrPresignDisabled.Error()))
+		return
+	}
+	if e := req.FormValue(P_EXPIRES); len(e) != 0 {
+		n, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || n <= 0 || time.Duration(n)*time.Second > PresignMaxExpiry {
+			resp.Write(tools.Json2Byte(400, "expires有误，最长为"+PresignMaxExpiry.String()))
+			return
+		}
+		expiry = time.Duration(n) * time.Second
+	}
+	// 签发时检查权限，访问时还会再检查一次
+	switch {
+	case method != "GET" && method != "PUT":
+		resp.Write(tools.Json2Byte(400, "method只能为GET或PUT"))
+		return
+	case method == "PUT" && len(md5) != 32: // 上传时必须校验md5，链接只能上传该内容
+		resp.Write(tools.Json2Byte(400, "无效md5: "+md5))
+		return
+	case len(key) != 0:
+		if !bucketAllowed(req, bucket, method == "PUT") {
+			resp.Write(tools.Json2Byte(403, Err403.Error()))
+			return
+		}
+		q.Set(P_BUCKET, bucket)
+		q.Set(P_KEY, key)
+	case len(md5) != 32:
+		resp.Write(tools.Json2Byte(400, "无效md5: "+md5))
+		return
+	case method == "GET" && !fileAllowed(req, md5):
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if len(md5) != 0 {
+		q.Set(P_MD5, md5)
+	}
+	if u := reqUser(req); u != nil {
+		q.Set(Q_PRESIGN_USER, u.Name)
+	}
+	expires = time.Now().Add(expiry).Unix()
+	q.Set(Q_PRESIGN_METHOD, method)
+	q.Set(Q_PRESIGN_EXPIRES, strconv.FormatInt(expires, 10))
+	log.Printf("生成预签名URL: %s /file?%s\n", method, q.Encode()) // 不记录签名
+	q.Set(Q_PRESIGN_SIGNATURE, presignSignature(presign, method, "/file", q))
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	resp.Write(tools.Json2ByteObj(200, map[string]interface{}{
+		"url":     scheme + "://" + req.Host + "/file?" + q.Encode(),
+		"method":  method,
+		"expires": expires,
+	}))
+}
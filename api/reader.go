@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	tools "../tools"
+)
+
+// 对象读取器，实现io.ReadSeeker，供http.ServeContent处理Range和条件请求
+// RS切片时，每个条带(见stripe.go)按顺序分成数据块数(见ObjFile.layout)段，每段perShard字节(最后一段补0)，
+// 因此条带中偏移off的数据位于第off/perShard个数据分片的off%perShard处，
+// 读取时只需要按Range向data节点请求覆盖该区间的条带及数据分片，不需要下载整个文件
+//
+// 每次打开时同时向同一条带的所有分片请求同一区间: 数据分片先于其他数据块数个分片响应时直接读取，
+// 否则以最先响应的数据块数个分片流式还原，其余的请求随即取消，慢或不可用的节点不增加读取延迟；
+// 整个过程不落盘，内存占用与文件大小无关
+// 读取中途出错时，从当前偏移重新打开(不再请求出错的分片)；所有请求随ctx(客户端的请求)取消
+// 每个切片请求占用传输名额并单独重试(见transfer.go)
+
+var (
+	ErrSeek = errors.New("无效的偏移")
+)
+
+type ObjReader struct {
+	ctx      context.Context
+	obj      *ObjFile
+	off      int64         // 当前偏移
+	body     io.ReadCloser // 当前数据分片的响应流
+	bodyOff  int64         // body下一个字节对应的文件偏移
+	bodyEnd  int64         // body结束时对应的文件偏移
+	reopen   bool          // body中途出错，下一次打开时不再请求该数据分片
+	failures int           // 连续出错的次数，超过FailCount时不再重新打开
+}
+
+func NewObjReader(ctx context.Context, o *ObjFile) *ObjReader {
+	return &ObjReader{ctx: withLimit(ctx), obj: o}
+}
+
+func (r *ObjReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.obj.Size
+	default:
+		return r.off, ErrSeek
+	}
+	if offset < 0 {
+		return r.off, ErrSeek
+	}
+	r.off = offset
+	return r.off, nil
+}
+
+func (r *ObjReader) Read(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if r.off >= r.obj.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil || r.bodyOff != r.off {
+		if err = r.openAt(r.off); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.bodyEnd-r.off {
+		p = p[:r.bodyEnd-r.off]
+	}
+	n, err = r.body.Read(p)
+	r.off += int64(n)
+	r.bodyOff = r.off
+	if r.off >= r.bodyEnd {
+		r.closeBody()
+		return n, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if n > 0 {
+		r.failures = 0
+	}
+	if err != nil && r.ctx.Err() == nil && r.failures < FailCount {
+		// 中途出错，从当前偏移重新打开，不截断响应
+		log.Printf("读取切片中途出错，剩余部分重新打开: %s %d %s\n", r.obj.Md5, r.off, err.Error())
+		r.failures++
+		TriggerRepair(r.obj.Md5)
+		r.closeBody()
+		r.reopen = true
+		if n > 0 {
+			return n, nil
+		}
+		return r.Read(p)
+	}
+	return n, err
+}
+
+func (r *ObjReader) Close() error {
+	r.closeBody()
+	return nil
+}
+
+// 打开包含off的数据分片，从off一直读到该分片的有效数据结尾
+func (r *ObjReader) openAt(off int64) error {
+	var (
+		dataCount, _ = r.obj.layout()
+		si           = r.obj.stripeAt(off) // 条带序号
+		body         io.ReadCloser
+		err          error
+	)
+	r.closeBody()
+	soff, ssize, shards := r.obj.stripe(si)
+	var (
+		perShard = shardSize(ssize, dataCount)
+		idx      = int((off - soff) / perShard)
+		start    = (off - soff) % perShard
+		end      = perShard // 分片内的结束位置(不含)
+	)
+	if idx >= len(shards) {
+		return ErrShardNotEnough
+	}
+	if rest := ssize - int64(idx)*perShard; rest < end {
+		end = rest // 最后一个数据分片末尾是补的0
+	}
+	if body, err = openShards(r.ctx, r.obj, shards, idx, !r.reopen, start, end); err != nil {
+		return err
+	}
+	r.reopen = false
+	r.body = body
+	r.bodyOff = off
+	r.bodyEnd = off + end - start
+	return nil
+}
+
+func (r *ObjReader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// 读取第idx个分片[start, end)区间的数据: 并行请求同一条带所有分片的该区间，
+// withIdx为true时也请求第idx个分片，它先于其他数据块数个分片打开时直接读取，
+// 否则以最先打开的数据块数个其他分片流式还原；然后取消其余的请求
+// 正常读取(withIdx为true)时有分片打开失败则触发修复，修复时还原切片也通过该函数，不再触发
+func openShards(ctx context.Context, o *ObjFile, shards []ObjShard, idx int, withIdx bool, start, end int64) (io.ReadCloser, error) {
+	var (
+		length                 = len(shards)
+		dataCount, parityCount = o.layout()
+		bodies                 = make(multiCloser, length)
+		readers                = make([]io.Reader, length)
+		cancels                = make([]context.CancelFunc, length)
+		ch                     = make(chan opened, length)
+		direct                 io.ReadCloser
+		failed                 []int
+		pending                int
+		succ                   int
+		rs                     io.Reader
+		err                    error
+	)
+	for i := range shards {
+		if i == idx && !withIdx {
+			continue
+		}
+		sctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		pending++
+		go func(i int) {
+			var body io.ReadCloser
+			err := withRetry(sctx, func() (err error) {
+				body, err = openShard(sctx, &shards[i], start, end-1)
+				return err
+			})
+			ch <- opened{i, body, err}
+		}(i)
+	}
+	for ; pending > 0 && succ < dataCount && direct == nil; pending-- {
+		res := <-ch
+		switch {
+		case res.err != nil:
+			cancels[res.i]()
+			failed = append(failed, res.i)
+		case res.i == idx:
+			direct = cancelBody{res.body, cancels[res.i]}
+		default:
+			bodies[res.i] = cancelBody{res.body, cancels[res.i]}
+			readers[res.i] = res.body
+			succ++
+		}
+	}
+	if len(failed) != 0 && withIdx && ctx.Err() == nil {
+		log.Printf("打开切片失败: %s %v\n", o.Md5, failed)
+		TriggerRepair(o.Md5)
+	}
+	// 取消其余的请求，此后才打开的流直接关闭
+	if direct != nil {
+		bodies.Close()
+	}
+	for i, cancel := range cancels {
+		if cancel != nil && bodies[i] == nil && (direct == nil || i != idx) {
+			cancel()
+		}
+	}
+	go func(n int) {
+		for ; n > 0; n-- {
+			if res := <-ch; res.body != nil {
+				res.body.Close()
+			}
+		}
+	}(pending)
+	switch {
+	case direct != nil:
+		return direct, nil
+	case ctx.Err() != nil:
+		bodies.Close()
+		return nil, ctx.Err()
+	case succ < dataCount:
+		bodies.Close()
+		log.Println("有效切片过少: ", succ)
+		return nil, ErrShardNotEnough
+	}
+	if withIdx {
+		log.Printf("数据分片未及时响应，改为还原读取: %s %d\n", o.Md5, idx)
+	}
+	if rs, err = tools.NewrsStream(readers, dataCount, parityCount, idx, end-start); err != nil {
+		bodies.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{rs, bodies}, nil
+}
+
+// 打开切片的结果
+type opened struct {
+	i    int
+	body io.ReadCloser
+	err  error
+}
+
+// 关闭流时同时取消其请求
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// 关闭所有非nil的流
+type multiCloser []io.ReadCloser
+
+func (m multiCloser) Close() error {
+	for _, c := range m {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return nil
+}
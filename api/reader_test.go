@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tools "../tools"
+)
+
+// 用较小的条带切片，由本地http服务模拟data节点，按Range读取并与原文件比较
+
+const (
+	testData   = 3    // 数据块数
+	testParity = 2    // 校验块数
+	testStripe = 1000 // 条带大小，最后一个条带不满时分片末尾补0
+)
+
+func init() {
+	FailCount = 1 // 缺失的分片不重试
+	liveConf.Store(&liveConfig{ClusterSecret: "test", TokenTimeout: time.Minute})
+	setupTransfer()
+}
+
+// 模拟data节点: GET /shard?path=切片名，支持Range，切片不存在时返回404
+func testDataNode(t *testing.T, dir string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.ServeFile(resp, req, filepath.Join(dir, filepath.Base(req.FormValue(P_PATH))))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// 生成size字节的随机文件，按stripe分条带切片，返回原数据及file文档
+// missing为每个条带中删除的切片序号
+func testObject(t *testing.T, size, stripe int64, missing []int) ([]byte, *ObjFile) {
+	var (
+		dir   = t.TempDir()
+		data  = make([]byte, size)
+		src   = filepath.Join(dir, "src")
+		width = testData + testParity
+		o     = &ObjFile{Md5: "test", Size: size, Name: "src", DataCount: testData, ParityCount: testParity}
+	)
+	rand.New(rand.NewSource(size)).Read(data)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size > stripe {
+		o.StripeSize = stripe
+	}
+	server := testDataNode(t, dir)
+	rs := tools.NewrsFile(src, dir, testData, testParity)
+	for i := 0; i < o.stripeCount(); i++ {
+		names, err := rs.RSSplitStripe(i, stripe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			o.ObjShard = append(o.ObjShard, ObjShard{BaseName: filepath.Base(name), Server: server})
+		}
+		for _, k := range missing {
+			os.Remove(filepath.Join(dir, o.ObjShard[i*width+k].BaseName))
+		}
+	}
+	return data, o
+}
+
+// 读取[off, off+n)
+func readRange(o *ObjFile, off, n int64) ([]byte, error) {
+	var r = NewObjReader(context.Background(), o)
+	defer r.Close()
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, n))
+}
+
+func TestStripeLayout(t *testing.T) {
+	var cases = []struct {
+		size    int64
+		count   int     // 条带数
+		sizes   []int64 // 各条带大小
+		lastOff int64   // 最后一个条带的偏移
+	}{
+		{0, 1, []int64{0}, 0},
+		{1, 1, []int64{1}, 0},
+		{999, 1, []int64{999}, 0},
+		{1000, 1, []int64{1000}, 0},
+		{1001, 2, []int64{1000, 1}, 1000},
+		{3000, 3, []int64{1000, 1000, 1000}, 2000},
+		{3500, 4, []int64{1000, 1000, 1000, 500}, 3000},
+	}
+	for _, c := range cases {
+		o := &ObjFile{Size: c.size, DataCount: testData, ParityCount: testParity}
+		if c.size > testStripe {
+			o.StripeSize = testStripe
+		}
+		if n := o.stripeCount(); n != c.count {
+			t.Errorf("size %d: 条带数 %d, 应为 %d", c.size, n, c.count)
+			continue
+		}
+		sizes := o.stripeSizes()
+		for i := range sizes {
+			if sizes[i] != c.sizes[i] {
+				t.Errorf("size %d: 条带大小 %v, 应为 %v", c.size, sizes, c.sizes)
+				break
+			}
+		}
+		if off, _, _ := o.stripe(c.count - 1); off != c.lastOff {
+			t.Errorf("size %d: 最后一个条带的偏移 %d, 应为 %d", c.size, off, c.lastOff)
+		}
+		if c.size > 0 && o.stripeAt(c.size-1) != c.count-1 {
+			t.Errorf("size %d: 最后一个字节在条带 %d, 应为 %d", c.size, o.stripeAt(c.size-1), c.count-1)
+		}
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	// 3500字节: 4个条带，最后一个条带500字节；每个分片334字节(最后一个条带167字节)
+	var cases = []struct {
+		name    string
+		size    int64
+		off, n  int64
+		missing []int
+	}{
+		{"整个文件", 3500, 0, 3500, nil},
+		{"第一个字节", 3500, 0, 1, nil},
+		{"条带内", 3500, 10, 20, nil},
+		{"跨分片", 3500, 330, 10, nil},
+		{"跨条带", 3500, 990, 20, nil},
+		{"跨多个条带", 3500, 500, 2600, nil},
+		{"最后一个短条带", 3500, 3000, 500, nil},
+		{"短条带跨分片", 3500, 3160, 20, nil},
+		{"最后一个字节", 3500, 3499, 1, nil},
+		{"超出文件结尾", 3500, 3400, 500, nil},
+		{"整数个条带", 3000, 1990, 1010, nil},
+		{"单个条带", 700, 0, 700, nil},
+		{"缺失数据分片", 3500, 0, 3500, []int{0, 1}},
+		{"缺失校验分片", 3500, 0, 3500, []int{3, 4}},
+		{"缺失数据和校验分片", 3500, 500, 2600, []int{1, 4}},
+		{"缺失最后的数据分片", 3500, 3160, 340, []int{2, 0}},
+		{"单个条带缺失分片", 700, 100, 500, []int{0, 2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, o := testObject(t, c.size, testStripe, c.missing)
+			got, err := readRange(o, c.off, c.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := c.off + c.n
+			if end > c.size {
+				end = c.size
+			}
+			if !bytes.Equal(got, data[c.off:end]) {
+				t.Fatalf("[%d, %d) 读取的数据不一致: %d 字节", c.off, end, len(got))
+			}
+		})
+	}
+}
+
+// 缺失的分片多于校验块数时不能读取
+func TestReadTooManyMissing(t *testing.T) {
+	_, o := testObject(t, 3500, testStripe, []int{0, 1, 3})
+	if _, err := readRange(o, 0, 3500); err != ErrShardNotEnough {
+		t.Fatalf("错误为 %v, 应为 %v", err, ErrShardNotEnough)
+	}
+}
+
+// 空文件不请求data节点
+func TestReadEmpty(t *testing.T) {
+	var o = &ObjFile{Md5: "test", DataCount: testData, ParityCount: testParity}
+	got, err := readRange(o, 0, 10)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("读取空文件: %d 字节, %v", len(got), err)
+	}
+}
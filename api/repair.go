@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tools "../tools"
+)
+
+// 切片修复: 检查file文档中的每个切片，用剩余切片还原缺失或损坏的切片，
+// 上传到其他健康的data节点，并更新file文档中的切片位置
+//   ①定期扫描所有file文档(RepairInterval)
+//   ②下载时发现数据分片不可用、data节点上报切片损坏时，加入修复队列(TriggerRepair)
+// 还原出的切片md5必须与file文档中记录的一致，才会上传
+// 多个api服务时，建议只在一个节点开启定期扫描(REPAIR_INTERVAL=0关闭)
+
+const (
+	REPAIR_DIR = "repair" // 还原切片的临时目录(存放于TmpDir)
+)
+
+var (
+	RepairInterval = time.Hour               // 定期扫描的时间间隔，为0时不扫描
+	RepairQueue    = make(chan string, 1024) // 需要修复的文件md5
+)
+
+var (
+	ErrRepairMd5  = errors.New("还原的切片MD5不一致")
+	ErrRepairLost = errors.New("有效切片过少，无法修复")
+)
+
+// 将文件加入修复队列，队列满时丢弃(定期扫描时还会检查)
+func TriggerRepair(md5 string) {
+	select {
+	case RepairQueue <- md5:
+	default:
+		log.Println("修复队列已满，丢弃: ", md5)
+	}
+}
+
+// 修复进程: 处理修复队列，并定期扫描所有文件
+func repairDaemon() {
+	var scan <-chan time.Time
+	os.RemoveAll(filepath.Join(TmpDir, REPAIR_DIR)) // 上次运行遗留的还原切片
+	if RepairInterval > 0 {
+		scan = time.NewTicker(RepairInterval).C
+	} else {
+		log.Println("不定期扫描切片")
+	}
+	for {
+		select {
+		case md5 := <-RepairQueue:
+			repairFile(md5)
+		case <-scan:
+			repairAll()
+		}
+	}
+}
+
+// 扫描所有file文档
+func repairAll() {
+	var (
+		ids    []string
+		failed int
+	)
+	MetaStore.Scan(ES_TYPE_FILE, "", func(id string, doc []byte) bool {
+		ids = append(ids, id)
+		return true
+	})
+	log.Println("开始扫描切片，文件数: ", len(ids))
+	for _, id := range ids {
+		if err := repairFile(id); err != nil && err != ErrRunning {
+			failed++
+		}
+	}
+	log.Printf("扫描切片结束，文件数: %d，修复失败: %d\n", len(ids), failed)
+}
+
+// 检查并修复一个文件的所有切片，分条带的文件逐个条带检查，每个条带单独还原
+func repairFile(md5 string) error {
+	var (
+		o        = &ObjFile{Md5: md5}
+		dir      = filepath.Join(TmpDir, REPAIR_DIR, md5)
+		bad      []int                 // 缺失或损坏的切片
+		exclude  []map[string]struct{} // 每个条带已存放切片的节点
+		stale    []ObjShard            // 已还原的切片的原位置，提交后删除
+		fresh    []ObjShard            // 还原后上传的切片
+		repaired int
+		err      error
+	)
+	RunningMU.Lock()
+	_, ok := RunningMap[md5]
+	if !ok {
+		RunningMap[md5] = struct{}{} // 修复时不允许同时上传该文件
+	}
+	RunningMU.Unlock()
+	if ok {
+		return ErrRunning
+	}
+	defer o.finishUpload(dir)
+
+	if err = o.loadMeta(); err != nil {
+		log.Println("修复时获取文件出错: ", md5, err.Error())
+		return err
+	}
+	dataCount, parityCount := o.layout()
+	width := dataCount + parityCount
+	if len(o.ObjShard) != o.stripeCount()*width || o.Size == 0 {
+		return nil
+	}
+	for i := 0; i < o.stripeCount(); i++ {
+		var (
+			errs    = make([]error, width)
+			servers = map[string]struct{}{}
+			lost    int
+			wg      sync.WaitGroup
+		)
+		for j := 0; j < width; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				errs[j] = checkShard(&o.ObjShard[i*width+j])
+			}(j)
+		}
+		wg.Wait()
+		for j, e := range errs {
+			if e != nil {
+				bad = append(bad, i*width+j)
+				lost++
+			} else {
+				servers[o.ObjShard[i*width+j].Server] = struct{}{}
+			}
+		}
+		if lost > parityCount {
+			log.Printf("%s: %s 条带%d\n", ErrRepairLost.Error(), md5, i)
+			return ErrRepairLost
+		}
+		exclude = append(exclude, servers)
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	log.Printf("文件切片缺失或损坏: %s %v\n", md5, bad)
+
+	tools.DirExist(dir)
+	for _, idx := range bad {
+		var (
+			old = o.ObjShard[idx]
+			s   = ObjShard{Md5: old.Md5, BaseName: old.BaseName}
+			src = filepath.Join(dir, old.BaseName)
+		)
+		if err = o.rebuildShard(idx, src); err != nil {
+			log.Println("还原切片失败: ", old.BaseName, err.Error())
+			continue
+		}
+		if s.Server, err = placeOne(exclude[idx/width]); err != nil {
+			log.Println("没有可用于存放还原切片的节点: ", old.BaseName)
+			break
+		}
+		if err = uploadOne(context.Background(), md5, &src, &s); err != nil {
+			log.Println("上传还原切片失败: ", s.Server, s.BaseName, err.Error())
+			continue
+		}
+		exclude[idx/width][s.Server] = struct{}{}
+		o.ObjShard[idx] = s
+		if old.Server != s.Server { // 还原到原节点时已覆盖原切片
+			stale = append(stale, old)
+		}
+		fresh = append(fresh, s)
+		repaired++
+	}
+	if repaired == 0 {
+		return ErrServer500
+	}
+
+	// 提交新的切片位置，修复期间文件可能已被删除
+	_, err = updateFile(md5, func(f *ObjFile) error {
+		if f.Refs <= 0 && f.Md5Refs != nil {
+			return errDeleting
+		}
+		f.ObjShard = o.ObjShard
+		return nil
+	})
+	if err == ErrNotFound || err == errDeleting {
+		log.Println("修复期间文件已删除: ", md5)
+		sha := Sha(o.ObjShard)
+		return (&sha).DeleteShard(context.Background())
+	} else if err != nil {
+		log.Println("更新切片位置出错: ", md5, err.Error())
+		sha := Sha(fresh) // 未提交，删除还原的切片，原切片保留
+		(&sha).DeleteShard(context.Background())
+		return err
+	}
+	// 提交后再删除原位置的切片，原位置可能只是暂时不可用，删除失败时只留下旧切片
+	for i := range stale {
+		if err = deleteOne(context.Background(), &stale[i]); err != nil {
+			log.Println("删除原切片失败: ", stale[i].Server, stale[i].BaseName)
+		}
+	}
+	log.Printf("成功修复切片: %s %d/%d\n", md5, repaired, len(bad))
+	if repaired != len(bad) {
+		return ErrServer500
+	}
+	return nil
+}
+
+// 通过同一条带的其他切片还原第idx个切片，保存至dest，并校验md5
+func (o *ObjFile) rebuildShard(idx int, dest string) error {
+	var (
+		dataCount, parityCount = o.layout()
+		width                  = dataCount + parityCount
+		_, size, shards        = o.stripe(idx / width)
+		body                   io.ReadCloser
+		f                      *os.File
+		err                    error
+	)
+	if body, err = openShards(withLimit(context.Background()), o, shards, idx%width, false, 0, shardSize(size, dataCount)); err != nil {
+		return err
+	}
+	defer body.Close()
+	if f, err = os.Create(dest); err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, body); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if !tools.MD5Diff(o.ObjShard[idx].Md5, dest) {
+		return ErrRepairMd5
+	}
+	return nil
+}
+
+// 检查切片是否完好(data节点会校验切片md5)
+func checkShard(s *ObjShard) error {
+	_, err := checkRemote(s)
+	return err
+}
+
+// 查找切片所属的文件(旧切片的shard文档中没有记录文件md5)
+func findFileByShard(server, shardMd5 string) string {
+	var fileMd5 string
+	MetaStore.Scan(ES_TYPE_FILE, "", func(id string, doc []byte) bool {
+		var o ObjFile
+		if json.Unmarshal(doc, &o) != nil {
+			return true
+		}
+		for _, s := range o.ObjShard {
+			if s.Md5 == shardMd5 && s.Server == server {
+				fileMd5 = o.Md5
+				return false
+			}
+		}
+		return true
+	})
+	return fileMd5
+}
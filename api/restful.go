@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -12,18 +12,27 @@ import (
 )
 
 const (
-	P_TOKEN = "token" // token的名称
-	P_MD5   = "md5"
-	P_PATH  = "path"
-	P_FILE  = "uploadfile" // post上传时表单名字
-	P_USER  = "user"
-	P_PASS  = "passwd"
+	P_TOKEN   = "token" // token的名称
+	P_MD5     = "md5"
+	P_PATH    = "path"
+	P_FILE    = "uploadfile" // post上传时表单名字
+	P_USER    = "user"
+	P_PASS    = "passwd"
+	P_BUCKET  = "bucket"  // 命名层: bucket名
+	P_KEY     = "key"     // 命名层: bucket中的key
+	P_SYNC    = "sync"    // 为1时同步上传
+	P_FILEMD5 = "filemd5" // 上传切片时，切片所属文件的md5
+
+	H_UPLOAD_MODE = "X-Upload-Mode" // 上传模式: sync|async，默认async
+	H_JOB_ID      = "X-Job-Id"      // 上传任务id
 )
 
 var (
-	ListenAddr   = "192.168.10.150:9000" // 该api服务接听的地址
-	ReadTimeout  = 10 * time.Second
-	WriteTimeout = 10 * time.Second
+	ListenAddr      = "192.168.10.150:9000" // 该api服务接听的地址
+	HBLegacy        = false                 // 按旧格式发送心跳，用于滚动升级
+	ReadTimeout     = 10 * time.Second      // 读取请求的超时，按请求设置，见withDeadline
+	WriteTimeout    = 10 * time.Second      // 写响应的超时，按请求设置
+	ShutdownTimeout = 30 * time.Second      // 退出时等待请求及上传结束的最长时间
 )
 
 var (
@@ -33,70 +42,161 @@ var (
 	Err405 = errors.New("非法Method")
 )
 
-func init() {
-	// 获取环境变量
-	if l := os.Getenv("ListenAddr"); len(l) != 0 {
-		ListenAddr = l
-	}
-}
-
 type APIServerStruct struct {
 	ListenAddr string
 	serv       *http.Server // 对外隐藏，提供Start方法替代
 }
 
-// 启动程序
+// 启动程序，Stop后返回
 func (ds *APIServerStruct) Start() {
 	log.Printf("启动API服务: %s\n", ds.serv.Addr)
-	log.Fatalln(ds.serv.ListenAndServe())
+	if err := ds.serv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
 }
 
-// 关闭程序
-func (ds *APIServerStruct) Stop() {}
+// 关闭程序: 停止接收新请求，等待正在处理的请求结束，超过deadline时返回错误
+func (ds *APIServerStruct) Stop(deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return ds.serv.Shutdown(ctx)
+}
 
 func NewAPIServer() *APIServerStruct {
 	var s = http.NewServeMux()
 
 	// 初始化处理函数
-	s.HandleFunc("/file", handlerFile)
-	s.HandleFunc("/checkfile", handlerCheckFile)
-	s.HandleFunc("/", func(resp http.ResponseWriter, rsq *http.Request) {
-		resp.Write(tools.Json2Byte(403, Err403.Error()))
-	})
+	s.HandleFunc("/file", authenticate(handlerFile))
+	s.HandleFunc("/checkfile", authenticate(handlerCheckFile))
+	s.HandleFunc("/jobs/", authenticate(handlerJob))
+	s.HandleFunc("/nodes", authenticate(handlerNodes))
+	s.HandleFunc("/users", authenticate(handlerUsers))
+	s.HandleFunc("/users/keys", authenticate(handlerKeys))
+	s.HandleFunc("/acl", authenticate(handlerACL))
+	s.HandleFunc("/presign", authenticate(handlerPresign))
+	s.HandleFunc("/multipart", authenticate(handlerMultipart))
+	s.HandleFunc(TUS_PATH, handlerTus) // OPTIONS以外的请求在handlerTus中鉴权
+	s.HandleFunc("/", handlerS3)       // 其余路径均为S3兼容接口，使用S3签名鉴权
 
 	return &APIServerStruct{
 		ListenAddr: ListenAddr,
 		serv: &http.Server{
-			Addr:           ListenAddr,
-			Handler:        s,
-			ReadTimeout:    ReadTimeout,
-			WriteTimeout:   WriteTimeout,
-			MaxHeaderBytes: 1 << 20,
+			Addr:              ListenAddr,
+			Handler:           withDeadline(s),
+			ReadHeaderTimeout: live().ReadTimeout,
+			MaxHeaderBytes:    1 << 20,
 		}}
 }
 
+// 按当前配置为每个请求设置读写超时，重新加载配置后对新请求生效
+// 流式传输的处理函数可以自行清除超时；上传请求不设超时，鉴权时可能已读取整个表单
+func withDeadline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var (
+			c   = live()
+			rc  = http.NewResponseController(resp)
+			now = time.Now()
+		)
+		if isUpload(req) {
+			h.ServeHTTP(resp, req)
+			return
+		}
+		if c.ReadTimeout > 0 {
+			rc.SetReadDeadline(now.Add(c.ReadTimeout))
+		}
+		if c.WriteTimeout > 0 {
+			rc.SetWriteDeadline(now.Add(c.WriteTimeout))
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// 上传请求的耗时与文件大小相关，同步上传时还要等待切片上传及提交
+// PUT /file、PUT /multipart、tus的POST/PATCH，以及S3接口的PUT
+func isUpload(req *http.Request) bool {
+	var name = strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+	switch {
+	case name == "file" || name == "multipart":
+		return req.Method == "PUT"
+	case name == strings.Trim(TUS_PATH, "/"):
+		return req.Method == "POST" || req.Method == "PATCH"
+	}
+	_, reserved := reservedBucket[name]
+	return !reserved && req.Method == "PUT"
+}
+
 // 处理文件相关功能
+// 可以通过md5，或bucket+key定位文件，PUT时必须带md5用于校验
+// 按md5访问时检查文件的owners/acl，按bucket+key访问时检查bucket的owner/acl
 func handlerFile(resp http.ResponseWriter, req *http.Request) {
 	var (
-		m   = req.Method
-		obj = new(ObjFile)
-		err error
+		m      = req.Method
+		obj    = new(ObjFile)
+		bucket = req.FormValue(P_BUCKET)
+		key    = req.FormValue(P_KEY)
+		err    error
 	)
 
 	obj.Md5 = strings.ToLower(req.FormValue(P_MD5))
-	if len(obj.Md5) != 32 {
+	if u := reqUser(req); u != nil {
+		obj.user = u.Name
+	}
+	obj.keyed = len(key) != 0
+	if len(key) != 0 && !bucketAllowed(req, bucket, m != "GET" && m != "HEAD") {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if len(key) == 0 && (m == "GET" || m == "HEAD") && !fileAllowed(req, obj.Md5) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if len(key) != 0 && (m == "GET" || m == "HEAD") {
+		k := getObjKey(bucket, key)
+		if k == nil {
+			resp.Write(tools.Json2Byte(404, ErrKeyNotFound.Error()))
+			return
+		}
+		obj.Md5 = k.Md5
+	}
+	if len(obj.Md5) != 32 && !(len(key) != 0 && m == "DELETE") {
 		resp.Write(tools.Json2Byte(403, "无效md5: "+obj.Md5))
 		return
 	}
 	switch {
-	case m == "GET": // 获取文件, 带token过来，通过文件名
+	case m == "GET" || m == "HEAD": // 获取文件，支持Range和条件请求
 		obj.SendFile(resp, req)
-	case m == "PUT": // 新建文件
-		if err = obj.FileServer(resp, req); err != nil {
+	case m == "PUT": // 新建文件，可以通过X-Storage-Class头部选择存储类型
+		if err = obj.setClass(req.Header.Get(H_STORAGE_CLASS)); err != nil {
+			resp.Write(tools.Json2Byte(400, err.Error()+": "+req.Header.Get(H_STORAGE_CLASS)))
+			return
+		}
+		if len(key) != 0 { // 上传提交后才绑定key，后台上传时由上传任务绑定
+			if err = createBucket(bucket, obj.user); err != nil && err != ErrBucketExist {
+				resp.Write(tools.Json2Byte(500, err.Error()))
+				return
+			}
+			obj.bind = &ObjKey{Bucket: bucket, Key: key}
+		}
+		if err = obj.FileServer(resp, req); err != nil && err != ErrExist {
 			resp.Write(tools.Json2Byte(500, err.Error()))
-		} else {
+			return
+		}
+		if err == ErrExist { // 已存在该文件，已增加引用
+			if err = obj.bindPending(); err != nil {
+				resp.Write(tools.Json2Byte(500, err.Error()))
+				return
+			}
+		}
+		if obj.job == nil { // 已存在该文件，没有上传任务
 			resp.Write(tools.Json2Byte(200, "成功上传: "+obj.Md5))
+			return
 		}
+		resp.Header().Set(H_JOB_ID, obj.job.ID)
+		resp.Write(tools.Json2ByteObj(200, map[string]string{
+			"md5":    obj.Md5,
+			"job":    obj.job.ID,
+			"status": obj.job.Status,
+		}))
 
 	case m == "DELETE": // 删除文件，通过文件名
 		obj.DeleteFile(resp, req)
@@ -105,11 +205,44 @@ func handlerFile(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// 通过md5返回信息
+// 上传后绑定bucket/key，bucket不存在时自动创建，上传者为owner
+func bindFileKey(obj *ObjFile, bucket, key string) error {
+	if err := createBucket(bucket, obj.user); err != nil && err != ErrBucketExist {
+		releaseRef(obj.Md5, "", true)
+		return err
+	}
+	return bindKey(&ObjKey{
+		Bucket: bucket,
+		Key:    key,
+		Md5:    obj.Md5,
+		Size:   obj.Size,
+		Create: time.Now().UnixNano(),
+	})
+}
+
+// 通过md5或bucket+key返回信息
 func handlerCheckFile(resp http.ResponseWriter, req *http.Request) {
-	var obj = new(ObjFile)
+	var (
+		obj = new(ObjFile)
+		key = req.FormValue(P_KEY)
+	)
 
 	obj.Md5 = strings.ToLower(req.FormValue(P_MD5))
+	if len(key) != 0 {
+		if !bucketAllowed(req, req.FormValue(P_BUCKET), false) {
+			resp.Write(tools.Json2Byte(403, Err403.Error()))
+			return
+		}
+		k := getObjKey(req.FormValue(P_BUCKET), key)
+		if k == nil {
+			resp.Write(tools.Json2Byte(404, ErrKeyNotFound.Error()))
+			return
+		}
+		obj.Md5 = k.Md5
+	} else if !fileAllowed(req, obj.Md5) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
 	if len(obj.Md5) != 32 {
 		resp.Write(tools.Json2Byte(403, "无效md5: "+obj.Md5))
 		return
@@ -121,3 +254,22 @@ func handlerCheckFile(resp http.ResponseWriter, req *http.Request) {
 	// 检查是否存在该文件，并返回元数据信息
 	obj.HeadFile(resp, req)
 }
+
+// 查看所有data节点的状态，只有管理员可以查看
+func handlerNodes(resp http.ResponseWriter, req *http.Request) {
+	if !isAdmin(reqUser(req)) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if req.Method != "GET" {
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+		return
+	}
+	DataMu.RLock()
+	nodes := make(map[string]DataNode, len(DataServer))
+	for addr, node := range DataServer {
+		nodes[addr] = *node
+	}
+	DataMu.RUnlock()
+	resp.Write(tools.Json2ByteObj(200, nodes))
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3兼容接口，使用path-style访问: http://ListenAddr/bucket/key
+// bucket和object只是命名层，object文档记录key到文件md5的映射，
+// 文件本身仍然通过ObjFile的切片流程存储
+//
+// 支持: ListBuckets、CreateBucket/HeadBucket/DeleteBucket/GetBucketLocation、
+//       PutObject/GetObject/HeadObject/DeleteObject、ListObjectsV2
+// 注意: bucket名不能为file/checkfile/jobs/nodes/users/acl/presign/multipart/tus，这些路径已被原有接口占用
+// 启用鉴权时，bucket的owner可读写，acl中的用户只读，见acl.go
+
+const (
+	S3_XMLNS       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	S3_MAX_KEYS    = 1000 // ListObjectsV2一次最多返回的key数
+	S3_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+// s3错误，Status为http状态码，Code为s3错误码
+type s3Error struct {
+	Status int
+	Code   string
+	Msg    string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+var (
+	ErrS3AccessDenied   = &s3Error{403, "AccessDenied", "Access Denied"}
+	ErrS3InvalidKey     = &s3Error{403, "InvalidAccessKeyId", "The access key Id you provided does not exist"}
+	ErrS3Signature      = &s3Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	ErrS3TimeSkewed     = &s3Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	ErrS3AuthHeader     = &s3Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	ErrS3BadDigest      = &s3Error{400, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+	ErrS3ShaMismatch    = &s3Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	ErrS3InvalidDigest  = &s3Error{400, "InvalidDigest", "The Content-MD5 you specified is not valid"}
+	ErrS3InvalidArg     = &s3Error{400, "InvalidArgument", "Invalid Argument"}
+	ErrS3BucketName     = &s3Error{400, "InvalidBucketName", "The specified bucket is not valid"}
+	ErrS3StorageClass   = &s3Error{400, "InvalidStorageClass", "The storage class you specified is not valid"}
+	ErrS3NoSuchBucket   = &s3Error{404, "NoSuchBucket", "The specified bucket does not exist"}
+	ErrS3NoSuchKey      = &s3Error{404, "NoSuchKey", "The specified key does not exist"}
+	ErrS3BucketExists   = &s3Error{409, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded"}
+	ErrS3BucketTaken    = &s3Error{409, "BucketAlreadyExists", "The requested bucket name is not available"}
+	ErrS3BucketNotEmpty = &s3Error{409, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	ErrS3Method         = &s3Error{405, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	ErrS3NotImplemented = &s3Error{501, "NotImplemented", "A header you provided implies functionality that is not implemented"}
+	ErrS3SlowDown       = &s3Error{503, "SlowDown", "Please reduce your request rate"}
+	ErrS3Internal       = &s3Error{500, "InternalError", "We encountered an internal error. Please try again"}
+)
+
+// xml响应
+type s3ErrorResult struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3BucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Buckets []s3BucketInfo `xml:"Buckets>Bucket"`
+}
+
+type s3LocationResult struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3Content struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Content      `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// S3接口入口，注册在"/"上
+func handlerS3(resp http.ResponseWriter, req *http.Request) {
+	var (
+		bucket, key = splitS3Path(req.URL.Path)
+		m           = req.Method
+		u           *User
+		sig         *s3Signing
+		err         *s3Error
+	)
+	if u, sig, err = s3Verify(req); err != nil {
+		log.Printf("S3鉴权失败: [%s] %s %s\n", err.Code, m, req.URL.Path)
+		writeS3Error(resp, req, err)
+		return
+	}
+	req = withUser(req, u)
+	if sig != nil {
+		req = req.WithContext(context.WithValue(req.Context(), CTX_S3_SIGNING, sig))
+	}
+	switch {
+	case bucket == "" && m == "GET": // 列出所有bucket
+		s3ListBuckets(resp, req)
+	case bucket == "":
+		writeS3Error(resp, req, ErrS3Method)
+	case key == "":
+		s3BucketHandler(resp, req, bucket)
+	default:
+		s3ObjectHandler(resp, req, bucket, key)
+	}
+}
+
+// bucket相关功能
+func s3BucketHandler(resp http.ResponseWriter, req *http.Request, bucket string) {
+	var m = req.Method
+	if m != "PUT" && !bucketAllowed(req, bucket, m == "DELETE") {
+		writeS3Error(resp, req, ErrS3AccessDenied)
+		return
+	}
+	switch {
+	case m == "GET" && hasQuery(req, "location"):
+		s3GetBucketLocation(resp, req, bucket)
+	case m == "GET" && req.URL.Query().Get("list-type") == "2":
+		s3ListObjectsV2(resp, req, bucket)
+	case m == "GET": // ListObjects(V1)暂不支持
+		writeS3Error(resp, req, ErrS3NotImplemented)
+	case m == "PUT":
+		s3CreateBucket(resp, req, bucket)
+	case m == "HEAD":
+		if !MetaStore.IsExists(ES_TYPE_BUCKET, bucket) {
+			writeS3Error(resp, req, ErrS3NoSuchBucket)
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+	case m == "DELETE":
+		s3DeleteBucket(resp, req, bucket)
+	default:
+		writeS3Error(resp, req, ErrS3Method)
+	}
+}
+
+// object相关功能
+func s3ObjectHandler(resp http.ResponseWriter, req *http.Request, bucket, key string) {
+	if !MetaStore.IsExists(ES_TYPE_BUCKET, bucket) {
+		writeS3Error(resp, req, ErrS3NoSuchBucket)
+		return
+	}
+	if !bucketAllowed(req, bucket, req.Method == "PUT" || req.Method == "DELETE") {
+		writeS3Error(resp, req, ErrS3AccessDenied)
+		return
+	}
+	switch req.Method {
+	case "PUT":
+		if len(req.Header.Get("X-Amz-Copy-Source")) != 0 { // CopyObject暂不支持
+			writeS3Error(resp, req, ErrS3NotImplemented)
+			return
+		}
+		s3PutObject(resp, req, bucket, key)
+	case "GET":
+		s3GetObject(resp, req, bucket, key)
+	case "HEAD":
+		s3HeadObject(resp, req, bucket, key)
+	case "DELETE":
+		s3DeleteObject(resp, req, bucket, key)
+	default:
+		writeS3Error(resp, req, ErrS3Method)
+	}
+}
+
+// 只列出当前用户可以读取的bucket
+func s3ListBuckets(resp http.ResponseWriter, req *http.Request) {
+	var (
+		res = &s3ListAllMyBucketsResult{Xmlns: S3_XMLNS}
+		u   = reqUser(req)
+	)
+	err := MetaStore.Scan(ES_TYPE_BUCKET, "", func(id string, doc []byte) bool {
+		var b Bucket
+		if json.Unmarshal(doc, &b) == nil && b.canRead(u) {
+			res.Buckets = append(res.Buckets, s3BucketInfo{
+				Name:         b.Name,
+				CreationDate: s3Time(b.Create),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("遍历bucket出错: ", err.Error())
+		writeS3Error(resp, req, ErrS3Internal)
+		return
+	}
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Name < res.Buckets[j].Name })
+	writeS3XML(resp, res)
+}
+
+func s3GetBucketLocation(resp http.ResponseWriter, req *http.Request, bucket string) {
+	if !MetaStore.IsExists(ES_TYPE_BUCKET, bucket) {
+		writeS3Error(resp, req, ErrS3NoSuchBucket)
+		return
+	}
+	writeS3XML(resp, &s3LocationResult{Xmlns: S3_XMLNS})
+}
+
+func s3CreateBucket(resp http.ResponseWriter, req *http.Request, bucket string) {
+	var owner string
+	if u := reqUser(req); u != nil {
+		owner = u.Name
+	}
+	switch err := createBucket(bucket, owner); err {
+	case nil:
+		resp.Header().Set("Location", "/"+bucket)
+		resp.WriteHeader(http.StatusOK)
+	case ErrBucketName:
+		writeS3Error(resp, req, ErrS3BucketName)
+	case ErrBucketExist:
+		if !bucketAllowed(req, bucket, true) { // 其他用户的bucket
+			writeS3Error(resp, req, ErrS3BucketTaken)
+			return
+		}
+		writeS3Error(resp, req, ErrS3BucketExists)
+	default:
+		writeS3Error(resp, req, ErrS3Internal)
+	}
+}
+
+func s3DeleteBucket(resp http.ResponseWriter, req *http.Request, bucket string) {
+	switch err := deleteBucket(bucket); err {
+	case nil:
+		resp.WriteHeader(http.StatusNoContent)
+	case ErrBucketNotFound:
+		writeS3Error(resp, req, ErrS3NoSuchBucket)
+	case ErrBucketNotEmpty:
+		writeS3Error(resp, req, ErrS3BucketNotEmpty)
+	default:
+		writeS3Error(resp, req, ErrS3Internal)
+	}
+}
+
+func s3ListObjectsV2(resp http.ResponseWriter, req *http.Request, bucket string) {
+	var (
+		q         = req.URL.Query()
+		prefix    = q.Get("prefix")
+		delimiter = q.Get("delimiter")
+		start     = q.Get("start-after")
+		token     = q.Get("continuation-token")
+		maxKeys   = S3_MAX_KEYS
+		last      string // 最后一个返回的key或公共前缀
+		res       = &s3ListBucketResult{
+			Xmlns:             S3_XMLNS,
+			Name:              bucket,
+			Prefix:            prefix,
+			Delimiter:         delimiter,
+			StartAfter:        start,
+			ContinuationToken: token,
+		}
+	)
+	if !MetaStore.IsExists(ES_TYPE_BUCKET, bucket) {
+		writeS3Error(resp, req, ErrS3NoSuchBucket)
+		return
+	}
+	if mk := q.Get("max-keys"); len(mk) != 0 {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			writeS3Error(resp, req, ErrS3InvalidArg)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	if len(token) != 0 {
+		b, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(resp, req, ErrS3InvalidArg)
+			return
+		}
+		start = string(b)
+	}
+	res.MaxKeys = maxKeys
+
+	// 按id顺序从start之后分批遍历，每批最多maxKeys+1个，不读取start之前和本页之后的key
+	// 公共前缀以delimiter结尾，需要跳过其下所有key: 从前缀之后(追加\xff，key中不会出现)继续遍历
+	var (
+		base  = bucket + "/"
+		after = base + start
+	)
+	if len(delimiter) != 0 && len(start) > len(prefix) && strings.HasSuffix(start, delimiter) {
+		after += "\xff"
+	}
+	for !res.IsTruncated {
+		var n int
+		err := MetaStore.ScanAfter(ES_TYPE_OBJECT, base+prefix, after, maxKeys+1, func(id string, doc []byte) bool {
+			var k ObjKey
+			n++
+			after = id
+			if json.Unmarshal(doc, &k) != nil {
+				return true
+			}
+			if len(delimiter) != 0 {
+				if i := strings.Index(k.Key[len(prefix):], delimiter); i >= 0 {
+					cp := k.Key[:len(prefix)+i+len(delimiter)]
+					if cp == last {
+						return true
+					}
+					if res.KeyCount >= maxKeys {
+						res.IsTruncated = true
+						return false
+					}
+					res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: cp})
+					res.KeyCount++
+					last = cp
+					return true
+				}
+			}
+			if res.KeyCount >= maxKeys {
+				res.IsTruncated = true
+				return false
+			}
+			res.Contents = append(res.Contents, s3Content{
+				Key:          k.Key,
+				LastModified: s3Time(k.Create),
+				ETag:         `"` + k.etag() + `"`,
+				Size:         k.Size,
+				StorageClass: "STANDARD",
+			})
+			res.KeyCount++
+			last = k.Key
+			return true
+		})
+		if err != nil {
+			log.Println("遍历object出错: ", err.Error())
+			writeS3Error(resp, req, ErrS3Internal)
+			return
+		}
+		if n <= maxKeys { // 已遍历完
+			break
+		}
+		if len(delimiter) != 0 && len(last) > len(prefix) && strings.HasSuffix(last, delimiter) {
+			after = base + last + "\xff"
+		}
+	}
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+	}
+	writeS3XML(resp, res)
+}
+
+func s3PutObject(resp http.ResponseWriter, req *http.Request, bucket, key string) {
+	var (
+		obj  = &ObjFile{keyed: true}
+		body io.Reader
+		err  error
+		se   *s3Error
+	)
+	if u := reqUser(req); u != nil {
+		obj.user = u.Name
+	}
+	if err = obj.setClass(req.Header.Get(H_S3_STORAGE_CLASS)); err != nil {
+		writeS3Error(resp, req, ErrS3StorageClass)
+		return
+	}
+	if body, se = s3Body(req); se != nil {
+		writeS3Error(resp, req, se)
+		return
+	}
+	if cm := req.Header.Get("Content-MD5"); len(cm) != 0 {
+		b, err := base64.StdEncoding.DecodeString(cm)
+		if err != nil || len(b) != 16 {
+			writeS3Error(resp, req, ErrS3InvalidDigest)
+			return
+		}
+		obj.Md5 = hex.EncodeToString(b)
+	}
+	switch err = obj.storeFile(body, true); err { // S3的PUT总是同步上传
+	case nil, ErrExist: // 内容已存在时storeFile已增加引用，只需要绑定key
+	case ErrMD5:
+		writeS3Error(resp, req, ErrS3BadDigest)
+		return
+	case ErrRunning:
+		writeS3Error(resp, req, ErrS3SlowDown)
+		return
+	default:
+		if e, ok := err.(*s3Error); ok {
+			writeS3Error(resp, req, e)
+		} else {
+			writeS3Error(resp, req, ErrS3Internal)
+		}
+		return
+	}
+
+	k := &ObjKey{
+		Bucket:      bucket,
+		Key:         key,
+		Md5:         obj.Md5,
+		Size:        obj.Size,
+		Create:      time.Now().UnixNano(),
+		ContentType: req.Header.Get("Content-Type"),
+	}
+	if err = bindKey(k); err != nil {
+		writeS3Error(resp, req, ErrS3Internal)
+		return
+	}
+	log.Printf("S3上传对象: %s/%s -> %s\n", bucket, key, obj.Md5)
+	resp.Header().Set("ETag", `"`+k.ETag+`"`)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func s3GetObject(resp http.ResponseWriter, req *http.Request, bucket, key string) {
+	var (
+		k   *ObjKey
+		obj = new(ObjFile)
+		err error
+	)
+	if k = getObjKey(bucket, key); k == nil {
+		writeS3Error(resp, req, ErrS3NoSuchKey)
+		return
+	}
+	obj.Md5 = k.Md5
+	if err = obj.loadMeta(); err != nil {
+		log.Println("获取文件元数据出错: ", k.Md5, err.Error())
+		writeS3Error(resp, req, ErrS3NoSuchKey)
+		return
+	}
+	setS3ObjectHeader(resp, k)
+	if len(obj.Class) != 0 && obj.Class != CLASS_STANDARD {
+		resp.Header().Set(H_S3_STORAGE_CLASS, obj.Class)
+	}
+	obj.serveContent(resp, req)
+}
+
+func s3HeadObject(resp http.ResponseWriter, req *http.Request, bucket, key string) {
+	var k *ObjKey
+	if k = getObjKey(bucket, key); k == nil {
+		writeS3Error(resp, req, ErrS3NoSuchKey)
+		return
+	}
+	setS3ObjectHeader(resp, k)
+	resp.Header().Set("Last-Modified", time.Unix(0, k.Create).UTC().Format(http.TimeFormat))
+	resp.Header().Set("Content-Length", strconv.FormatInt(k.Size, 10))
+	resp.WriteHeader(http.StatusOK)
+}
+
+// 删除key并释放文件的引用，key不存在时同样返回204
+func s3DeleteObject(resp http.ResponseWriter, req *http.Request, bucket, key string) {
+	if err := unbindKey(bucket, key); err != nil && err != ErrKeyNotFound {
+		writeS3Error(resp, req, ErrS3Internal)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func setS3ObjectHeader(resp http.ResponseWriter, k *ObjKey) {
+	var h = resp.Header()
+	h.Set("ETag", `"`+k.etag()+`"`)
+	h.Set("Accept-Ranges", "bytes")
+	if len(k.ContentType) != 0 {
+		h.Set("Content-Type", k.ContentType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+}
+
+// 拆分路径为bucket和key
+func splitS3Path(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// 是否带有某个query参数(可以没有值)
+func hasQuery(req *http.Request, name string) bool {
+	_, ok := req.URL.Query()[name]
+	return ok
+}
+
+func s3Time(t int64) string {
+	return time.Unix(0, t).UTC().Format(S3_TIME_FORMAT)
+}
+
+func writeS3XML(resp http.ResponseWriter, v interface{}) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = xml.Marshal(v); err != nil {
+		log.Println(err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/xml")
+	resp.Write([]byte(xml.Header))
+	resp.Write(body)
+}
+
+func writeS3Error(resp http.ResponseWriter, req *http.Request, e *s3Error) {
+	var body, _ = xml.Marshal(&s3ErrorResult{
+		Code:     e.Code,
+		Message:  e.Msg,
+		Resource: req.URL.Path,
+	})
+	resp.Header().Set("Content-Type", "application/xml")
+	resp.WriteHeader(e.Status)
+	if req.Method != "HEAD" {
+		resp.Write([]byte(xml.Header))
+		resp.Write(body)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3的AWS Signature Version 4鉴权
+// 只支持Authorization头部签名，不支持query参数签名(presigned url)
+// 配置了S3_ACCESS_KEY或启用了用户鉴权(admin_user)时校验签名；都未配置时只有设置了s3_anonymous才允许不签名访问，否则拒绝所有请求
+// 配置的S3_ACCESS_KEY视为管理员，用户的API key(见user.go)同样可用于S3接口
+// 流式上传(STREAMING-AWS4-HMAC-SHA256-PAYLOAD)时，以头部签名为种子逐块校验chunk-signature
+
+const (
+	S3_ALGORITHM     = "AWS4-HMAC-SHA256"
+	S3_DATE_FORMAT   = "20060102T150405Z"
+	S3_UNSIGNED      = "UNSIGNED-PAYLOAD"
+	S3_STREAMING     = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	S3_CHUNK_ALG     = "AWS4-HMAC-SHA256-PAYLOAD" // chunk签名的算法
+	S3_EMPTY_SHA256  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	S3_HEADER_SHA256 = "X-Amz-Content-Sha256"
+	S3_HEADER_DATE   = "X-Amz-Date"
+)
+
+const CTX_S3_SIGNING ctxKey = 1 // 请求context中保存头部签名的信息，用于校验chunk签名
+
+var (
+	S3MaxSkew        = 15 * time.Minute
+	S3MaxChunk int64 = 16 << 20 // 流式上传时每个chunk的最大大小，校验签名前需要缓存整个chunk
+)
+
+// 头部签名的信息，流式上传时逐块校验签名
+type s3Signing struct {
+	key   []byte // 签名密钥
+	date  string // x-amz-date
+	scope string // date/region/s3/aws4_request
+	seed  string // 头部的签名，第一个chunk签名的上一个签名
+}
+
+// 通过access key获取secret及对应的用户
+func s3Secret(accessKey string) (string, *User, bool) {
+	if c := live(); len(c.S3AccessKey) != 0 && accessKey == c.S3AccessKey {
+		if !AuthEnabled() {
+			return c.S3SecretKey, nil, true
+		}
+		return c.S3SecretKey, &User{Name: AdminUser, Admin: true}, true
+	}
+	if !AuthEnabled() {
+		return "", nil, false
+	}
+	k := getKey(accessKey)
+	if k == nil {
+		return "", nil, false
+	}
+	u := getUser(k.User)
+	if u == nil {
+		return "", nil, false
+	}
+	return k.Secret, u, true
+}
+
+// 校验请求签名，返回签名对应的用户及签名信息，允许匿名访问时都为nil
+func s3Verify(req *http.Request) (*User, *s3Signing, *s3Error) {
+	var (
+		auth          = req.Header.Get("Authorization")
+		credential    string
+		signedHeaders string
+		signature     string
+		amzDate       = req.Header.Get(S3_HEADER_DATE)
+		payload       = req.Header.Get(S3_HEADER_SHA256)
+		t             time.Time
+		err           error
+	)
+	if c := live(); len(c.S3AccessKey) == 0 && !AuthEnabled() {
+		if c.S3Anonymous {
+			return nil, nil, nil
+		}
+		return nil, nil, ErrS3AccessDenied
+	}
+	if !strings.HasPrefix(auth, S3_ALGORITHM+" ") {
+		return nil, nil, ErrS3AccessDenied
+	}
+	// AWS4-HMAC-SHA256 Credential=AK/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=xxx
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, S3_ALGORITHM+" "), ",") {
+		kv = strings.TrimSpace(kv)
+		switch {
+		case strings.HasPrefix(kv, "Credential="):
+			credential = strings.TrimPrefix(kv, "Credential=")
+		case strings.HasPrefix(kv, "SignedHeaders="):
+			signedHeaders = strings.TrimPrefix(kv, "SignedHeaders=")
+		case strings.HasPrefix(kv, "Signature="):
+			signature = strings.TrimPrefix(kv, "Signature=")
+		}
+	}
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || len(signedHeaders) == 0 || len(signature) == 0 {
+		return nil, nil, ErrS3AuthHeader
+	}
+	secret, u, ok := s3Secret(scope[0])
+	if !ok {
+		return nil, nil, ErrS3InvalidKey
+	}
+	// scope: date/region/service/aws4_request
+	parts := strings.Split(scope[1], "/")
+	if len(parts) != 4 || parts[3] != "aws4_request" {
+		return nil, nil, ErrS3AuthHeader
+	}
+
+	// 请求时间: 必须带X-Amz-Date，scope中的日期须与之相同，服务须为s3
+	if t, err = time.Parse(S3_DATE_FORMAT, amzDate); err != nil {
+		return nil, nil, ErrS3AccessDenied
+	}
+	if parts[0] != amzDate[:8] || parts[2] != "s3" {
+		return nil, nil, ErrS3AuthHeader
+	}
+	if d := time.Since(t); d > S3MaxSkew || d < -S3MaxSkew {
+		return nil, nil, ErrS3TimeSkewed
+	}
+	if len(payload) == 0 {
+		payload = S3_EMPTY_SHA256
+	}
+
+	// 计算签名
+	h := sha256.Sum256([]byte(s3CanonicalRequest(req, signedHeaders, payload)))
+	toSign := strings.Join([]string{
+		S3_ALGORITHM,
+		amzDate,
+		scope[1],
+		hex.EncodeToString(h[:]),
+	}, "\n")
+	key := s3SigningKey(secret, parts)
+	if !hmac.Equal([]byte(hex.EncodeToString(s3HMAC(key, toSign))), []byte(signature)) {
+		return nil, nil, ErrS3Signature
+	}
+	return u, &s3Signing{key: key, date: amzDate, scope: scope[1], seed: signature}, nil
+}
+
+// 规范请求: method、路径、query、头部、签名的头部名及请求体的sha256
+func s3CanonicalRequest(req *http.Request, signedHeaders, payload string) string {
+	return strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(req),
+		s3CanonicalHeaders(req, signedHeaders),
+		signedHeaders,
+		payload,
+	}, "\n")
+}
+
+// 签名密钥，scope为date/region/service/aws4_request
+func s3SigningKey(secret string, scope []string) []byte {
+	key := s3HMAC([]byte("AWS4"+secret), scope[0])
+	for _, p := range scope[1:] {
+		key = s3HMAC(key, p)
+	}
+	return key
+}
+
+// 一个chunk的签名，prev为上一个chunk的签名(第一个chunk为头部的签名)
+func (s *s3Signing) chunkSignature(prev string, data []byte) string {
+	h := sha256.Sum256(data)
+	toSign := strings.Join([]string{
+		S3_CHUNK_ALG,
+		s.date,
+		s.scope,
+		prev,
+		S3_EMPTY_SHA256,
+		hex.EncodeToString(h[:]),
+	}, "\n")
+	return hex.EncodeToString(s3HMAC(s.key, toSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	var m = hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// 按aws规则编码，只保留A-Za-z0-9-_.~
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(req *http.Request) string {
+	return canonicalQuery(req.URL.Query())
+}
+
+// 按aws规则编码并排序query参数
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func s3CanonicalHeaders(req *http.Request, signedHeaders string) string {
+	var b bytes.Buffer
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var v string
+		switch name {
+		case "host":
+			v = req.Host
+		case "content-length":
+			v = strconv.FormatInt(req.ContentLength, 10)
+		default:
+			var vs []string
+			for _, hv := range req.Header[http.CanonicalHeaderKey(name)] {
+				vs = append(vs, strings.Join(strings.Fields(hv), " "))
+			}
+			v = strings.Join(vs, ",")
+		}
+		b.WriteString(name + ":" + v + "\n")
+	}
+	return b.String()
+}
+
+// 返回请求体，处理aws-chunked编码，并校验x-amz-content-sha256或chunk签名
+func s3Body(req *http.Request) (io.Reader, *s3Error) {
+	var payload = req.Header.Get(S3_HEADER_SHA256)
+	switch {
+	case payload == S3_STREAMING:
+		sig, _ := req.Context().Value(CTX_S3_SIGNING).(*s3Signing) // 匿名访问时为nil，不校验
+		c := &s3ChunkReader{r: bufio.NewReader(req.Body), sig: sig}
+		if sig != nil {
+			c.prev = sig.seed
+		}
+		return c, nil
+	case strings.HasPrefix(payload, "STREAMING-"):
+		return nil, ErrS3NotImplemented
+	case len(payload) == 0 || payload == S3_UNSIGNED:
+		return req.Body, nil
+	case len(payload) != 64:
+		return nil, ErrS3ShaMismatch
+	}
+	return &s3ShaReader{r: req.Body, h: sha256.New(), sum: payload, err: ErrS3ShaMismatch}, nil
+}
+
+// 读取时计算sha256，读完后与x-amz-content-sha256(或X-Obj-Content-SHA256)不一致时返回err
+type s3ShaReader struct {
+	r   io.Reader
+	h   hash.Hash
+	sum string
+	err error
+}
+
+func (s *s3ShaReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(s.h.Sum(nil)) != s.sum {
+		return n, s.err
+	}
+	return n, err
+}
+
+// 解码aws-chunked请求体: <hex-size>;chunk-signature=<sig>\r\n<data>\r\n ... 0;chunk-signature=<sig>\r\n\r\n
+// 每个chunk读完后校验签名，签名依次串联，最后的空chunk同样签名；chunk最大为S3MaxChunk
+type s3ChunkReader struct {
+	r    *bufio.Reader
+	sig  *s3Signing // 为nil时不校验签名
+	prev string     // 上一个chunk的签名
+	want string     // 当前chunk的签名
+	buf  []byte     // 当前chunk的数据，读完后校验
+	left int64      // 当前chunk剩余字节
+	err  error
+}
+
+func (c *s3ChunkReader) Read(p []byte) (int, error) {
+	var n int
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.left == 0 {
+		if c.err = c.next(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, c.err = c.r.Read(p)
+	c.left -= int64(n)
+	if c.sig != nil {
+		c.buf = append(c.buf, p[:n]...)
+	}
+	if c.left == 0 && c.err == nil {
+		// chunk结尾的\r\n
+		if _, c.err = c.r.Discard(2); c.err == nil {
+			c.err = c.verify()
+		}
+	}
+	if c.err == io.EOF {
+		c.err = io.ErrUnexpectedEOF
+	}
+	return n, c.err
+}
+
+// 读取下一个chunk的头部，最后的空chunk校验签名后返回io.EOF
+func (c *s3ChunkReader) next() error {
+	var (
+		line string
+		size int64
+		err  error
+	)
+	if line, err = c.r.ReadString('\n'); err == io.EOF {
+		return io.ErrUnexpectedEOF // 没有最后的空chunk时请求体不完整
+	} else if err != nil {
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSpace(line), ";", 2)
+	if size, err = strconv.ParseInt(fields[0], 16, 64); err != nil || size < 0 || size > S3MaxChunk {
+		return ErrS3InvalidArg
+	}
+	c.want = ""
+	if len(fields) == 2 {
+		c.want = strings.TrimPrefix(fields[1], "chunk-signature=")
+	}
+	c.buf = c.buf[:0]
+	if size == 0 {
+		if err = c.verify(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	c.left = size
+	return nil
+}
+
+// 校验当前chunk的签名
+func (c *s3ChunkReader) verify() error {
+	if c.sig == nil {
+		return nil
+	}
+	sum := c.sig.chunkSignature(c.prev, c.buf)
+	if !hmac.Equal([]byte(sum), []byte(c.want)) {
+		return ErrS3Signature
+	}
+	c.prev = sum
+	return nil
+}
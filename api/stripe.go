@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	tools "../tools"
+)
+
+// 条带(stripe): 大于StripeSize的文件按StripeSize切成多个条带，每个条带单独做RS编码
+//   file文档中的stripe_size及obj_shard组成条带清单: 第i个条带为文件中[i*stripe_size, (i+1)*stripe_size)的数据，
+//   其切片为obj_shard[i*w, (i+1)*w)，w为数据块+校验块，最后一个条带可以不满
+//   条带大小不一致时(如分段上传的文件)，stripes按顺序记录每个条带的大小，优先于stripe_size
+//   不大于StripeSize的文件只有一个条带，不记录stripe_size，与旧版本的格式相同
+// 上传时源文件保留在切片目录中，逐个条带切片并上传，最多同时处理StripeParallel个条带，
+// 本地只保留这些条带的切片；读取和修复时只访问相关的条带
+
+var (
+	StripeSize     int64 = 64 << 20 // 条带大小，为0时不分条带
+	StripeParallel       = 2        // 上传时同时切片和上传的条带数
+)
+
+// 条带数
+func (o *ObjFile) stripeCount() int {
+	if len(o.Stripes) != 0 {
+		return len(o.Stripes)
+	}
+	if o.StripeSize <= 0 || o.Size <= o.StripeSize {
+		return 1
+	}
+	return int((o.Size + o.StripeSize - 1) / o.StripeSize)
+}
+
+// 第i个条带在文件中的偏移、数据大小及切片，清单不完整时shards为nil
+func (o *ObjFile) stripe(i int) (off, size int64, shards []ObjShard) {
+	var (
+		dataCount, parityCount = o.layout()
+		width                  = dataCount + parityCount
+	)
+	switch {
+	case len(o.Stripes) != 0:
+		for _, n := range o.Stripes[:i] {
+			off += n
+		}
+		size = o.Stripes[i]
+	case o.stripeCount() > 1:
+		off = int64(i) * o.StripeSize
+		if size = o.Size - off; size > o.StripeSize {
+			size = o.StripeSize
+		}
+	default:
+		size = o.Size
+	}
+	if (i+1)*width <= len(o.ObjShard) {
+		shards = o.ObjShard[i*width : (i+1)*width]
+	}
+	return off, size, shards
+}
+
+// 包含文件偏移off的条带
+func (o *ObjFile) stripeAt(off int64) int {
+	switch {
+	case len(o.Stripes) != 0:
+		for i, n := range o.Stripes {
+			if off < n {
+				return i
+			}
+			off -= n
+		}
+		return len(o.Stripes) - 1
+	case o.stripeCount() > 1:
+		return int(off / o.StripeSize)
+	}
+	return 0
+}
+
+// 所有条带的大小
+func (o *ObjFile) stripeSizes() []int64 {
+	var sizes = make([]int64, o.stripeCount())
+	for i := range sizes {
+		_, sizes[i], _ = o.stripe(i)
+	}
+	return sizes
+}
+
+// 条带中每个切片的大小，文件按顺序分成dataCount段(最后一段补0)
+func shardSize(size int64, dataCount int) int64 {
+	return (size + int64(dataCount) - 1) / int64(dataCount)
+}
+
+// 分条带上传: 并行切片及上传各条带，出错后取消其他条带的上传，不再处理剩余的条带
+// 每个条带上传前从源文件切出切片(继续上传时本地已有的切片除外)，上传后即删除
+func (s *Sha) uploadStripes(ctx context.Context, obj *ObjFile, shardArr []string) error {
+	var (
+		dataCount, parityCount = obj.layout()
+		width                  = dataCount + parityCount
+		n                      = len(shardArr) / width
+		sem                    = make(chan struct{}, StripeParallel)
+		errMu                  sync.Mutex
+		wg                     sync.WaitGroup
+		first                  error
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var (
+				lo, hi = i * width, (i + 1) * width
+				err    error
+			)
+			if ctx.Err() != nil || allPlaced(shardArr[lo:hi]) {
+				return
+			}
+			if err = obj.journal.encodeStripe(i, shardArr[lo:hi]); err == nil {
+				err = s.uploadGroup(ctx, obj, shardArr, lo, hi)
+			}
+			if err != nil {
+				errMu.Lock()
+				if first == nil {
+					first = err
+				}
+				errMu.Unlock()
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err() // 上传被取消
+	}
+	return first
+}
+
+// 该组切片是否都已上传
+func allPlaced(shardArr []string) bool {
+	for _, src := range shardArr {
+		if len(src) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 从源文件切出第i个条带的切片并记录md5，shardArr为该条带的切片，已上传的为""
+// 本地已有该条带所有待上传的切片时不再切片；继续上传时切出的切片须与原来记录的md5一致
+func (j *Journal) encodeStripe(i int, shardArr []string) error {
+	var (
+		dataCount, parityCount = j.File.layout()
+		width                  = dataCount + parityCount
+		lo                     = i * width
+		md5s                   = make([]string, width)
+		paths                  []string
+		err                    error
+	)
+	if j.encoded(lo, shardArr) {
+		return nil
+	}
+	rs := tools.NewrsFile(j.Source, j.ShardDir, dataCount, parityCount)
+	if paths, err = rs.RSSplitStripe(i, j.File.StripeSize); err != nil {
+		log.Printf("条带%d切片时出错: %s %s\n", i, j.File.Md5, err.Error())
+		return ErrUpload
+	}
+	for k, path := range paths {
+		if len(shardArr[k]) == 0 { // 已上传的切片
+			os.Remove(path)
+			continue
+		}
+		if md5s[k], err = tools.Md5Get(path); err != nil {
+			return err
+		}
+		if old := j.ShardMd5[lo+k]; len(old) != 0 && old != md5s[k] {
+			log.Println("重新切出的切片md5不一致: ", path)
+			return ErrMD5
+		}
+	}
+	j.mu.Lock()
+	for k, md5 := range md5s {
+		if len(md5) != 0 {
+			j.ShardMd5[lo+k] = md5
+		}
+	}
+	j.mu.Unlock()
+	tools.Debugln("条带切片成功: ", filepath.Base(j.Source), i)
+	return j.save()
+}
+
+// 本地是否已有该组所有待上传的切片，且已记录md5
+func (j *Journal) encoded(lo int, shardArr []string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for k, src := range shardArr {
+		if len(src) != 0 && (len(j.ShardMd5[lo+k]) == 0 || !tools.FileExist(src)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 切片传输的并发控制: 上传、下载、删除切片时并行处理各个切片
+//   每个请求(一个文件的一次上传/下载/删除)同时最多ShardParallel个切片，所有请求合计最多ShardParallelTotal个
+//   每个切片失败后单独重试，间隔从RetryBackoff开始每次翻倍(不超过RetryMaxBackoff)，共FailCount次
+//   ctx取消后不再开始新的传输及重试，正在进行的请求随之中断
+
+var (
+	ShardParallel      = 8                      // 每个请求同时传输的切片数
+	ShardParallelTotal = 64                     // 所有请求同时传输的切片数
+	RetryBackoff       = 200 * time.Millisecond // 第一次重试前的等待时间
+	RetryMaxBackoff    = 5 * time.Second        // 重试的最长等待时间
+	transferSlots      chan struct{}            // 全局并发，setupTransfer时创建
+)
+
+type limitKey struct{}
+
+// 按配置创建全局并发限制，须在加载配置后调用
+func setupTransfer() {
+	transferSlots = make(chan struct{}, ShardParallelTotal)
+}
+
+// 为一个请求设置并发限制，同一请求中的多组切片(如多个条带)共用该限制；已设置时不变
+func withLimit(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(limitKey{}).(chan struct{}); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, limitKey{}, make(chan struct{}, ShardParallel))
+}
+
+// 获取请求及全局的传输名额
+func acquireSlot(ctx context.Context) error {
+	local, _ := ctx.Value(limitKey{}).(chan struct{})
+	select {
+	case local <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case transferSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		<-local
+		return ctx.Err()
+	}
+}
+
+func releaseSlot(ctx context.Context) {
+	local, _ := ctx.Value(limitKey{}).(chan struct{})
+	<-transferSlots
+	<-local
+}
+
+// 执行fn，失败时按指数退避重试，共FailCount次，返回最后一次的错误
+// 每次尝试时占用一个传输名额，等待重试期间不占用
+func withRetry(ctx context.Context, fn func() error) error {
+	var (
+		wait = RetryBackoff
+		err  error
+	)
+	for i := 0; ; i++ {
+		if err = acquireSlot(ctx); err != nil {
+			return err
+		}
+		err = fn()
+		releaseSlot(ctx)
+		if err == nil || i+1 >= FailCount {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if wait *= 2; wait > RetryMaxBackoff {
+			wait = RetryMaxBackoff
+		}
+	}
+}
+
+// 并行处理n个切片，每个切片单独重试，返回每个切片最后一次的错误
+func transferAll(ctx context.Context, n int, fn func(i int) error) []error {
+	var (
+		errs = make([]error, n)
+		wg   sync.WaitGroup
+	)
+	ctx = withLimit(ctx)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = withRetry(ctx, func() error { return fn(i) })
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tools "../tools"
+)
+
+// 断点续传: 兼容tus 1.0.0协议(https://tus.io)，支持creation、creation-with-upload、termination、expiration扩展
+//   OPTIONS /tus/      协议版本及扩展，不需要鉴权
+//   POST    /tus/      创建上传，Upload-Length为文件大小，返回Location
+//   HEAD    /tus/<id>  查询已上传的偏移(Upload-Offset)
+//   PATCH   /tus/<id>  从Upload-Offset处追加数据，Content-Type须为application/offset+octet-stream
+//   DELETE  /tus/<id>  放弃上传
+// Upload-Metadata中可以带bucket、key、md5及storage_class(均为base64编码)
+// 已上传的数据及上传信息保存在TmpDir/tus中，连接断开或apiserv重启后从已写入的偏移继续，
+// 数据全部到达后交给storeFile切片并上传，与/file的PUT相同
+// 同一个上传的所有请求须发给同一个apiserv
+
+const (
+	TUS_PATH         = "/tus/"
+	TUS_DIR          = "tus" // 断点续传的临时目录(存放于TmpDir)
+	TUS_VERSION      = "1.0.0"
+	TUS_EXTENSION    = "creation,creation-with-upload,termination,expiration"
+	TUS_CONTENT_TYPE = "application/offset+octet-stream"
+
+	H_TUS_RESUMABLE   = "Tus-Resumable"
+	H_TUS_VERSION     = "Tus-Version"
+	H_TUS_EXTENSION   = "Tus-Extension"
+	H_TUS_MAX_SIZE    = "Tus-Max-Size"
+	H_UPLOAD_OFFSET   = "Upload-Offset"
+	H_UPLOAD_LENGTH   = "Upload-Length"
+	H_UPLOAD_METADATA = "Upload-Metadata"
+	H_UPLOAD_EXPIRES  = "Upload-Expires"
+	H_OBJ_MD5         = "X-Obj-Md5" // 上传完成时返回文件的md5
+)
+
+var (
+	TusTTL           = 24 * time.Hour // 上传在最后一次写入后保留的时间
+	TusMaxSize int64 = 1 << 40        // 文件的最大大小
+	tusID            = regexp.MustCompile(`^[0-9A-Za-z]{16}$`)
+	tusLocks         = map[string]struct{}{} // 正在写入的上传
+	tusMU            = &sync.Mutex{}         // 保护tusLocks
+)
+
+var (
+	ErrTusNotFound = errors.New("不存在该上传")
+	ErrTusVersion  = errors.New("不支持的tus版本")
+	ErrTusLength   = errors.New("Upload-Length有误")
+	ErrTusOffset   = errors.New("Upload-Offset与已上传的偏移不一致")
+	ErrTusLocked   = errors.New("该上传正在写入")
+	ErrTusType     = errors.New("Content-Type须为" + TUS_CONTENT_TYPE)
+)
+
+// 断点续传的上传，信息保存在TmpDir/tus/<id>.json，数据保存在TmpDir/tus/<id>
+type TusUpload struct {
+	ID       string `json:"id"`
+	Length   int64  `json:"length"`
+	Metadata string `json:"metadata,omitempty"` // 原始的Upload-Metadata，HEAD时返回
+	Bucket   string `json:"bucket,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Md5      string `json:"md5,omitempty"`
+	Class    string `json:"class,omitempty"`
+	User     string `json:"user,omitempty"` // 创建者，只有创建者和管理员可以操作
+	Create   int64  `json:"create"`
+}
+
+func (t *TusUpload) dataPath() string {
+	return filepath.Join(TmpDir, TUS_DIR, t.ID)
+}
+
+func (t *TusUpload) infoPath() string {
+	return filepath.Join(TmpDir, TUS_DIR, t.ID+".json")
+}
+
+// 已上传的偏移，即已写入的数据大小
+func (t *TusUpload) offset() int64 {
+	info, err := os.Stat(t.dataPath())
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// 过期时间，从最后一次写入开始计算
+func (t *TusUpload) expires() time.Time {
+	info, err := os.Stat(t.dataPath())
+	if err != nil {
+		return time.Unix(0, t.Create).Add(TusTTL)
+	}
+	return info.ModTime().Add(TusTTL)
+}
+
+// 保存上传信息，先写临时文件再改名
+func (t *TusUpload) save() error {
+	var (
+		tmp  = t.infoPath() + ".tmp"
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(t); err != nil {
+		return err
+	}
+	tools.DirExist(filepath.Dir(tmp))
+	if err = ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.infoPath())
+}
+
+func (t *TusUpload) remove() {
+	os.Remove(t.infoPath())
+	os.Remove(t.dataPath())
+}
+
+func getTus(id string) *TusUpload {
+	var t = new(TusUpload)
+	if !tusID.MatchString(id) {
+		return nil
+	}
+	body, err := ioutil.ReadFile(filepath.Join(TmpDir, TUS_DIR, id+".json"))
+	if err != nil || json.Unmarshal(body, t) != nil {
+		return nil
+	}
+	return t
+}
+
+// 加写入锁，同一个上传同时只能有一个请求写入
+func lockTus(id string) bool {
+	tusMU.Lock()
+	defer tusMU.Unlock()
+	if _, ok := tusLocks[id]; ok {
+		return false
+	}
+	tusLocks[id] = struct{}{}
+	return true
+}
+
+func unlockTus(id string) {
+	tusMU.Lock()
+	delete(tusLocks, id)
+	tusMU.Unlock()
+}
+
+// 解析Upload-Metadata: 逗号分隔的"key base64(value)"
+func parseTusMetadata(s string) (map[string]string, error) {
+	var meta = map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		if len(kv) > 2 {
+			return nil, Err400
+		}
+		meta[kv[0]] = ""
+		if len(kv) == 2 {
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, Err400
+			}
+			meta[kv[0]] = string(v)
+		}
+	}
+	return meta, nil
+}
+
+func tusError(resp http.ResponseWriter, status int, err error) {
+	resp.WriteHeader(status)
+	resp.Write([]byte(err.Error()))
+}
+
+// 处理断点续传请求，OPTIONS不需要鉴权，其余请求同其他接口
+func handlerTus(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set(H_TUS_RESUMABLE, TUS_VERSION)
+	if m := req.Header.Get("X-HTTP-Method-Override"); len(m) != 0 { // 不支持PATCH/DELETE的客户端
+		req.Method = strings.ToUpper(m)
+	}
+	if req.Method == "OPTIONS" {
+		resp.Header().Set(H_TUS_VERSION, TUS_VERSION)
+		resp.Header().Set(H_TUS_EXTENSION, TUS_EXTENSION)
+		resp.Header().Set(H_TUS_MAX_SIZE, strconv.FormatInt(TusMaxSize, 10))
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Header.Get(H_TUS_RESUMABLE) != TUS_VERSION {
+		resp.Header().Set(H_TUS_VERSION, TUS_VERSION)
+		tusError(resp, http.StatusPreconditionFailed, ErrTusVersion)
+		return
+	}
+	authenticate(serveTus)(resp, req)
+}
+
+func serveTus(resp http.ResponseWriter, req *http.Request) {
+	var (
+		id = strings.TrimPrefix(req.URL.Path, TUS_PATH)
+		t  *TusUpload
+	)
+	if len(id) == 0 {
+		if req.Method != "POST" {
+			tusError(resp, http.StatusMethodNotAllowed, Err405)
+			return
+		}
+		createTus(resp, req)
+		return
+	}
+	if t = getTus(id); t == nil {
+		tusError(resp, http.StatusNotFound, ErrTusNotFound)
+		return
+	}
+	if user := reqUser(req); !isAdmin(user) && user.Name != t.User {
+		tusError(resp, http.StatusForbidden, Err403)
+		return
+	}
+	switch req.Method {
+	case "HEAD":
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.Header().Set(H_UPLOAD_OFFSET, strconv.FormatInt(t.offset(), 10))
+		resp.Header().Set(H_UPLOAD_LENGTH, strconv.FormatInt(t.Length, 10))
+		if len(t.Metadata) != 0 {
+			resp.Header().Set(H_UPLOAD_METADATA, t.Metadata)
+		}
+		resp.WriteHeader(http.StatusOK)
+	case "PATCH":
+		t.patch(resp, req, http.StatusNoContent)
+	case "DELETE":
+		if !lockTus(t.ID) {
+			tusError(resp, http.StatusLocked, ErrTusLocked)
+			return
+		}
+		t.remove()
+		unlockTus(t.ID)
+		log.Println("放弃断点续传: ", t.ID)
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		tusError(resp, http.StatusMethodNotAllowed, Err405)
+	}
+}
+
+// 创建上传，带数据时(creation-with-upload)同时写入
+func createTus(resp http.ResponseWriter, req *http.Request) {
+	var (
+		t = &TusUpload{
+			ID:       tools.RandomString(16),
+			Metadata: req.Header.Get(H_UPLOAD_METADATA),
+			Create:   time.Now().UnixNano(),
+		}
+		meta map[string]string
+		err  error
+	)
+	if t.Length, err = strconv.ParseInt(req.Header.Get(H_UPLOAD_LENGTH), 10, 64); err != nil || t.Length <= 0 {
+		tusError(resp, http.StatusBadRequest, ErrTusLength)
+		return
+	}
+	if t.Length > TusMaxSize {
+		tusError(resp, http.StatusRequestEntityTooLarge, ErrTusLength)
+		return
+	}
+	if meta, err = parseTusMetadata(t.Metadata); err != nil {
+		tusError(resp, http.StatusBadRequest, err)
+		return
+	}
+	t.Bucket, t.Key, t.Md5, t.Class = meta[P_BUCKET], meta[P_KEY], strings.ToLower(meta[P_MD5]), meta["storage_class"]
+	if len(t.Key) != 0 && !bucketAllowed(req, t.Bucket, true) {
+		tusError(resp, http.StatusForbidden, Err403)
+		return
+	}
+	if len(t.Key) != 0 && !validBucket(t.Bucket) {
+		tusError(resp, http.StatusBadRequest, ErrBucketName)
+		return
+	}
+	if len(t.Md5) != 0 && len(t.Md5) != 32 {
+		tusError(resp, http.StatusBadRequest, ErrMD5)
+		return
+	}
+	if _, err = getClass(t.Class); err != nil {
+		tusError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if user := reqUser(req); user != nil {
+		t.User = user.Name
+	}
+	if err = t.save(); err == nil {
+		err = ioutil.WriteFile(t.dataPath(), nil, 0644)
+	}
+	if err != nil {
+		log.Println("创建断点续传出错: ", err.Error())
+		t.remove()
+		tusError(resp, http.StatusInternalServerError, ErrServer500)
+		return
+	}
+	log.Printf("创建断点续传: %s %d %s/%s\n", t.ID, t.Length, t.Bucket, t.Key)
+	resp.Header().Set("Location", TUS_PATH+t.ID)
+	if req.Header.Get("Content-Type") == TUS_CONTENT_TYPE {
+		req.Header.Set(H_UPLOAD_OFFSET, "0")
+		t.patch(resp, req, http.StatusCreated)
+		return
+	}
+	resp.Header().Set(H_UPLOAD_EXPIRES, t.expires().UTC().Format(http.TimeFormat))
+	resp.WriteHeader(http.StatusCreated)
+}
+
+// 从Upload-Offset处追加请求体，连接断开时已写入的数据保留，数据全部到达后上传文件
+// status为成功时的状态码
+func (t *TusUpload) patch(resp http.ResponseWriter, req *http.Request, status int) {
+	var (
+		off int64
+		n   int64
+		f   *os.File
+		err error
+	)
+	if req.Header.Get("Content-Type") != TUS_CONTENT_TYPE {
+		tusError(resp, http.StatusUnsupportedMediaType, ErrTusType)
+		return
+	}
+	if off, err = strconv.ParseInt(req.Header.Get(H_UPLOAD_OFFSET), 10, 64); err != nil {
+		tusError(resp, http.StatusBadRequest, ErrTusOffset)
+		return
+	}
+	if !lockTus(t.ID) {
+		tusError(resp, http.StatusLocked, ErrTusLocked)
+		return
+	}
+	defer unlockTus(t.ID)
+	if off != t.offset() {
+		tusError(resp, http.StatusConflict, ErrTusOffset)
+		return
+	}
+	if off < t.Length {
+		if f, err = os.OpenFile(t.dataPath(), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			tusError(resp, http.StatusNotFound, ErrTusNotFound) // 已过期被清理
+			return
+		}
+		n, err = io.Copy(f, io.LimitReader(req.Body, t.Length-off))
+		f.Close()
+		off += n
+		if err != nil {
+			log.Printf("断点续传写入中断: %s %d/%d %s\n", t.ID, off, t.Length, err.Error())
+			tusError(resp, http.StatusInternalServerError, ErrUpload)
+			return
+		}
+	}
+	resp.Header().Set(H_UPLOAD_OFFSET, strconv.FormatInt(off, 10))
+	if off < t.Length {
+		resp.Header().Set(H_UPLOAD_EXPIRES, t.expires().UTC().Format(http.TimeFormat))
+		resp.WriteHeader(status)
+		return
+	}
+	t.finish(resp, req, status)
+}
+
+// 数据全部到达，交给storeFile切片并上传，成功后删除该上传
+// 失败时(如该文件正在上传)保留数据，可以在Upload-Offset等于Upload-Length时再次PATCH重试
+func (t *TusUpload) finish(resp http.ResponseWriter, req *http.Request, status int) {
+	var (
+		o    = &ObjFile{Md5: t.Md5, user: t.User, keyed: len(t.Key) != 0}
+		sync = strings.ToLower(req.Header.Get(H_UPLOAD_MODE)) == "sync"
+		f    *os.File
+		err  error
+	)
+	if err = o.setClass(t.Class); err != nil {
+		tusError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if f, err = os.Open(t.dataPath()); err != nil {
+		tusError(resp, http.StatusNotFound, ErrTusNotFound)
+		return
+	}
+	err = o.storeFile(f, sync)
+	f.Close()
+	switch err {
+	case nil, ErrExist:
+	case ErrMD5: // 数据与md5不一致，不能重试
+		t.remove()
+		tusError(resp, http.StatusBadRequest, err)
+		return
+	case ErrRunning:
+		tusError(resp, http.StatusConflict, err)
+		return
+	default:
+		tusError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	t.remove()
+	log.Printf("断点续传完成: %s -> %s\n", t.ID, o.Md5)
+	if len(t.Key) != 0 {
+		if err = bindFileKey(o, t.Bucket, t.Key); err != nil {
+			tusError(resp, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	resp.Header().Set(H_OBJ_MD5, o.Md5)
+	if o.job != nil {
+		resp.Header().Set(H_JOB_ID, o.job.ID)
+	}
+	resp.WriteHeader(status)
+}
+
+// 定期清理过期的上传
+func cleanTus() {
+	var dir = filepath.Join(TmpDir, TUS_DIR)
+	for {
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			id := strings.TrimSuffix(info.Name(), ".json")
+			if !lockTus(id) {
+				continue
+			}
+			switch t := getTus(id); {
+			case t != nil && time.Now().After(t.expires()):
+				log.Println("断点续传已过期: ", id)
+				t.remove()
+			case t == nil && time.Since(info.ModTime()) > TusTTL: // 没有上传信息的数据或临时文件
+				os.Remove(filepath.Join(dir, info.Name()))
+			}
+			unlockTus(id)
+		}
+		time.Sleep(JobCleanInterval)
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tools "../tools"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 用户及鉴权: 用户和API key保存在元数据存储中
+//   ①用户名+密码: Basic Auth，或POST表单中的user/passwd(不接受query中的密码)，密码以PBKDF2-SHA256加盐hash保存
+//   ②API key签名: Authorization: OBJ-HMAC-SHA256 Credential=<access key>, Signature=<hex>
+//     签名内容为 method\npath\n排序后的query\nX-Obj-Date\nX-Obj-Content-SHA256，签名算法为HMAC-SHA256(secret)
+//     只有query中的参数参与签名，表单(包括multipart表单)中只能出现与query相同的参数；API key同时可用于S3接口
+//     X-Obj-Content-SHA256为请求体的sha256(hex)，读完请求体时校验；带md5参数时可以为UNSIGNED-PAYLOAD，由md5校验请求体
+// 未设置admin_user时不做鉴权，与旧版本行为一致；设置后启动时自动创建该管理员
+// API key的secret需要用于校验签名，不能只保存hash，以apikey_encrypt_key做AES-256-GCM加密后保存
+
+const (
+	ES_TYPE_KEY = "apikey" // API key类型，id为access key
+
+	AUTH_ALGORITHM = "OBJ-HMAC-SHA256"
+	H_AUTH_DATE    = "X-Obj-Date"           // 签名时间，格式同S3_DATE_FORMAT
+	H_AUTH_SHA256  = "X-Obj-Content-SHA256" // 请求体的sha256，参与签名
+	P_ADMIN        = "admin"                // 为1时创建管理员
+	P_ACCESS_KEY   = "access_key"
+
+	PASS_ALGORITHM = "pbkdf2-sha256"
+	PASS_ITER      = 600000 // PBKDF2迭代次数，旧版本的hash按其中记录的次数校验，登录成功时重新hash
+	PASS_SALT      = 16
+	PASS_KEYLEN    = 32
+
+	SECRET_ALGORITHM = "aes-256-gcm" // API key的secret的加密算法
+)
+
+type ctxKey int
+
+const CTX_USER ctxKey = 0 // 请求context中保存当前用户
+
+var (
+	AdminUser     = "" // 管理员用户名，为空时不做鉴权
+	AdminPassword = "" // 管理员初始密码，只在创建时使用
+	KeyEncryptKey = "" // 加密API key的secret的密钥，为空时不能创建API key
+	userName      = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,64}$`)
+)
+
+var (
+	ErrAuthRequired = errors.New("需要登录")
+	ErrPassword     = errors.New("用户名或密码错误")
+	ErrSignature    = errors.New("签名有误")
+	ErrBodyHash     = errors.New("请求体与X-Obj-Content-SHA256不一致")
+	ErrAccessKey    = errors.New("无效的access key")
+	ErrTimeSkewed   = errors.New("请求时间偏差过大")
+	ErrUserName     = errors.New("无效用户名")
+	ErrUserNotFound = errors.New("不存在该用户")
+	ErrKeyEncrypt   = errors.New("未设置apikey_encrypt_key, 不能创建API key")
+	ErrKeyCorrupt   = errors.New("API key的secret格式有误")
+)
+
+// 用户文档，id为用户名
+type User struct {
+	Name   string `json:"name"`
+	Pass   string `json:"pass,omitempty"` // 密码hash: pbkdf2-sha256$迭代次数$salt$hash
+	Admin  bool   `json:"admin"`
+	Create int64  `json:"create"`
+}
+
+// API key文档，元数据中只保存加密后的secret
+type APIKey struct {
+	AccessKey string `json:"access_key"`
+	Secret    string `json:"secret,omitempty"`     // 明文，只在创建时返回；旧版本的文档中以明文保存
+	SecretEnc string `json:"secret_enc,omitempty"` // 加密的secret: aes-256-gcm$nonce$密文
+	User      string `json:"user"`
+	Create    int64  `json:"create"`
+}
+
+// 是否启用鉴权
+func AuthEnabled() bool {
+	return len(AdminUser) != 0
+}
+
+// 启动时创建管理员，已存在时不修改
+func initAdmin() {
+	if !AuthEnabled() {
+		log.Println("未设置admin_user, 接口不做鉴权")
+		return
+	}
+	if MetaStore.IsExists(ES_TYPE_USER, AdminUser) {
+		return
+	}
+	if len(AdminPassword) == 0 {
+		log.Fatalln("首次启用鉴权时须设置admin_password")
+	}
+	if err := saveUser(AdminUser, AdminPassword, true); err != nil {
+		log.Fatalln("创建管理员出错: ", err)
+	}
+	log.Println("创建管理员: ", AdminUser)
+}
+
+// 启动时加密旧版本以明文保存的API key
+func initKeys() {
+	var plain []APIKey
+	MetaStore.Scan(ES_TYPE_KEY, "", func(id string, doc []byte) bool {
+		var k APIKey
+		if json.Unmarshal(doc, &k) == nil && len(k.Secret) != 0 {
+			plain = append(plain, k)
+		}
+		return true
+	})
+	if len(plain) == 0 {
+		return
+	}
+	if len(KeyEncryptKey) == 0 {
+		log.Printf("有%d个API key以明文保存, 设置apikey_encrypt_key后启动时自动加密\n", len(plain))
+		return
+	}
+	for _, k := range plain {
+		if err := saveKey(&k); err != nil {
+			log.Fatalln("加密API key出错: ", k.AccessKey, err)
+		}
+		log.Println("加密API key: ", k.User, k.AccessKey)
+	}
+}
+
+// 获取用户，不存在时返回nil
+func getUser(name string) *User {
+	var (
+		u    = new(User)
+		body []byte
+		err  error
+	)
+	if body, err = MetaStore.Get(ES_TYPE_USER, name); err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, u); err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return u
+}
+
+// 新建或修改用户
+func saveUser(name, pass string, admin bool) error {
+	var u = getUser(name)
+	if !userName.MatchString(name) {
+		return ErrUserName
+	}
+	if u == nil {
+		u = &User{Name: name, Create: time.Now().UnixNano()}
+	}
+	u.Pass = hashPassword(pass)
+	u.Admin = admin
+	if _, err := MetaStore.Add(ES_TYPE_USER, name, u); err != nil {
+		log.Println("保存用户出错: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+// 删除用户及其所有API key
+func deleteUser(name string) error {
+	if !MetaStore.IsExists(ES_TYPE_USER, name) {
+		return ErrUserNotFound
+	}
+	for _, k := range listKeys(name) {
+		MetaStore.Delete(ES_TYPE_KEY, k.AccessKey)
+	}
+	if _, err := MetaStore.Delete(ES_TYPE_USER, name); err != nil {
+		log.Println("删除用户出错: ", err.Error())
+		return err
+	}
+	log.Println("删除用户: ", name)
+	return nil
+}
+
+func hashPassword(pass string) string {
+	var salt = randBytes(PASS_SALT)
+	return strings.Join([]string{
+		PASS_ALGORITHM,
+		strconv.Itoa(PASS_ITER),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(pbkdf2.Key([]byte(pass), salt, PASS_ITER, PASS_KEYLEN, sha256.New)),
+	}, "$")
+}
+
+func (u *User) checkPassword(pass string) bool {
+	var parts = strings.Split(u.Pass, "$")
+	if len(parts) != 4 || parts[0] != PASS_ALGORITHM {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(pbkdf2.Key([]byte(pass), salt, iter, len(hash), sha256.New), hash)
+}
+
+// 密码hash的迭代次数少于PASS_ITER(旧版本创建)时，用已校验的密码重新hash
+func (u *User) rehashPassword(pass string) {
+	var parts = strings.Split(u.Pass, "$")
+	if len(parts) != 4 {
+		return
+	}
+	if iter, err := strconv.Atoi(parts[1]); err != nil || iter >= PASS_ITER {
+		return
+	}
+	u.Pass = hashPassword(pass)
+	if _, err := MetaStore.UpdateField(ES_TYPE_USER, u.Name, "pass", u.Pass); err != nil {
+		log.Println("更新密码hash出错: ", u.Name, err.Error())
+	}
+}
+
+func randBytes(n int) []byte {
+	var b = make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("读取随机数出错: ", err)
+	}
+	return b
+}
+
+// 为用户新建API key，返回的secret只在创建时可见
+func createKey(user string) (*APIKey, error) {
+	var k = &APIKey{
+		AccessKey: strings.ToUpper(hex.EncodeToString(randBytes(10))),
+		Secret:    base64.RawURLEncoding.EncodeToString(randBytes(30)),
+		User:      user,
+		Create:    time.Now().UnixNano(),
+	}
+	if err := saveKey(k); err != nil {
+		log.Println("创建API key出错: ", err.Error())
+		return nil, err
+	}
+	log.Println("创建API key: ", user, k.AccessKey)
+	return &APIKey{AccessKey: k.AccessKey, Secret: k.Secret, User: k.User, Create: k.Create}, nil
+}
+
+// 加密secret后保存API key，k.Secret为明文
+func saveKey(k *APIKey) error {
+	var (
+		doc = *k
+		err error
+	)
+	if doc.SecretEnc, err = encryptSecret(k.Secret); err != nil {
+		return err
+	}
+	doc.Secret = ""
+	_, err = MetaStore.Add(ES_TYPE_KEY, doc.AccessKey, &doc)
+	return err
+}
+
+// 获取API key并解密secret，不存在或不能解密时返回nil
+func getKey(accessKey string) *APIKey {
+	var (
+		k    = new(APIKey)
+		body []byte
+	)
+	if len(accessKey) == 0 {
+		return nil
+	}
+	body, err := MetaStore.Get(ES_TYPE_KEY, accessKey)
+	if err != nil || json.Unmarshal(body, k) != nil {
+		return nil
+	}
+	if len(k.SecretEnc) != 0 {
+		if k.Secret, err = decryptSecret(k.SecretEnc); err != nil {
+			log.Println("解密API key出错: ", accessKey, err.Error())
+			return nil
+		}
+	}
+	return k
+}
+
+// 用户的所有API key，不含secret
+func listKeys(user string) []APIKey {
+	var keys []APIKey
+	MetaStore.Scan(ES_TYPE_KEY, "", func(id string, doc []byte) bool {
+		var k APIKey
+		if json.Unmarshal(doc, &k) == nil && k.User == user {
+			k.Secret, k.SecretEnc = "", ""
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+// 由apikey_encrypt_key得到AES-256-GCM
+func secretCipher() (cipher.AEAD, error) {
+	if len(KeyEncryptKey) == 0 {
+		return nil, ErrKeyEncrypt
+	}
+	key := sha256.Sum256([]byte(KeyEncryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密secret: aes-256-gcm$nonce$密文，access key不参与
+func encryptSecret(secret string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := randBytes(gcm.NonceSize())
+	return strings.Join([]string{
+		SECRET_ALGORITHM,
+		base64.RawStdEncoding.EncodeToString(nonce),
+		base64.RawStdEncoding.EncodeToString(gcm.Seal(nil, nonce, []byte(secret), nil)),
+	}, "$"), nil
+}
+
+func decryptSecret(enc string) (string, error) {
+	var (
+		fields = strings.Split(enc, "$")
+		nonce  []byte
+		sealed []byte
+		plain  []byte
+	)
+	if len(fields) != 3 || fields[0] != SECRET_ALGORITHM {
+		return "", ErrKeyCorrupt
+	}
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	if nonce, err = base64.RawStdEncoding.DecodeString(fields[1]); err != nil || len(nonce) != gcm.NonceSize() {
+		return "", ErrKeyCorrupt
+	}
+	if sealed, err = base64.RawStdEncoding.DecodeString(fields[2]); err != nil {
+		return "", err
+	}
+	if plain, err = gcm.Open(nil, nonce, sealed, nil); err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// 当前请求的用户，未启用鉴权时为nil
+func reqUser(req *http.Request) *User {
+	u, _ := req.Context().Value(CTX_USER).(*User)
+	return u
+}
+
+func withUser(req *http.Request, u *User) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), CTX_USER, u))
+}
+
+// 是否有管理员权限，未启用鉴权时视为管理员
+func isAdmin(u *User) bool {
+	return u == nil || u.Admin
+}
+
+// 鉴权中间件，失败时返回401
+// 预签名URL(见presign.go)不论是否启用鉴权都要校验签名和有效期
+func authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if isPresigned(req) {
+			u, err := verifyPresign(req)
+			if err != nil {
+				log.Printf("预签名URL校验失败: %s %s %s\n", req.Method, req.URL.Path, err.Error())
+				resp.Write(tools.Json2Byte(401, err.Error()))
+				return
+			}
+			h(resp, withUser(req, u))
+			return
+		}
+		if !AuthEnabled() {
+			h(resp, req)
+			return
+		}
+		u, err := authUser(req)
+		if err != nil {
+			log.Printf("鉴权失败: %s %s %s\n", req.Method, req.URL.Path, err.Error())
+			resp.Write(tools.Json2Byte(401, err.Error()))
+			return
+		}
+		h(resp, withUser(req, u))
+	}
+}
+
+// 根据签名、Basic Auth或POST表单中的user/passwd获取用户，query中的密码会进入访问日志，不接受
+func authUser(req *http.Request) (*User, error) {
+	var (
+		auth = req.Header.Get("Authorization")
+		u    *User
+	)
+	if strings.HasPrefix(auth, AUTH_ALGORITHM+" ") {
+		return verifySignature(req, strings.TrimPrefix(auth, AUTH_ALGORITHM+" "))
+	}
+	name, pass, ok := req.BasicAuth()
+	if !ok && req.Method == "POST" {
+		name, pass = req.PostFormValue(P_USER), req.PostFormValue(P_PASS)
+	}
+	if len(name) == 0 {
+		return nil, ErrAuthRequired
+	}
+	if u = getUser(name); u == nil || !u.checkPassword(pass) {
+		return nil, ErrPassword
+	}
+	u.rehashPassword(pass)
+	return u, nil
+}
+
+// 校验API key签名
+func verifySignature(req *http.Request, auth string) (*User, error) {
+	var (
+		accessKey, signature string
+		date                 = req.Header.Get(H_AUTH_DATE)
+		k                    *APIKey
+		u                    *User
+	)
+	for _, kv := range strings.Split(auth, ",") {
+		kv = strings.TrimSpace(kv)
+		switch {
+		case strings.HasPrefix(kv, "Credential="):
+			accessKey = strings.TrimPrefix(kv, "Credential=")
+		case strings.HasPrefix(kv, "Signature="):
+			signature = strings.TrimPrefix(kv, "Signature=")
+		}
+	}
+	if k = getKey(accessKey); k == nil {
+		return nil, ErrAccessKey
+	}
+	t, err := time.Parse(S3_DATE_FORMAT, date)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	if d := time.Since(t); d > S3MaxSkew || d < -S3MaxSkew {
+		return nil, ErrTimeSkewed
+	}
+	if !hmac.Equal([]byte(signRequest(req, date, k.Secret)), []byte(signature)) {
+		return nil, ErrSignature
+	}
+	// 请求体: 读完时与已签名的sha256对比，或由已签名的md5参数校验(上传时storeFile校验md5)
+	switch payload := req.Header.Get(H_AUTH_SHA256); {
+	case payload == S3_UNSIGNED && len(req.URL.Query().Get(P_MD5)) == 32:
+	case len(payload) == 64:
+		req.Body = shaBody{&s3ShaReader{r: req.Body, h: sha256.New(), sum: strings.ToLower(payload), err: ErrBodyHash}, req.Body}
+	default:
+		return nil, ErrSignature
+	}
+	if !formSigned(req, req.URL.Query(), "") {
+		return nil, ErrSignature
+	}
+	if u = getUser(k.User); u == nil {
+		return nil, ErrAccessKey
+	}
+	return u, nil
+}
+
+// 表单(包括multipart表单)中的参数是否都与已签名的query相同，以免在请求体中修改bucket/key/md5等
+// skip为不参与比较的参数名
+func formSigned(req *http.Request, q url.Values, skip string) bool {
+	req.FormValue(P_MD5)
+	for k, vs := range req.Form {
+		if k != skip && strings.Join(vs, "\n") != strings.Join(q[k], "\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// 校验sha256的请求体，Close时关闭原请求体
+type shaBody struct {
+	io.Reader
+	io.Closer
+}
+
+// 计算请求签名(hex)
+func signRequest(req *http.Request, date, secret string) string {
+	var m = hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strings.Join([]string{
+		req.Method,
+		req.URL.Path,
+		s3CanonicalQuery(req),
+		date,
+		req.Header.Get(H_AUTH_SHA256),
+	}, "\n")))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// 用户管理
+//
+//	GET    /users                   管理员列出所有用户，其他用户返回自己
+//	PUT    /users?user=&passwd=     管理员新建或修改用户(admin=1为管理员)，其他用户只能修改自己的密码
+//	DELETE /users?user=             管理员删除用户及其API key
+func handlerUsers(resp http.ResponseWriter, req *http.Request) {
+	var (
+		u    = reqUser(req)
+		name = req.FormValue(P_USER)
+		err  error
+	)
+	if !AuthEnabled() {
+		resp.Write(tools.Json2Byte(403, "未启用鉴权"))
+		return
+	}
+	switch req.Method {
+	case "GET":
+		var users []User
+		MetaStore.Scan(ES_TYPE_USER, "", func(id string, doc []byte) bool {
+			var one User
+			if json.Unmarshal(doc, &one) == nil && (u.Admin || one.Name == u.Name) {
+				one.Pass = ""
+				users = append(users, one)
+			}
+			return true
+		})
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+		resp.Write(tools.Json2ByteObj(200, users))
+	case "PUT":
+		admin := req.FormValue(P_ADMIN) == "1"
+		if _, ok := req.Form[P_ADMIN]; !ok { // 未带admin参数时保持原有权限
+			if old := getUser(name); old != nil {
+				admin = old.Admin
+			}
+		}
+		if !u.Admin {
+			if name != u.Name {
+				resp.Write(tools.Json2Byte(403, Err403.Error()))
+				return
+			}
+			admin = false
+		}
+		if len(req.FormValue(P_PASS)) == 0 {
+			resp.Write(tools.Json2Byte(400, "密码不能为空"))
+			return
+		}
+		if err = saveUser(name, req.FormValue(P_PASS), admin); err == ErrUserName {
+			resp.Write(tools.Json2Byte(400, err.Error()))
+			return
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+			return
+		}
+		log.Println("保存用户: ", name)
+		resp.Write(tools.Json2Byte(200, "成功保存用户: "+name))
+	case "DELETE":
+		if !u.Admin || name == AdminUser {
+			resp.Write(tools.Json2Byte(403, Err403.Error()))
+			return
+		}
+		if err = deleteUser(name); err == ErrUserNotFound {
+			resp.Write(tools.Json2Byte(404, err.Error()))
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+		} else {
+			resp.Write(tools.Json2Byte(200, "成功删除用户: "+name))
+		}
+	default:
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+	}
+}
+
+// API key管理，管理员可以通过user参数管理其他用户的key
+//
+//	GET    /users/keys                列出API key(不含secret)
+//	POST   /users/keys                新建API key，secret只在此时返回
+//	DELETE /users/keys?access_key=    删除API key
+func handlerKeys(resp http.ResponseWriter, req *http.Request) {
+	var (
+		u    = reqUser(req)
+		name = req.FormValue(P_USER)
+	)
+	if !AuthEnabled() {
+		resp.Write(tools.Json2Byte(403, "未启用鉴权"))
+		return
+	}
+	if len(name) == 0 {
+		name = u.Name
+	}
+	if name != u.Name && !u.Admin {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	switch req.Method {
+	case "GET":
+		resp.Write(tools.Json2ByteObj(200, listKeys(name)))
+	case "POST":
+		if !MetaStore.IsExists(ES_TYPE_USER, name) {
+			resp.Write(tools.Json2Byte(404, ErrUserNotFound.Error()))
+			return
+		}
+		k, err := createKey(name)
+		if err == ErrKeyEncrypt {
+			resp.Write(tools.Json2Byte(403, err.Error()))
+			return
+		} else if err != nil {
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+			return
+		}
+		resp.Write(tools.Json2ByteObj(200, k))
+	case "DELETE":
+		k := getKey(req.FormValue(P_ACCESS_KEY))
+		if k == nil || (k.User != u.Name && !u.Admin) {
+			resp.Write(tools.Json2Byte(404, ErrAccessKey.Error()))
+			return
+		}
+		if _, err := MetaStore.Delete(ES_TYPE_KEY, k.AccessKey); err != nil {
+			log.Println("删除API key出错: ", err.Error())
+			resp.Write(tools.Json2Byte(500, ErrServer500.Error()))
+			return
+		}
+		log.Println("删除API key: ", k.User, k.AccessKey)
+		resp.Write(tools.Json2Byte(200, "成功删除API key: "+k.AccessKey))
+	default:
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	tools "../tools"
+)
+
+// data服务的配置，共用部分见tools.Config
+// 默认值为各个包变量的初始值，加载后再写回包变量；可重新加载的配置只发布到liveConf(见live)
+
+type Config struct {
+	tools.Config  `yaml:",inline"`
+	Zone          string        `yaml:"zone" env:"ZONE" usage:"可用区标签"`
+	Rack          string        `yaml:"rack" env:"RACK" usage:"机架标签"`
+	ScrubRate     int64         `yaml:"scrub_rate" env:"SCRUB_RATE" reload:"true" usage:"巡检时每秒最多读取的字节数"`
+	ScrubInterval time.Duration `yaml:"scrub_interval" env:"SCRUB_INTERVAL" usage:"两次巡检的间隔，为0时不巡检"`
+	Insecure      bool          `yaml:"insecure" env:"INSECURE" usage:"允许在未设置cluster_secret和tls_ca时启动，此时不校验api的请求，只用于测试"`
+}
+
+var (
+	ErrInsecure = errors.New("未设置cluster_secret或tls_ca(mTLS)时任何人都可以读写和删除切片，须设置其中之一，测试时可以设置insecure")
+)
+
+var (
+	Loader   *tools.ConfigLoader // 重新加载时使用
+	Conf     *Config             // 当前生效的配置
+	liveConf atomic.Value        // *liveConfig，可重新加载的配置
+)
+
+// 可重新加载的配置，重新加载时整体替换为新的快照，不修改已发布的快照
+// 请求中通过live()读取，同一次处理中应只读取一次
+type liveConfig struct {
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	TokenTimeout    time.Duration
+	ClusterSecret   string // 校验下载切片token的密钥(见tools/token.go)
+	RandomSecret    bool   // ClusterSecret为本进程随机生成的密钥
+	ScrubRate       int64
+}
+
+// 当前生效的可重新加载配置，加载配置前为默认值
+func live() *liveConfig {
+	if c, ok := liveConf.Load().(*liveConfig); ok {
+		return c
+	}
+	return &liveConfig{
+		ReadTimeout:     ReadTimeout,
+		WriteTimeout:    WriteTimeout,
+		ShutdownTimeout: ShutdownTimeout,
+		TokenTimeout:    TokenTimeOut,
+		ScrubRate:       ScrubRate,
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Config: tools.Config{
+			ListenAddr:      ListenAddr,
+			BaseDir:         BaseDir,
+			ElasticURL:      ELASTIC_URL,
+			ESIndex:         ES_INDEX,
+			MetaBackend:     MetaBackend,
+			NSQAddr:         NSQ_ADDR,
+			Membership:      MemberBackend,
+			HBInterval:      HBSendInterval,
+			HBTimeout:       time.Duration(VaildTime),
+			ReadTimeout:     ReadTimeout,
+			WriteTimeout:    WriteTimeout,
+			ShutdownTimeout: ShutdownTimeout,
+			LogLevel:        tools.LOG_INFO,
+			TokenTimeout:    TokenTimeOut,
+		},
+		ScrubRate:     ScrubRate,
+		ScrubInterval: ScrubInterval,
+	}
+}
+
+// 校验配置，并填充依赖其他配置的默认值
+func (c *Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.ScrubRate <= 0 {
+		return errors.New("scrub_rate必须大于0")
+	}
+	if c.ScrubInterval < 0 {
+		return errors.New("scrub_interval不能小于0")
+	}
+	if len(c.ClusterSecret) == 0 && len(c.TLSCA) == 0 && !c.Insecure {
+		return ErrInsecure
+	}
+	c.fill()
+	return nil
+}
+
+// 填充依赖其他配置的默认值
+func (c *Config) fill() {
+	if len(c.TmpDir) == 0 {
+		c.TmpDir = filepath.Join(c.BaseDir, "tmp")
+	}
+	if len(c.MemberAddr) == 0 {
+		c.MemberAddr = c.ListenAddr
+	}
+}
+
+// 解析命令行参数并加载配置，失败时退出
+func loadConfig() {
+	var (
+		conf = new(Config)
+		err  error
+	)
+	if Loader, err = tools.NewConfigLoader("dataserv", defaultConfig(), os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatalln("解析命令行参数出错: ", err)
+	}
+	if err = Loader.Load(conf); err != nil {
+		log.Fatalln("加载配置出错: ", err)
+	}
+	if Loader.Dump {
+		fmt.Print(tools.DumpConfig(conf))
+		os.Exit(0)
+	}
+	if len(Loader.Path) != 0 {
+		log.Println("加载配置文件: ", Loader.Path)
+	}
+	applyConfig(conf)
+}
+
+// 收到SIGHUP时重新加载配置，只有可重新加载的配置立即生效
+func reloadConfig() {
+	var ch = make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		conf := new(Config)
+		if err := Loader.Load(conf); err != nil {
+			log.Println("重新加载配置出错，仍使用原配置: ", err)
+			continue
+		}
+		if keys := tools.KeepRestart(Conf, conf); len(keys) != 0 {
+			log.Println("以下配置需要重启才能生效: ", strings.Join(keys, ","))
+		}
+		applyConfig(conf)
+		log.Println("已重新加载配置")
+	}
+}
+
+// 写回包变量，重新加载时只修改可重新加载的配置
+// Conf始终为当前生效的配置
+func applyConfig(c *Config) {
+	if Conf == nil {
+		ListenAddr = c.ListenAddr
+		BaseDir = c.BaseDir
+		TmpDir = c.TmpDir
+		ELASTIC_URL = c.ElasticURL
+		ES_INDEX = c.ESIndex
+		MetaBackend = c.MetaBackend
+		NSQ_ADDR = c.NSQAddr
+		MemberBackend = c.Membership
+		MemberAddr = c.MemberAddr
+		Seeds = c.Seeds
+		HBSendInterval = c.HBInterval
+		VaildTime = c.HBTimeout.Nanoseconds()
+		HBLegacy = c.HBLegacy
+		Zone = c.Zone
+		Rack = c.Rack
+		ScrubInterval = c.ScrubInterval
+		TLSCert = c.TLSCert
+		TLSKey = c.TLSKey
+		TLSCA = c.TLSCA
+	}
+	// 读写超时按请求设置(见withDeadline)，不修改运行中的http.Server
+	l := &liveConfig{
+		ReadTimeout:     c.ReadTimeout,
+		WriteTimeout:    c.WriteTimeout,
+		ShutdownTimeout: c.ShutdownTimeout,
+		TokenTimeout:    c.TokenTimeout,
+		ScrubRate:       c.ScrubRate,
+	}
+	l.ClusterSecret, l.RandomSecret = clusterSecret(c.ClusterSecret, live())
+	liveConf.Store(l)
+	tools.SetLogLevel(c.LogLevel)
+	Conf = c
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tools "../tools"
@@ -18,61 +19,89 @@ import (
 // 所有逻辑处理，与es交互
 
 const (
-	ELASTIC_URL   = "http://192.168.10.150:9200"
-	ES_INDEX      = "objstorage" // 索引名，所有服务共用一个索引
-	ES_TYPE_SHARD = "shard"
+	ES_TYPE_SHARD      = "shard"
+	ES_TYPE_SHARD_PATH = "shard_path" // 按路径记录的切片，id为节点地址/切片路径，巡检时按路径找到切片的md5
+	META_DB            = "meta.db"    // Bolt后端时，元数据文件名(存放于Dir)
 )
 
+// 部分为默认值，启动时由配置覆盖(见config.go)
 var (
+	ELASTIC_URL  = "http://192.168.10.150:9200"
+	ES_INDEX     = "objstorage" // 索引名，所有服务共用一个索引
 	BaseDir      = "/data1"
-	TmpDir       = "/data1/tmp"
-	FileToken    = make(map[string]*Files)
-	TokenTimeOut = 5 * time.Second // token有效时间
-	FileMU       = &sync.RWMutex{}
-	ESearch      = tools.NewES(ELASTIC_URL, ES_INDEX) // ES实例
-	RunningMap   = map[string]struct{}{}              // 保存正在执行保存任务的md5，以免重复上传分片
-	RunningMU    = &sync.RWMutex{}                    // 保护RunningMap
+	TmpDir       string                  // 临时文件目录，默认为BaseDir/tmp
+	TokenTimeOut = 30 * time.Second      // token有效时间(默认值，生效的值见live)
+	MetaBackend  = tools.STORE_ES        // 元数据存储类型: es|bolt
+	MetaStore    tools.MetadataStore     // 元数据存储实例
+	RunningMap   = map[string]struct{}{} // 保存正在执行保存任务的md5，以免重复上传分片
+	RunningMU    = &sync.RWMutex{}       // 保护RunningMap
 )
 
 var (
 	ErrMD5    = errors.New("MD5有误")
 	ErrUpload = errors.New("上传文件时出错")
 	ErrES     = errors.New("ES中不存在Doc")
+	ErrPath   = errors.New("无效的切片路径")
 	Err405    = errors.New("非法Method")
 	Err500    = errors.New("500 Server Error")
 	Err404    = errors.New("404 Not Found")
 	Err403    = errors.New("403 Forbidden")
 )
 
-type Files struct {
-	ServerPath string
-	ReqTime    time.Time
+// 确定token密钥，未配置时随机生成(重新加载时沿用prev中已生成的)，此时只能使用本节点checkshard签发的token
+func clusterSecret(secret string, prev *liveConfig) (string, bool) {
+	switch {
+	case len(secret) != 0:
+		return secret, false
+	case prev.RandomSecret:
+		return prev.ClusterSecret, true
+	}
+	log.Println("未设置cluster_secret, 下载切片前须先请求checkshard")
+	return tools.RandomSecret(), true
 }
 
-func init() {
+// 创建分片目录及元数据存储，须在加载配置后调用
+func prepare() {
 	var (
 		f   os.FileInfo
 		err error
 	)
-	if l := os.Getenv("LISTEN_ADDR"); len(l) != 0 {
-		ListenAddr = l
-	}
-	if tmp := os.Getenv("BaseDir"); len(tmp) != 0 {
-		BaseDir = tmp
-	}
 	Dir = filepath.Join(BaseDir, strings.Replace(ListenAddr, ":", ".", -1))
 	if f, err = os.Stat(Dir); err != nil {
 		if os.IsNotExist(err) {
 			log.Println("创建新的分片目录: ", Dir)
 			os.MkdirAll(Dir, 0755)
-			return
 		}
-	}
-	if f.IsDir() {
+	} else if f.IsDir() {
 		log.Println("已存在分片目录: ", Dir)
 	} else {
 		log.Fatalln("存储分片类型须为目录: ", Dir)
 	}
+
+	// 元数据存储，默认使用ES
+	MetaStore = tools.NewStore(MetaBackend, ELASTIC_URL, ES_INDEX, filepath.Join(Dir, META_DB))
+	ShardCount = countShards()
+}
+
+// 统计Dir中的切片数(不含元数据文件及隔离目录)
+func countShards() int64 {
+	var n int64
+	filepath.Walk(Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == filepath.Join(Dir, QUARANTINE_DIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != filepath.Join(Dir, META_DB) {
+			n++
+		}
+		return nil
+	})
+	return n
 }
 
 // 数据切片，通过ES获取
@@ -82,45 +111,45 @@ type Shard struct {
 	MD5     string `json:"md5"`
 	SerPath string `json:"ser_path"` // 存放在data中的路径，如xxx/shards.xx，一般为md5.01这类名
 	Server  string `json:"server"`   // 存放在哪个区服, 例如: 0.0.0.0:8000
+	FileMd5 string `json:"file_md5"` // 所属文件的md5，上报损坏切片时使用
 }
 
-// 检验md5并返回跳转url
+// 检验md5并返回下载token，未配置cluster_secret的api通过该接口获取token
+// 带path时直接校验该路径的切片，不依赖shard文档(副本等不同节点上的切片md5可能相同，共用ES时文档只有一份)
 func (s *Shard) CheckShard(resp http.ResponseWriter, req *http.Request) {
-	var (
-		token   string // 临时token
-		serpath string
-	)
+	var serpath string
 	s.MD5 = req.FormValue(P_MD5)
-	if len(s.MD5) != 32 || !ESearch.IsExists(ES_TYPE_SHARD, s.MD5) {
+	s.SerPath = req.FormValue(P_PATH)
+	if len(s.MD5) != 32 || (len(s.SerPath) == 0 && !MetaStore.IsExists(ES_TYPE_SHARD, s.MD5)) {
 		log.Println("ES中不存在分片信息: ", s.MD5)
 		resp.Write(tools.Json2Byte(500, ErrMD5.Error()))
 		return
 	}
-	res, _ := ESearch.GetOne(ES_TYPE_SHARD, s.MD5)
-	if err := json.Unmarshal(*res.Source, s); err != nil {
-		log.Println(err.Error())
-		resp.Write(tools.Json2Byte(500, Err500.Error()))
-		return
+	if len(s.SerPath) == 0 {
+		body, _ := MetaStore.Get(ES_TYPE_SHARD, s.MD5)
+		if err := json.Unmarshal(body, s); err != nil {
+			log.Println(err.Error())
+			resp.Write(tools.Json2Byte(500, Err500.Error()))
+			return
+		}
 	}
 
 	serpath = filepath.Join(Dir, s.SerPath)
+	if !strings.HasPrefix(serpath, Dir+string(filepath.Separator)) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
 	if !tools.FileExist(serpath) {
 		log.Println("不存在该shard: ", serpath)
 		resp.Write(tools.Json2Byte(404, Err404.Error()))
 		return
 	}
-	if !tools.MD5Diff(s.MD5, serpath) {
+	if !verifyShard(serpath, s.MD5) {
 		resp.Write(tools.Json2Byte(500, ErrMD5.Error()))
 		return
 	}
-	token = tools.RandomString(8)
-	FileMU.Lock()
-	FileToken[token] = &Files{
-		ServerPath: serpath,
-		ReqTime:    time.Now(),
-	}
-	FileMU.Unlock()
-	resp.Write(tools.Json2Byte(302, token))
+	c := live()
+	resp.Write(tools.Json2Byte(302, tools.SignShardToken(c.ClusterSecret, s.MD5, s.SerPath, time.Now().Add(c.TokenTimeout))))
 }
 
 // 删除切片
@@ -131,9 +160,18 @@ func (s *Shard) DeleteShard(resp http.ResponseWriter, req *http.Request) {
 		resp.Write(tools.Json2Byte(500, ErrMD5.Error()))
 		return
 	}
-	if ESearch.IsExists(ES_TYPE_SHARD, s.MD5) {
+	// 防止path越出分片目录
+	s.SerPath = req.FormValue(P_PATH)
+	tmpfile := filepath.Join(Dir, s.SerPath)
+	if !strings.HasPrefix(tmpfile, Dir+string(filepath.Separator)) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if doc := getShardDoc(s.MD5); doc != nil && len(doc.Server) != 0 && doc.Server != ListenAddr {
+		log.Println("切片文档属于其他节点，保留: ", s.MD5, doc.Server) // 副本等相同md5的切片
+	} else if doc != nil {
 		log.Println("从ES中删除切片文档: ", s.MD5)
-		if _, err := ESearch.Delete(ES_TYPE_SHARD, s.MD5); err != nil {
+		if _, err := MetaStore.Delete(ES_TYPE_SHARD, s.MD5); err != nil {
 			resp.Write(tools.Json2Byte(500, Err500.Error()))
 			return
 		}
@@ -142,51 +180,86 @@ func (s *Shard) DeleteShard(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	// 处理分片
-	s.SerPath = req.FormValue(P_PATH)
-	tmpfile := filepath.Join(Dir, s.SerPath)
 	if tools.FileExist(tmpfile) {
 		log.Println("删除切片文件: ", tmpfile)
-		os.Remove(tmpfile)
+		if os.Remove(tmpfile) == nil {
+			atomic.AddInt64(&ShardCount, -1)
+		}
+		forgetVerified(tmpfile)
 	} else {
 		log.Println("不存在切片文件: ", tmpfile)
 	}
+	if _, err := MetaStore.Delete(ES_TYPE_SHARD_PATH, shardPathID(tmpfile)); err != nil && err != tools.ErrDocNotFound {
+		log.Println("删除切片路径记录出错: ", tmpfile, err.Error())
+	}
 	resp.Write(tools.Json2Byte(200, "成功删除切片: "+s.SerPath))
 }
 
+// 切片路径记录的id，serpath为切片的绝对路径
+func shardPathID(serpath string) string {
+	return ListenAddr + "/" + filepath.ToSlash(strings.TrimPrefix(serpath, Dir+string(filepath.Separator)))
+}
+
+// 获取切片文档，不存在时返回nil
+func getShardDoc(md5 string) *Shard {
+	var doc = new(Shard)
+	if !MetaStore.IsExists(ES_TYPE_SHARD, md5) {
+		return nil
+	}
+	body, err := MetaStore.Get(ES_TYPE_SHARD, md5)
+	if err != nil || json.Unmarshal(body, doc) != nil {
+		return nil
+	}
+	return doc
+}
+
 // 发送文件，直接通过resp
+// token绑定md5和path，不带path时(旧版api)从元数据中查找
 func (s *Shard) SendShard(resp http.ResponseWriter, req *http.Request) {
 	var (
-		ok    bool
-		token string // 传递过来的token
-		f     *Files
+		token   = req.FormValue(P_TOKEN) // 传递过来的token
+		serpath string
+		err     error
 	)
-
-	// token有效性
-	token = req.FormValue(P_TOKEN)
-	if len(token) != 8 {
+	s.MD5 = req.FormValue(P_MD5)
+	s.SerPath = req.FormValue(P_PATH)
+	if len(s.MD5) != 32 || len(token) == 0 {
 		resp.Write(tools.Json2Byte(403, Err403.Error()))
 		return
 	}
-	FileMU.RLock()
-	f, ok = FileToken[token]
-	FileMU.RUnlock()
-	if !ok || time.Now().Sub(f.ReqTime) > TokenTimeOut {
-		log.Println("无效token: ", token)
-		resp.Write(tools.Json2Byte(404, Err404.Error()))
+	if len(s.SerPath) == 0 {
+		body, err := MetaStore.Get(ES_TYPE_SHARD, s.MD5)
+		if err != nil || json.Unmarshal(body, s) != nil {
+			log.Println("ES中不存在分片信息: ", s.MD5)
+			resp.Write(tools.Json2Byte(404, Err404.Error()))
+			return
+		}
+	}
+	if err = tools.VerifyShardToken(live().ClusterSecret, s.MD5, s.SerPath, token); err != nil {
+		log.Printf("%s: %s %s\n", err.Error(), s.MD5, s.SerPath)
+		resp.Write(tools.Json2Byte(403, err.Error()))
 		return
 	}
 
-	// ServerPath路径查找文件
-	if tools.FileExist(f.ServerPath) {
-		log.Println("发送切片: ", f.ServerPath)
-		http.ServeFile(resp, req, f.ServerPath)
-	} else {
-		log.Println("不存在该切片: ", f.ServerPath)
+	// ServerPath路径查找文件，token已绑定path，这里只防止越出分片目录
+	serpath = filepath.Join(Dir, s.SerPath)
+	if !strings.HasPrefix(serpath, Dir+string(filepath.Separator)) {
+		resp.Write(tools.Json2Byte(403, Err403.Error()))
+		return
+	}
+	if !tools.FileExist(serpath) {
+		log.Println("不存在该切片: ", serpath)
 		resp.Write(tools.Json2Byte(404, Err404.Error()))
+		return
+	}
+	// api自行签发token时不再请求checkshard，发送前校验md5，损坏的切片由api通过其他切片还原
+	if !verifyShard(serpath, s.MD5) {
+		log.Println("切片MD5不一致，拒绝发送: ", serpath)
+		resp.Write(tools.Json2Byte(500, ErrMD5.Error()))
+		return
 	}
-	FileMU.Lock()
-	delete(FileToken, token)
-	FileMU.Unlock()
+	tools.Debugln("发送切片: ", serpath)
+	http.ServeFile(resp, req, serpath)
 }
 
 // 获取put新建的文件，需要检验md5，提交至ES索引
@@ -198,6 +271,8 @@ func (s *Shard) ShardServer(resp http.ResponseWriter, req *http.Request) {
 		pf           multipart.File // form文件
 		finfo        os.FileInfo
 	)
+	WriteWG.Add(1)
+	defer WriteWG.Done()
 	// 判断MD5
 	s.MD5 = req.FormValue(P_MD5)
 	if len(s.MD5) != 32 {
@@ -227,13 +302,24 @@ func (s *Shard) ShardServer(resp http.ResponseWriter, req *http.Request) {
 
 	// 判断文件
 	s.SerPath = req.FormValue(P_PATH)
+	s.FileMd5 = req.FormValue(P_FILEMD5)
 	serpath = filepath.Join(Dir, s.SerPath)
 	tmp = filepath.Join(TmpDir, s.SerPath)
+	// 防止path越出分片目录及临时目录
+	if !strings.HasPrefix(serpath, Dir+string(filepath.Separator)) || !strings.HasPrefix(tmp, TmpDir+string(filepath.Separator)) {
+		log.Println(ErrPath.Error(), s.SerPath)
+		resp.Write(tools.Json2Byte(400, ErrPath.Error()))
+		return
+	}
 	if tools.FileExist(serpath) {
 		log.Println("已存在,将覆盖该文件: ", serpath)
 	}
 	os.MkdirAll(filepath.Dir(tmp), 0755)
-	f, _ = os.Create(tmp) // 创建临时文件
+	if f, err = os.Create(tmp); err != nil { // 创建临时文件
+		log.Println("创建临时文件出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, Err500.Error()))
+		return
+	}
 	defer func() {
 		f.Close()
 		os.Remove(tmp)
@@ -246,26 +332,41 @@ func (s *Shard) ShardServer(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	log.Println("存进临时文件: ", tmp)
+	tools.Debugln("存进临时文件: ", tmp)
 	if !tools.MD5AndStorage(pf, f, s.MD5) {
 		log.Println("MD5不一致")
 		resp.Write(tools.Json2Byte(400, ErrMD5.Error()))
 		return
 	}
+	if err = f.Sync(); err != nil { // 落盘后才返回成功
+		log.Println("切片落盘失败: ", err.Error())
+		resp.Write(tools.Json2Byte(500, Err500.Error()))
+		return
+	}
 
 	// 上传至ES数据库
 	finfo, _ = os.Stat(tmp)
 	s.Size = finfo.Size()
-	if _, err = ESearch.Add(ES_TYPE_SHARD, s.MD5, s); err != nil {
+	if _, err = MetaStore.Add(ES_TYPE_SHARD, s.MD5, s); err != nil {
 		log.Println("提交到ES时出错: ", err.Error())
 		resp.Write(tools.Json2Byte(500, Err500.Error()))
 		return
 	}
+	// 相同md5的切片(如副本)共用一个shard文档，按路径另外记录，巡检时使用
+	if _, err = MetaStore.Add(ES_TYPE_SHARD_PATH, shardPathID(serpath), s); err != nil {
+		log.Println("提交切片路径记录出错: ", err.Error())
+		resp.Write(tools.Json2Byte(500, Err500.Error()))
+		return
+	}
 	os.MkdirAll(filepath.Dir(serpath), 0755)
+	exist := tools.FileExist(serpath)
 	if err = tools.MoveFile(tmp, serpath); err != nil {
 		log.Println(err.Error())
 		resp.Write(tools.Json2Byte(500, Err500.Error()))
 	} else {
+		if !exist {
+			atomic.AddInt64(&ShardCount, 1)
+		}
 		log.Println("success,成功存进: ", serpath)
 		resp.Write(tools.Json2Byte(200, "成功存进Data: "+s.SerPath))
 	}
@@ -3,72 +3,126 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	tools "../tools"
-	nsq "github.com/nsqio/go-nsq"
 )
 
 const (
-	NSQ_ADDR      = "127.0.0.1:4150"
 	CONSUMER_TYPE = "DATA" // 消费者类型
 )
 
 var (
+	NSQ_ADDR       = "127.0.0.1:4150"
 	DataServerMap  = make(map[string]int64, 8) // 用于保存data节点的时间信息
 	DataMu         = &sync.RWMutex{}           // DataServer的读写锁
 	HBSendInterval = time.Millisecond * 1000   // 发送心跳时间间隔
 	WarnCount      = 5                         // 发送心跳次数超过5次，会打印警报信息
 	VaildTime      = time.Second.Nanoseconds() // data超时时间
 	Topic          = map[string]string{
-		"hbapi":  "HBApiServers",  // api服务器的addr
-		"hbdata": "HBDataServers", // data服务器的addr
+		"hbapi":   "HBApiServers",  // api服务器的addr
+		"hbdata":  "HBDataServers", // data服务器的addr
+		"corrupt": "CorruptShards", // 巡检发现的异常切片
 	}
 	// 格式为: 消费者类型_消费者IP_消费者PORT, 例如: API_19216810101_4015
-	ChannelAPIHB string            // 获取api心跳信息的channel
-	DATASERVER   *DataServerStruct // data的api接口服务器
+	ChannelAPIHB  string             // 获取api心跳信息的channel
+	DATASERVER    *DataServerStruct  // data的api接口服务器
+	MemberBackend = tools.MEMBER_NSQ // 集群成员类型: nsq|static|gossip
+	MemberAddr    string             // UDP后端的监听地址，默认与ListenAddr相同
+	Seeds         []string           // static的所有节点或gossip的种子节点
 )
 
 func main() {
 	var (
-		hb *tools.HeartBeat
+		hb  tools.Membership
+		err error
 	)
+	loadConfig() // 加载配置，dump-config时打印后退出
+	prepare()
+	go reloadConfig() // 收到SIGHUP时重新加载配置
+
 	ChannelAPIHB = fmt.Sprintf("%s_%s", CONSUMER_TYPE, strings.Replace(strings.Replace(ListenAddr, ".", "", -1), ":", "_", -1))
 
-	hb = tools.NewHeartBeat(NSQ_ADDR, Topic["hbdata"], ListenAddr, WarnCount, HBSendInterval)
+	hb, err = tools.NewMembership(MemberBackend, tools.HBConf{
+		ProdTopic:    Topic["hbdata"],
+		ProdMsg:      ListenAddr,
+		WarnCount:    WarnCount,
+		ProdInterval: HBSendInterval,
+		Stat:         nodeStat,
+		Legacy:       HBLegacy,
+	}, NSQ_ADDR, MemberAddr, Seeds)
+	if err != nil {
+		log.Fatalln("初始化集群成员出错: ", err)
+	}
 	go hb.SendHeart()
-	hb.AddConsumer(Topic["hbapi"], ChannelAPIHB, &APIConsumer{})
+	if err = hb.AddConsumer(Topic["hbapi"], ChannelAPIHB, &APIConsumer{}); err != nil {
+		log.Fatalln(err)
+	}
+	go scrubber(hb) // 巡检切片
 
 	// RESTful
 	DATASERVER = NewDataServer()
-	DATASERVER.Start()
+	go DATASERVER.Start()
+	shutdown(hb)
+}
+
+// 收到SIGTERM或SIGINT后退出:
+//
+//	①停止心跳并通知其他节点本节点离开，api不再向本节点上传切片
+//	②停止接收新请求，等待正在处理的请求结束
+//	③超时后不再等待读取切片的请求，写入中的切片再等待ShutdownTimeout，以免留下未提交的切片
+func shutdown(hb tools.Membership) {
+	var (
+		ch  = make(chan os.Signal, 1)
+		err error
+	)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	log.Println("收到退出信号: ", <-ch)
+	if err = hb.Leave(); err != nil {
+		log.Println("通知其他节点离开时出错: ", err.Error())
+	}
+	shutdown := live().ShutdownTimeout
+	if err = DATASERVER.Stop(time.Now().Add(shutdown)); err != nil {
+		log.Println("等待请求结束超时: ", err.Error())
+		if !tools.WaitTimeout(WriteWG, shutdown) {
+			log.Println("切片写入未完成，api会重新上传")
+		}
+	}
+	log.Println("data服务已退出")
 }
 
 // 获取API节点信息
 type APIConsumer struct {
 }
 
-func (c *APIConsumer) HandleMessage(msg *nsq.Message) error {
+func (c *APIConsumer) HandleMessage(body []byte) error {
 	var (
-		m         = msg.Body
-		err       error
-		t         int64            // unix时间戳
-		apiServer = string(m[20:]) // IP地址信息
-		now       = time.Now().UnixNano()
+		m   *tools.HBMsg
+		err error
+		now = time.Now().UnixNano()
 	)
-	if t, err = strconv.ParseInt(string(m[:19]), 10, 64); err != nil {
-		log.Println(err)
+	if m, err = tools.ParseHB(body); err != nil {
+		log.Println(err, string(body))
 		return err
 	}
-	if now-t > VaildTime {
-		log.Printf("API节点超时: [%s] %d\n", apiServer, t)
-		return err
+	if m.Leave {
+		log.Printf("API节点离开: [%s]\n", m.Addr)
+		DataMu.Lock()
+		delete(DataServerMap, m.Addr)
+		DataMu.Unlock()
+		return nil
+	}
+	if now-m.Time > VaildTime {
+		log.Printf("API节点超时: [%s] %d\n", m.Addr, m.Time)
+		return nil
 	}
 	DataMu.Lock()
-	DataServerMap[apiServer] = t
+	DataServerMap[m.Addr] = m.Time
 	DataMu.Unlock()
-	return err
+	return nil
 }
@@ -1,25 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	tools "../tools"
 )
 
 const (
-	P_TOKEN = "token" // token的名称
-	P_MD5   = "md5"
-	P_PATH  = "path"
-	P_FILE  = "uploadfile" // post上传时表单名字
+	P_TOKEN   = "token" // token的名称
+	P_MD5     = "md5"
+	P_PATH    = "path"
+	P_FILE    = "uploadfile" // post上传时表单名字
+	P_FILEMD5 = "filemd5"    // 切片所属文件的md5
 )
 
 var (
-	Dir          string                  // 全路径
-	ListenAddr   = "192.168.10.150:8000" // 该api服务接听的地址
-	ReadTimeout  = 10 * time.Second
-	WriteTimeout = 10 * time.Second
+	Dir             string                  // 全路径
+	ListenAddr      = "192.168.10.150:8000" // 该api服务接听的地址
+	Zone            string                  // 可用区标签
+	Rack            string                  // 机架标签
+	HBLegacy        bool                    // 按旧格式发送心跳
+	ShardCount      int64                   // 本节点的切片数
+	InFlight        int64                   // 正在处理的请求数
+	ReadTimeout     = 10 * time.Second      // 读取请求的超时，按请求设置，见withDeadline
+	WriteTimeout    = 10 * time.Second      // 写响应的超时，按请求设置
+	ShutdownTimeout = 30 * time.Second      // 退出时等待请求及切片写入结束的最长时间
+	WriteWG         = &sync.WaitGroup{}     // 正在写入的切片，退出时等待
+	TLSCert         string                  // 设置后使用https(见tools/internal.go)
+	TLSKey          string
+	TLSCA           string // 设置后要求api提供该CA签发的客户端证书
 )
 
 type DataServerStruct struct {
@@ -28,21 +43,44 @@ type DataServerStruct struct {
 	serv       *http.Server // 对外隐藏，提供Start方法替代
 }
 
-// 启动程序
+// 启动程序，Stop后返回
 func (ds *DataServerStruct) Start() {
-	log.Printf("启动data服务: %s\n", ds.serv.Addr)
-	log.Fatalln(ds.serv.ListenAndServe())
+	var err error
+	if ds.serv.TLSConfig != nil {
+		log.Printf("启动data服务(TLS): %s\n", ds.serv.Addr)
+		err = ds.serv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("启动data服务: %s\n", ds.serv.Addr)
+		err = ds.serv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
 }
 
-// 关闭程序
-func (ds *DataServerStruct) Stop() {}
+// 关闭程序: 停止接收新请求，等待正在处理的请求结束，超过deadline时返回错误
+func (ds *DataServerStruct) Stop(deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return ds.serv.Shutdown(ctx)
+}
 
 func NewDataServer() *DataServerStruct {
-	var s = http.NewServeMux()
+	var (
+		s       = http.NewServeMux()
+		tlsConf *tls.Config
+		err     error
+	)
+	if len(TLSCert) != 0 {
+		if tlsConf, err = tools.ServerTLS(TLSCert, TLSKey, TLSCA); err != nil {
+			log.Fatalln("加载TLS证书出错: ", err)
+		}
+	}
 
 	// 初始化处理函数
 	s.HandleFunc("/shard", handlerShard)
 	s.HandleFunc("/checkshard", handlerCheckShard)
+	s.HandleFunc("/stat", handlerStat)
 	s.HandleFunc("/", func(resp http.ResponseWriter, rsq *http.Request) {
 		resp.Write(tools.Json2Byte(403, Err403.Error()))
 	})
@@ -51,14 +89,32 @@ func NewDataServer() *DataServerStruct {
 		ListenAddr: ListenAddr,
 		Dir:        Dir,
 		serv: &http.Server{
-			Addr:           ListenAddr,
-			Handler:        s,
-			ReadTimeout:    ReadTimeout,
-			WriteTimeout:   WriteTimeout,
-			MaxHeaderBytes: 1 << 20,
+			Addr:              ListenAddr,
+			Handler:           countInFlight(withDeadline(verifyInternal(s))),
+			TLSConfig:         tlsConf,
+			ReadHeaderTimeout: live().ReadTimeout,
+			MaxHeaderBytes:    1 << 20,
 		}}
 }
 
+// 按当前配置为每个请求设置读写超时，重新加载配置后对新请求生效
+func withDeadline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var (
+			c   = live()
+			rc  = http.NewResponseController(resp)
+			now = time.Now()
+		)
+		if c.ReadTimeout > 0 {
+			rc.SetReadDeadline(now.Add(c.ReadTimeout))
+		}
+		if c.WriteTimeout > 0 {
+			rc.SetWriteDeadline(now.Add(c.WriteTimeout))
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
 // 分片相关功能
 func handlerShard(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -91,3 +147,55 @@ func handlerCheckShard(resp http.ResponseWriter, req *http.Request) {
 	}
 	sha.CheckShard(resp, req)
 }
+
+// 返回节点状态: 磁盘空间、切片数及zone/rack标签
+func handlerStat(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.Write(tools.Json2Byte(405, Err405.Error()))
+		return
+	}
+	resp.Write(tools.Json2ByteObj(200, nodeStat()))
+}
+
+// 节点状态，随心跳发送
+func nodeStat() tools.NodeStat {
+	var (
+		st = tools.NodeStat{
+			Addr:     ListenAddr,
+			Version:  tools.Version,
+			Zone:     Zone,
+			Rack:     Rack,
+			Shards:   atomic.LoadInt64(&ShardCount),
+			InFlight: atomic.LoadInt64(&InFlight),
+		}
+		err error
+	)
+	if st.Free, st.Total, err = tools.DiskUsage(Dir); err != nil {
+		log.Println("获取磁盘空间出错: ", err.Error())
+	}
+	return st
+}
+
+// 统计正在处理的请求数
+func countInFlight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&InFlight, 1)
+		defer atomic.AddInt64(&InFlight, -1)
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// 设置了cluster_secret时，校验api请求的签名
+// 未设置时由mTLS校验api的证书，或者配置了insecure(见Config.Validate)
+func verifyInternal(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if c := live(); !c.RandomSecret {
+			if err := tools.VerifyInternal(req, c.ClusterSecret); err != nil {
+				log.Printf("%s: %s %s %s\n", err.Error(), req.RemoteAddr, req.Method, req.URL.Path)
+				resp.Write(tools.Json2Byte(401, err.Error()))
+				return
+			}
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tools "../tools"
+)
+
+// 切片巡检: 后台按限速遍历本节点Dir中的所有切片，重新计算md5并与该路径记录的md5对比
+// 不一致的切片移动到隔离目录(Dir/quarantine)，缺失或损坏的切片上报给api，由api还原
+// 隔离的切片不会自动删除，由管理员确认后处理
+// 发送切片前也会校验md5(见verifyShard)，校验结果按文件大小和修改时间缓存，巡检通过的切片同样记录
+// 不改变大小和修改时间的损坏(如磁盘位翻转)由下一次巡检发现
+
+const (
+	QUARANTINE_DIR = "quarantine" // 隔离目录(存放于Dir)
+	SCRUB_CHUNK    = 64 << 10     // 限速读取时，每次最多读取的字节数
+	REASON_MISSING = "missing"    // 切片文件不存在
+	REASON_CORRUPT = "corrupt"    // 切片md5不一致
+)
+
+var (
+	ScrubRate     int64 = 10 << 20                   // 每秒最多读取的字节数(默认值，生效的值见live)
+	ScrubInterval       = 24 * time.Hour             // 两次巡检的间隔，为0时不巡检
+	verified            = map[string]verifiedShard{} // 已校验md5的切片，key为切片路径
+	verifiedMU          = &sync.Mutex{}              // 保护verified
+)
+
+// 校验通过时切片文件的状态，文件被修改后需要重新校验
+type verifiedShard struct {
+	md5  string
+	size int64
+	mod  time.Time
+}
+
+// 切片文件的md5是否为md5，校验通过的结果会缓存，文件未修改时不再重新计算
+func verifyShard(serpath, md5 string) bool {
+	info, err := os.Stat(serpath)
+	if err != nil {
+		return false
+	}
+	v := verifiedShard{md5: md5, size: info.Size(), mod: info.ModTime()}
+	verifiedMU.Lock()
+	ok := verified[serpath] == v
+	verifiedMU.Unlock()
+	if ok {
+		return true
+	}
+	if !tools.MD5Diff(md5, serpath) {
+		forgetVerified(serpath)
+		return false
+	}
+	verifiedMU.Lock()
+	verified[serpath] = v
+	verifiedMU.Unlock()
+	return true
+}
+
+// 记录切片已通过校验，info为计算md5之前的文件状态
+func markVerified(serpath, md5 string, info os.FileInfo) {
+	verifiedMU.Lock()
+	verified[serpath] = verifiedShard{md5: md5, size: info.Size(), mod: info.ModTime()}
+	verifiedMU.Unlock()
+}
+
+func forgetVerified(serpath string) {
+	verifiedMU.Lock()
+	delete(verified, serpath)
+	verifiedMU.Unlock()
+}
+
+// 巡检进程
+func scrubber(hb tools.Membership) {
+	if ScrubInterval <= 0 {
+		log.Println("不巡检切片")
+		return
+	}
+	for {
+		scrubAll(hb)
+		time.Sleep(ScrubInterval)
+	}
+}
+
+// 巡检本节点的所有切片: 遍历Dir中的切片文件，按路径记录找到应有的md5后重新计算
+// 旧版本写入的切片没有路径记录，使用路径相同的shard文档；有记录而文件不存在时上报缺失
+func scrubAll(hb tools.Membership) {
+	var (
+		shards = map[string]*Shard{} // 应有的切片，key为切片的绝对路径
+		paths  []string
+		bad    int
+		start  = time.Now()
+	)
+	MetaStore.Scan(ES_TYPE_SHARD, "", func(id string, doc []byte) bool {
+		s := new(Shard)
+		if json.Unmarshal(doc, s) == nil && s.Server == ListenAddr {
+			shards[filepath.Join(Dir, s.SerPath)] = s
+		}
+		return true
+	})
+	MetaStore.Scan(ES_TYPE_SHARD_PATH, ListenAddr+"/", func(id string, doc []byte) bool {
+		s := new(Shard)
+		if json.Unmarshal(doc, s) == nil {
+			shards[filepath.Join(Dir, s.SerPath)] = s
+		}
+		return true
+	})
+	filepath.Walk(Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == filepath.Join(Dir, QUARANTINE_DIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == filepath.Join(Dir, META_DB) {
+			return nil
+		}
+		if _, ok := shards[path]; !ok {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	for path := range shards {
+		paths = append(paths, path)
+	}
+	log.Println("开始巡检切片: ", len(paths))
+	for _, path := range paths {
+		s := shards[path]
+		if s == nil {
+			recordLegacy(path)
+			continue
+		}
+		if reason := s.scrub(); len(reason) != 0 {
+			bad++
+			s.report(hb, reason)
+		}
+	}
+	log.Printf("巡检切片结束: %d个切片，%d个异常，耗时%s\n", len(paths), bad, time.Since(start))
+}
+
+// 校验一个切片，返回异常原因，正常时返回""
+func (s *Shard) scrub() string {
+	var (
+		serpath = filepath.Join(Dir, s.SerPath)
+		sum     string
+		info    os.FileInfo
+		err     error
+	)
+	RunningMU.RLock()
+	_, ok := RunningMap[s.MD5]
+	RunningMU.RUnlock()
+	if ok { // 正在写入
+		return ""
+	}
+	if sum, info, err = hashShard(serpath); os.IsNotExist(err) {
+		if s.recorded() { // 巡检期间可能已被删除
+			log.Println("巡检时切片不存在: ", serpath)
+			return REASON_MISSING
+		}
+		return ""
+	} else if err != nil {
+		log.Println("巡检时读取切片出错: ", serpath, err.Error())
+		return ""
+	}
+	if sum == s.MD5 {
+		markVerified(serpath, s.MD5, info)
+		return ""
+	}
+	log.Println("切片MD5不一致，移入隔离目录: ", serpath)
+	forgetVerified(serpath)
+	dest := filepath.Join(Dir, QUARANTINE_DIR, s.SerPath+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Dir(dest), 0755)
+	if err = os.Rename(serpath, dest); err != nil {
+		log.Println("隔离切片出错: ", err.Error())
+	} else {
+		atomic.AddInt64(&ShardCount, -1)
+	}
+	return REASON_CORRUPT
+}
+
+// 按限速计算切片文件的md5，同时返回计算前的文件状态
+func hashShard(serpath string) (string, os.FileInfo, error) {
+	var h = md5.New()
+	f, err := os.Open(serpath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = io.Copy(h, &rateReader{r: f, rate: live().ScrubRate, start: time.Now()}); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), info, nil
+}
+
+// 没有路径记录的文件: 存在该md5的shard文档时为旧版本写入的切片(如副本的文档记在其他节点)，补充路径记录
+// 否则可能是写入后未提交或已损坏的切片，无法判断，只记录日志
+func recordLegacy(serpath string) {
+	sum, info, err := hashShard(serpath)
+	if err != nil {
+		return
+	}
+	doc := getShardDoc(sum)
+	if doc == nil {
+		log.Println("切片没有md5记录，跳过: ", serpath)
+		return
+	}
+	doc.SerPath = strings.TrimPrefix(serpath, Dir+string(filepath.Separator))
+	doc.Server = ListenAddr
+	if _, err = MetaStore.Add(ES_TYPE_SHARD_PATH, shardPathID(serpath), doc); err != nil {
+		log.Println("补充切片路径记录出错: ", serpath, err.Error())
+		return
+	}
+	markVerified(serpath, sum, info)
+}
+
+// 切片是否仍有记录: 路径记录，或旧版本路径相同的shard文档
+func (s *Shard) recorded() bool {
+	if MetaStore.IsExists(ES_TYPE_SHARD_PATH, shardPathID(filepath.Join(Dir, s.SerPath))) {
+		return true
+	}
+	doc := getShardDoc(s.MD5)
+	return doc != nil && doc.Server == ListenAddr && filepath.Join(Dir, doc.SerPath) == filepath.Join(Dir, s.SerPath)
+}
+
+// 上报异常切片
+func (s *Shard) report(hb tools.Membership, reason string) {
+	var (
+		body []byte
+		err  error
+	)
+	body, _ = json.Marshal(&tools.ShardReport{
+		Server:  ListenAddr,
+		Md5:     s.MD5,
+		SerPath: s.SerPath,
+		FileMd5: s.FileMd5,
+		Reason:  reason,
+	})
+	if err = hb.Send(Topic["corrupt"], string(body)); err != nil {
+		log.Println("上报异常切片失败: ", s.SerPath, err.Error())
+	}
+}
+
+// 限速读取，平均每秒不超过rate字节
+type rateReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64 // 已读取的字节数
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if len(p) > SCRUB_CHUNK {
+		p = p[:SCRUB_CHUNK]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if d := time.Duration(r.n*int64(time.Second)/r.rate) - time.Since(r.start); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
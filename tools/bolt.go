@@ -0,0 +1,304 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 封装BoltDB，实现与ES相同的CRUD，每个docType对应一个bucket
+
+type Bolt struct {
+	Path string   // db文件路径
+	DB   *bolt.DB // 存放db句柄
+}
+
+func NewBolt(path string) *Bolt {
+	var (
+		db  *bolt.DB
+		err error
+	)
+	DirExist(filepath.Dir(path))
+	if db, err = bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+		log.Fatalf("打开Bolt文件失败: %s, %s\n", path, err)
+	}
+	return &Bolt{
+		Path: path,
+		DB:   db,
+	}
+}
+
+// 增加: 整个doc增加,md5为id
+func (b *Bolt) Add(docType, md5 string, doc interface{}) (string, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(doc); err != nil {
+		return "", err
+	}
+	err = b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(docType))
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(md5), body)
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("添加成功: %s, %s", docType, md5), nil
+}
+
+// 增加: 在同一事务中判断是否已存在
+func (b *Bolt) Create(docType, md5 string, doc interface{}) error {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(docType))
+		if err != nil {
+			return err
+		}
+		if bk.Get([]byte(md5)) != nil {
+			return ErrConflict
+		}
+		return bk.Put([]byte(md5), body)
+	})
+}
+
+// 删除: 根据id/md5
+func (b *Bolt) Delete(docType, md5 string) (string, error) {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil || bk.Get([]byte(md5)) == nil {
+			return ErrDocNotFound
+		}
+		return bk.Delete([]byte(md5))
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("删除成功: %s, %s", docType, md5), nil
+}
+
+// 改: 修改整个doc，与ES一致，只覆盖doc中出现的字段
+func (b *Bolt) UpdateDoc(docType, md5 string, doc interface{}) (string, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(doc); err != nil {
+		return "", err
+	}
+	if err = b.merge(docType, md5, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("文档修改成功: %s, %s", docType, md5), nil
+}
+
+// 改: 修改部分filed
+func (b *Bolt) UpdateField(docType, md5, filed string, value interface{}) (string, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(map[string]interface{}{filed: value}); err != nil {
+		return "", err
+	}
+	if err = b.merge(docType, md5, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("文档字段成功: %s, %s, %s", docType, md5, filed), nil
+}
+
+// 查找: 根据id/md5查找
+func (b *Bolt) Get(docType, md5 string) ([]byte, error) {
+	var body []byte
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return ErrDocNotFound
+		}
+		v := bk.Get([]byte(md5))
+		if v == nil {
+			return ErrDocNotFound
+		}
+		// bolt返回的切片只在事务内有效，需要复制
+		body = append([]byte{}, v...)
+		return nil
+	})
+	return body, err
+}
+
+// 查找: bolt没有版本号，以doc内容的hash作为版本号
+func (b *Bolt) GetVersion(docType, md5 string) ([]byte, int64, error) {
+	body, err := b.Get(docType, md5)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, boltVersion(body), nil
+}
+
+// 改: 在同一事务中比较版本号并替换整个doc
+func (b *Bolt) UpdateIf(docType, md5 string, version int64, doc interface{}) error {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return ErrDocNotFound
+		}
+		v := bk.Get([]byte(md5))
+		if v == nil {
+			return ErrDocNotFound
+		}
+		if boltVersion(v) != version {
+			return ErrConflict
+		}
+		return bk.Put([]byte(md5), body)
+	})
+}
+
+// 删除: 在同一事务中比较版本号并删除
+func (b *Bolt) DeleteIf(docType, md5 string, version int64) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return ErrDocNotFound
+		}
+		v := bk.Get([]byte(md5))
+		if v == nil {
+			return ErrDocNotFound
+		}
+		if boltVersion(v) != version {
+			return ErrConflict
+		}
+		return bk.Delete([]byte(md5))
+	})
+}
+
+func boltVersion(body []byte) int64 {
+	h := fnv.New64a()
+	h.Write(body)
+	return int64(h.Sum64())
+}
+
+// 判断是否存在
+func (b *Bolt) IsExists(docType, md5 string) bool {
+	_, err := b.Get(docType, md5)
+	return err == nil
+}
+
+// 遍历: 按id前缀遍历，bolt中的key有序，直接Seek到前缀位置
+// fn中可能会再写入db，所以先在只读事务中取出数据，再逐个回调
+func (b *Bolt) Scan(docType, prefix string, fn func(id string, doc []byte) bool) error {
+	var (
+		ids  []string
+		docs [][]byte
+	)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return nil
+		}
+		c := bk.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			ids = append(ids, string(k))
+			docs = append(docs, append([]byte{}, v...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range ids {
+		if !fn(ids[i], docs[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// 遍历: 从prefix与after中较大的位置Seek，跳过after本身，最多取出limit个
+func (b *Bolt) ScanAfter(docType, prefix, after string, limit int, fn func(id string, doc []byte) bool) error {
+	var (
+		ids  []string
+		docs [][]byte
+		from = prefix
+	)
+	if after > from {
+		from = after
+	}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return nil
+		}
+		c := bk.Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(ids) < limit; k, v = c.Next() {
+			if string(k) == after {
+				continue
+			}
+			ids = append(ids, string(k))
+			docs = append(docs, append([]byte{}, v...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range ids {
+		if !fn(ids[i], docs[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// 将patch中的顶层字段合并进已有的doc
+func (b *Bolt) merge(docType, md5 string, patch []byte) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		var (
+			old = map[string]json.RawMessage{}
+			p   = map[string]json.RawMessage{}
+			v   []byte
+			err error
+		)
+		bk := tx.Bucket([]byte(docType))
+		if bk == nil {
+			return ErrDocNotFound
+		}
+		if v = bk.Get([]byte(md5)); v == nil {
+			return ErrDocNotFound
+		}
+		if err = json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(patch, &p); err != nil {
+			return err
+		}
+		for k, field := range p {
+			old[k] = field
+		}
+		if v, err = json.Marshal(old); err != nil {
+			return err
+		}
+		return bk.Put([]byte(md5), v)
+	})
+}
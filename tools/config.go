@@ -0,0 +1,354 @@
+package tools
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// 配置: apiserv和dataserv共用，优先级从低到高为: 默认值 < 配置文件(YAML) < 环境变量 < 命令行参数
+//
+//	yaml: 配置文件中的键名，同时作为命令行参数名，如: -listen_addr 0.0.0.0:9000
+//	env: 环境变量名，多个时用逗号分隔(兼容旧的变量名)
+//	reload: 收到SIGHUP后立即生效，其余配置修改后需要重启
+//	secret: 打印配置时隐藏
+//
+// 启动参数最后带dump-config时，打印最终生效的配置后退出
+
+const (
+	CMD_DUMP_CONFIG = "dump-config"
+	SECRET_MASK     = "******"
+)
+
+var (
+	ErrConfigCmd = errors.New("未知的命令")
+)
+
+// 两个服务共用的配置
+type Config struct {
+	ListenAddr      string        `yaml:"listen_addr" env:"LISTEN_ADDR,ListenAddr" usage:"监听地址(ip:port)"`
+	BaseDir         string        `yaml:"base_dir" env:"BASE_DIR,BaseDir" usage:"数据根目录"`
+	TmpDir          string        `yaml:"tmp_dir" env:"TMP_DIR,TmpDir" usage:"临时文件目录，为空时在base_dir下"`
+	ElasticURL      string        `yaml:"elastic_url" env:"ELASTIC_URL" usage:"ES地址"`
+	ESIndex         string        `yaml:"es_index" env:"ES_INDEX" usage:"ES索引名，所有服务共用"`
+	MetaBackend     string        `yaml:"meta_backend" env:"META_BACKEND" usage:"元数据存储: es|bolt，apiserv使用bolt时只能运行一个apiserv"`
+	NSQAddr         string        `yaml:"nsq_addr" env:"NSQ_ADDR" usage:"nsqd地址"`
+	Membership      string        `yaml:"membership" env:"MEMBERSHIP" usage:"集群成员: nsq|static|gossip"`
+	MemberAddr      string        `yaml:"member_addr" env:"MEMBER_ADDR" usage:"UDP后端的监听地址，为空时与listen_addr相同"`
+	Seeds           []string      `yaml:"seeds" env:"SEEDS" usage:"static的所有节点或gossip的种子节点，逗号分隔"`
+	HBInterval      time.Duration `yaml:"hb_interval" env:"HB_INTERVAL" usage:"心跳发送间隔"`
+	HBTimeout       time.Duration `yaml:"hb_timeout" env:"HB_TIMEOUT" usage:"心跳超时时间，超时的节点被剔除"`
+	HBLegacy        bool          `yaml:"hb_legacy" env:"HB_LEGACY" usage:"按旧格式发送心跳，用于滚动升级"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT" reload:"true" usage:"http读超时"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" reload:"true" usage:"http写超时"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" reload:"true" usage:"退出时等待请求及上传结束的最长时间"`
+	LogLevel        string        `yaml:"log_level" env:"LOG_LEVEL" reload:"true" usage:"日志级别: debug|info"`
+	ClusterSecret   string        `yaml:"cluster_secret" env:"CLUSTER_SECRET" reload:"true" secret:"true" usage:"集群内共用的密钥，用于签发下载切片的token及api->data请求签名，所有节点须相同"`
+	TokenTimeout    time.Duration `yaml:"token_timeout" env:"TOKEN_TIMEOUT" reload:"true" usage:"下载切片token的有效时间，须大于节点间的时钟偏差"`
+	TLSCert         string        `yaml:"tls_cert" env:"TLS_CERT" usage:"api->data通信的证书(PEM)，设置后启用TLS"`
+	TLSKey          string        `yaml:"tls_key" env:"TLS_KEY" usage:"tls_cert的私钥(PEM)"`
+	TLSCA           string        `yaml:"tls_ca" env:"TLS_CA" usage:"校验对端证书的CA(PEM)，data设置后要求客户端证书(mTLS)"`
+}
+
+// 校验共用配置
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("listen_addr格式有误: %s", c.ListenAddr)
+	}
+	if len(c.BaseDir) == 0 {
+		return errors.New("base_dir不能为空")
+	}
+	switch c.MetaBackend {
+	case STORE_ES:
+		if len(c.ElasticURL) == 0 || len(c.ESIndex) == 0 {
+			return errors.New("elastic_url和es_index不能为空")
+		}
+	case STORE_BOLT:
+	default:
+		return fmt.Errorf("未知的meta_backend: %s", c.MetaBackend)
+	}
+	switch c.Membership {
+	case MEMBER_NSQ:
+		if len(c.NSQAddr) == 0 {
+			return errors.New("nsq_addr不能为空")
+		}
+	case MEMBER_STATIC, MEMBER_GOSSIP:
+		if len(c.Seeds) == 0 {
+			return fmt.Errorf("membership为%s时seeds不能为空", c.Membership)
+		}
+	default:
+		return fmt.Errorf("未知的membership: %s", c.Membership)
+	}
+	if c.HBInterval <= 0 || c.HBTimeout <= 0 {
+		return errors.New("hb_interval和hb_timeout必须大于0")
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		return errors.New("read_timeout、write_timeout和shutdown_timeout必须大于0")
+	}
+	if !ValidLogLevel(c.LogLevel) {
+		return fmt.Errorf("未知的log_level: %s", c.LogLevel)
+	}
+	if c.TokenTimeout <= 0 {
+		return errors.New("token_timeout必须大于0")
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		return ErrTLSConfig
+	}
+	if len(c.TLSCA) != 0 && len(c.TLSCert) == 0 {
+		return errors.New("设置tls_ca时须同时设置tls_cert和tls_key")
+	}
+	return nil
+}
+
+type Validator interface {
+	Validate() error
+}
+
+// 配置加载，保存默认值和命令行参数，重新加载时使用
+type ConfigLoader struct {
+	Path string // 配置文件路径
+	Dump bool   // 只打印配置
+
+	typ      reflect.Type      // 配置的类型(结构体)
+	defaults []byte            // 默认值(YAML)
+	flags    map[string]string // 命令行中设置的参数
+}
+
+// 解析命令行参数，conf为带默认值的配置(结构体指针)
+func NewConfigLoader(name string, conf Validator, args []string) (*ConfigLoader, error) {
+	var (
+		l = &ConfigLoader{
+			typ:   reflect.TypeOf(conf).Elem(),
+			flags: map[string]string{},
+		}
+		fs  = flag.NewFlagSet(name, flag.ContinueOnError)
+		err error
+	)
+	if l.defaults, err = yaml.Marshal(conf); err != nil {
+		return nil, err
+	}
+	fs.StringVar(&l.Path, "config", os.Getenv("CONFIG"), "配置文件路径(YAML)")
+	eachField(reflect.ValueOf(conf).Elem(), func(f reflect.StructField, v reflect.Value) {
+		key, usage := yamlKey(f), f.Tag.Get("usage")
+		if env := f.Tag.Get("env"); len(env) != 0 {
+			usage += " (环境变量: " + env + ")"
+		}
+		fs.Var(&flagValue{
+			key:    key,
+			def:    formatValue(v),
+			isBool: v.Kind() == reflect.Bool,
+			flags:  l.flags,
+		}, key, usage)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [%s]\n", name, CMD_DUMP_CONFIG)
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+	switch fs.Arg(0) {
+	case "":
+	case CMD_DUMP_CONFIG:
+		l.Dump = true
+	default:
+		return nil, fmt.Errorf("%s: %s", ErrConfigCmd, fs.Arg(0))
+	}
+	return l, nil
+}
+
+// 按优先级加载配置并校验，conf须为与默认值同类型的空配置
+func (l *ConfigLoader) Load(conf Validator) error {
+	var (
+		v    = reflect.ValueOf(conf).Elem()
+		body []byte
+		err  error
+	)
+	if v.Type() != l.typ {
+		return fmt.Errorf("配置类型有误: %s", v.Type())
+	}
+	if err = yaml.Unmarshal(l.defaults, conf); err != nil {
+		return err
+	}
+	if len(l.Path) != 0 {
+		if body, err = ioutil.ReadFile(l.Path); err != nil {
+			return err
+		}
+		if err = yaml.UnmarshalStrict(body, conf); err != nil {
+			return fmt.Errorf("配置文件格式有误: %s %s", l.Path, err.Error())
+		}
+	}
+	eachField(v, func(f reflect.StructField, fv reflect.Value) {
+		if err != nil {
+			return
+		}
+		for _, name := range strings.Split(f.Tag.Get("env"), ",") {
+			if tmp := os.Getenv(name); len(name) != 0 && len(tmp) != 0 {
+				if err = setValue(fv, tmp); err != nil {
+					err = fmt.Errorf("环境变量%s格式有误: %s", name, tmp)
+				}
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	eachField(v, func(f reflect.StructField, fv reflect.Value) {
+		if tmp, ok := l.flags[yamlKey(f)]; ok && err == nil {
+			if err = setValue(fv, tmp); err != nil {
+				err = fmt.Errorf("参数-%s格式有误: %s", yamlKey(f), tmp)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return conf.Validate()
+}
+
+// 打印配置(YAML)，secret配置只显示是否设置
+func DumpConfig(conf interface{}) string {
+	var (
+		v   = reflect.New(reflect.TypeOf(conf).Elem())
+		out []byte
+	)
+	v.Elem().Set(reflect.ValueOf(conf).Elem())
+	eachField(v.Elem(), func(f reflect.StructField, fv reflect.Value) {
+		if f.Tag.Get("secret") == "true" && fv.Kind() == reflect.String && fv.Len() != 0 {
+			fv.SetString(SECRET_MASK)
+		}
+	})
+	out, _ = yaml.Marshal(v.Interface())
+	return string(out)
+}
+
+// 重新加载时，将需要重启才能生效的配置项恢复为原值，返回被恢复的配置项
+func KeepRestart(old, conf interface{}) []string {
+	var (
+		keys   []string
+		values = map[string]reflect.Value{}
+	)
+	eachField(reflect.ValueOf(old).Elem(), func(f reflect.StructField, v reflect.Value) {
+		values[f.Name] = v
+	})
+	eachField(reflect.ValueOf(conf).Elem(), func(f reflect.StructField, v reflect.Value) {
+		o, ok := values[f.Name]
+		if !ok || f.Tag.Get("reload") == "true" || reflect.DeepEqual(o.Interface(), v.Interface()) {
+			return
+		}
+		keys = append(keys, yamlKey(f))
+		v.Set(o)
+	})
+	return keys
+}
+
+// 遍历配置项，展开嵌入的结构体
+func eachField(v reflect.Value, fn func(f reflect.StructField, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			eachField(v.Field(i), fn)
+			continue
+		}
+		if len(f.PkgPath) != 0 || yamlKey(f) == "-" {
+			continue
+		}
+		fn(f, v.Field(i))
+	}
+}
+
+func yamlKey(f reflect.StructField) string {
+	key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if len(key) == 0 {
+		return strings.ToLower(f.Name)
+	}
+	return key
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// 将字符串转为配置项的值
+func setValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var arr []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				arr = append(arr, item)
+			}
+		}
+		v.Set(reflect.ValueOf(arr))
+	default:
+		return fmt.Errorf("不支持的配置类型: %s", v.Type())
+	}
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		arr := make([]string, v.Len())
+		for i := range arr {
+			arr[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(arr, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// 命令行参数，先记录下来，在配置文件和环境变量之后生效
+type flagValue struct {
+	key    string
+	def    string
+	isBool bool
+	flags  map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *flagValue) Set(s string) error {
+	f.flags[f.key] = s
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package tools
+
+import "syscall"
+
+// 获取path所在磁盘的剩余空间和总空间(字节)
+func DiskUsage(path string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
@@ -0,0 +1,6 @@
+package tools
+
+// windows下不统计磁盘空间，api按未知容量处理
+func DiskUsage(path string) (free, total int64, err error) {
+	return 0, 0, nil
+}
@@ -3,7 +3,9 @@ package tools
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 
 	"gopkg.in/olivere/elastic.v5"
 )
@@ -60,6 +62,21 @@ func (es *ES) Add(docType, md5 string, doc interface{}) (string, error) {
 	return fmt.Sprintf("添加成功: %s, %s", docType, md5), nil
 }
 
+// 增加: 以op_type=create写入，已存在该id时ES返回409
+func (es *ES) Create(docType, md5 string, doc interface{}) error {
+	_, err := es.Client.Index().
+		Index(es.IndexName).
+		Type(docType).
+		Id(md5).
+		OpType("create").
+		BodyJson(doc).
+		Do(context.Background())
+	if elastic.IsConflict(err) {
+		return ErrConflict
+	}
+	return err
+}
+
 // 删除: 根据id/md5
 func (es *ES) Delete(docType, md5 string) (string, error) {
 	_, err := es.Client.Delete().
@@ -67,7 +84,9 @@ func (es *ES) Delete(docType, md5 string) (string, error) {
 		Type(docType).
 		Id(md5).
 		Do(context.Background())
-	if err != nil {
+	if elastic.IsNotFound(err) {
+		return "", ErrDocNotFound
+	} else if err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("删除成功: %s, %s", docType, md5), nil
@@ -115,6 +134,66 @@ func (es *ES) GetOne(docType, md5 string) (*elastic.GetResult, error) {
 	return res, nil
 }
 
+// 查找: 只返回doc的json内容，实现MetadataStore
+func (es *ES) Get(docType, md5 string) ([]byte, error) {
+	res, err := es.GetOne(docType, md5)
+	if elastic.IsNotFound(err) { // 文档不存在时ES返回404
+		return nil, ErrDocNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, ErrDocNotFound
+	}
+	return *res.Source, nil
+}
+
+// 查找: 同时返回ES的_version
+func (es *ES) GetVersion(docType, md5 string) ([]byte, int64, error) {
+	res, err := es.GetOne(docType, md5)
+	if elastic.IsNotFound(err) {
+		return nil, 0, ErrDocNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if !res.Found || res.Source == nil || res.Version == nil {
+		return nil, 0, ErrDocNotFound
+	}
+	return *res.Source, *res.Version, nil
+}
+
+// 改: 通过ES的版本控制替换整个doc，版本号不一致时ES返回409
+func (es *ES) UpdateIf(docType, md5 string, version int64, doc interface{}) error {
+	_, err := es.Client.Index().
+		Index(es.IndexName).
+		Type(docType).
+		Id(md5).
+		Version(version).
+		BodyJson(doc).
+		Do(context.Background())
+	if e, ok := err.(*elastic.Error); ok && e.Status == 409 {
+		return ErrConflict
+	}
+	return err
+}
+
+// 删除: 通过ES的版本控制删除，版本号不一致时ES返回409
+func (es *ES) DeleteIf(docType, md5 string, version int64) error {
+	_, err := es.Client.Delete().
+		Index(es.IndexName).
+		Type(docType).
+		Id(md5).
+		Version(version).
+		Do(context.Background())
+	switch {
+	case elastic.IsConflict(err):
+		return ErrConflict
+	case elastic.IsNotFound(err):
+		return ErrDocNotFound
+	}
+	return err
+}
+
 // 判断是否存在
 func (es *ES) IsExists(docType, md5 string) bool {
 	res, err := es.Client.Exists().
@@ -127,3 +206,52 @@ func (es *ES) IsExists(docType, md5 string) bool {
 	}
 	return res
 }
+
+// 遍历: 按_uid(type#id)排序搜索，前缀及起始位置都作为_uid的查询条件，只取limit个
+func (es *ES) ScanAfter(docType, prefix, after string, limit int, fn func(id string, doc []byte) bool) error {
+	var uid = docType + "#"
+	q := elastic.NewBoolQuery().Filter(elastic.NewPrefixQuery("_uid", uid+prefix))
+	if len(after) != 0 {
+		q = q.Filter(elastic.NewRangeQuery("_uid").Gt(uid + after))
+	}
+	res, err := es.Client.Search(es.IndexName).
+		Type(docType).
+		Query(q).
+		Sort("_uid", true).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source != nil && !fn(hit.Id, *hit.Source) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 遍历: 通过scroll遍历某类文档，ES中_id不便做前缀查询，在客户端过滤
+func (es *ES) Scan(docType, prefix string, fn func(id string, doc []byte) bool) error {
+	var (
+		scroll = es.Client.Scroll(es.IndexName).Type(docType).Size(500)
+		res    *elastic.SearchResult
+		err    error
+	)
+	defer scroll.Clear(context.Background())
+	for {
+		if res, err = scroll.Do(context.Background()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil || !strings.HasPrefix(hit.Id, prefix) {
+				continue
+			}
+			if !fn(hit.Id, *hit.Source) {
+				return nil
+			}
+		}
+	}
+}
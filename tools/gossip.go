@@ -0,0 +1,363 @@
+package tools
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SWIM风格的gossip成员协议
+//   ①每个探测周期选择一个节点发送ping，超时未收到ack时，请求其他GossipIndirect个节点代为探测(ping-req)
+//   ②仍未收到ack时标记为suspect，suspect超过GossipSuspect后标记为dead
+//   ③成员变化(alive/suspect/dead)捎带在所有UDP包中传播，每条变化最多传播GossipRetransmit次
+//   ④节点被怀疑时，增加自己的incarnation并广播alive进行反驳
+// 没有任何存活节点时，重新向种子节点发送ping加入集群
+
+const (
+	GOSSIP_ALIVE   = 0
+	GOSSIP_SUSPECT = 1
+	GOSSIP_DEAD    = 2
+)
+
+var (
+	GossipProbeInterval = time.Second            // 探测周期
+	GossipProbeTimeout  = 300 * time.Millisecond // 直接探测的超时时间
+	GossipIndirect      = 3                      // 间接探测的节点数
+	GossipSuspect       = 5 * time.Second        // suspect转为dead的时间
+	GossipDeadKeep      = 30 * time.Second       // dead节点保留的时间，之后从成员列表删除
+	GossipRetransmit    = 4                      // 每条成员变化的传播次数
+	GossipMaxUpdates    = 8                      // 每个包最多捎带的成员变化
+)
+
+// 成员变化
+type update struct {
+	Addr  string `json:"a"`
+	State int    `json:"s"`
+	Inc   uint64 `json:"i"` // incarnation，由节点自己递增
+}
+
+type member struct {
+	update
+	since time.Time // 进入当前状态的时间
+}
+
+type broadcast struct {
+	update
+	left int // 剩余传播次数
+}
+
+type Gossip struct {
+	HBConf
+	bus     *udpBus
+	seeds   []string
+	mu      *sync.Mutex
+	inc     uint64 // 本节点的incarnation
+	seq     uint32
+	members map[string]*member
+	acks    map[uint32]func() // 等待ack的回调
+	queue   []*broadcast      // 待传播的成员变化
+	probes  []string          // 本轮待探测的节点
+}
+
+func NewGossip(conf HBConf, bind string, seeds []string) (*Gossip, error) {
+	var (
+		bus *udpBus
+		err error
+	)
+	if bus, err = newUDPBus(bind); err != nil {
+		return nil, err
+	}
+	conf.stop = make(chan struct{})
+	g := &Gossip{
+		HBConf:  conf,
+		bus:     bus,
+		seeds:   seeds,
+		mu:      &sync.Mutex{},
+		members: map[string]*member{},
+		acks:    map[uint32]func(){},
+	}
+	bus.onPacket = g.handlePacket
+	g.join()
+	go g.probeLoop()
+	return g, nil
+}
+
+func (g *Gossip) SendHeart() {
+	g.sendLoop(g.Send)
+}
+
+// 发送给所有未标记为dead的节点
+func (g *Gossip) Send(topic, msg string) error {
+	return g.bus.publish(g.Members(), topic, msg)
+}
+
+func (g *Gossip) AddConsumer(topic, channel string, handler Handler) error {
+	g.bus.subscribe(topic, handler)
+	return nil
+}
+
+// 通知所有节点本节点离开，停止探测
+func (g *Gossip) Leave() error {
+	err := g.leave(g.Send)
+	for _, addr := range g.Members() {
+		g.bus.send(addr, &packet{Type: PKT_LEAVE})
+	}
+	g.bus.close()
+	return err
+}
+
+// 所有未标记为dead的节点
+func (g *Gossip) Members() []string {
+	var addrs []string
+	g.mu.Lock()
+	for addr, m := range g.members {
+		if m.State != GOSSIP_DEAD {
+			addrs = append(addrs, addr)
+		}
+	}
+	g.mu.Unlock()
+	return addrs
+}
+
+// 向种子节点发送ping
+func (g *Gossip) join() {
+	for _, seed := range g.seeds {
+		if seed != g.bus.addr {
+			g.send(seed, &packet{Type: PKT_PING, Seq: g.nextSeq()})
+		}
+	}
+}
+
+// 发送时捎带成员变化
+func (g *Gossip) send(addr string, p *packet) error {
+	g.mu.Lock()
+	for i := 0; i < len(g.queue) && len(p.Updates) < GossipMaxUpdates; {
+		b := g.queue[i]
+		p.Updates = append(p.Updates, b.update)
+		if b.left--; b.left <= 0 {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			continue
+		}
+		i++
+	}
+	g.mu.Unlock()
+	return g.bus.send(addr, p)
+}
+
+func (g *Gossip) nextSeq() uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	return g.seq
+}
+
+// 加入待传播队列，同一节点只保留最新的变化，调用方需持有锁
+func (g *Gossip) enqueue(u update) {
+	for i, b := range g.queue {
+		if b.Addr == u.Addr {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			break
+		}
+	}
+	g.queue = append(g.queue, &broadcast{update: u, left: GossipRetransmit})
+}
+
+func (g *Gossip) handlePacket(p *packet) {
+	if p.Type == PKT_LEAVE {
+		log.Println("gossip: 节点离开: ", p.From)
+		g.mark(p.From, GOSSIP_DEAD)
+		return
+	}
+	g.mu.Lock()
+	// 能收到包说明发送方存活
+	if m, ok := g.members[p.From]; !ok {
+		log.Println("gossip: 新节点加入: ", p.From)
+		m = &member{update: update{Addr: p.From, State: GOSSIP_ALIVE}, since: time.Now()}
+		g.members[p.From] = m
+		g.enqueue(m.update)
+	} else if m.State != GOSSIP_ALIVE {
+		m.State = GOSSIP_ALIVE
+		m.since = time.Now()
+	}
+	for _, u := range p.Updates {
+		g.apply(u)
+	}
+	g.mu.Unlock()
+
+	switch p.Type {
+	case PKT_PING:
+		g.send(p.From, &packet{Type: PKT_ACK, Seq: p.Seq})
+	case PKT_PING_REQ:
+		var (
+			from = p.From
+			seq  = p.Seq
+			s    = g.nextSeq()
+		)
+		g.mu.Lock()
+		g.acks[s] = func() { g.send(from, &packet{Type: PKT_ACK, Seq: seq}) }
+		g.mu.Unlock()
+		time.AfterFunc(GossipProbeInterval, func() {
+			g.mu.Lock()
+			delete(g.acks, s)
+			g.mu.Unlock()
+		})
+		g.send(p.Target, &packet{Type: PKT_PING, Seq: s})
+	case PKT_ACK:
+		g.mu.Lock()
+		f, ok := g.acks[p.Seq]
+		delete(g.acks, p.Seq)
+		g.mu.Unlock()
+		if ok {
+			f()
+		}
+	}
+}
+
+// 处理一条成员变化，调用方需持有锁
+func (g *Gossip) apply(u update) {
+	if u.Addr == g.bus.addr {
+		if u.State != GOSSIP_ALIVE && u.Inc >= g.inc { // 反驳
+			g.inc = u.Inc + 1
+			g.enqueue(update{Addr: g.bus.addr, State: GOSSIP_ALIVE, Inc: g.inc})
+		}
+		return
+	}
+	m, ok := g.members[u.Addr]
+	if !ok {
+		if u.State == GOSSIP_DEAD {
+			return
+		}
+		log.Println("gossip: 新节点加入: ", u.Addr)
+		g.members[u.Addr] = &member{update: u, since: time.Now()}
+		g.enqueue(u)
+		return
+	}
+	switch {
+	case u.State == GOSSIP_ALIVE && u.Inc > m.Inc:
+	case u.State == GOSSIP_SUSPECT && (u.Inc > m.Inc || u.Inc == m.Inc && m.State == GOSSIP_ALIVE):
+	case u.State == GOSSIP_DEAD && u.Inc >= m.Inc && m.State != GOSSIP_DEAD:
+	default:
+		return
+	}
+	if m.State != u.State {
+		log.Printf("gossip: 节点状态变化: %s %d -> %d\n", u.Addr, m.State, u.State)
+		m.since = time.Now()
+	}
+	m.update = u
+	g.enqueue(u)
+}
+
+// 修改节点状态并传播
+func (g *Gossip) mark(addr string, state int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok := g.members[addr]; ok && m.State < state {
+		log.Printf("gossip: 节点状态变化: %s %d -> %d\n", addr, m.State, state)
+		m.State = state
+		m.since = time.Now()
+		g.enqueue(m.update)
+	}
+}
+
+func (g *Gossip) probeLoop() {
+	for {
+		select {
+		case <-g.stop:
+			return
+		default:
+		}
+		start := time.Now()
+		g.expire()
+		if target := g.nextProbe(); len(target) != 0 {
+			g.probe(target)
+		} else {
+			g.join()
+		}
+		if d := GossipProbeInterval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// suspect超时转为dead，dead超时从成员列表删除
+func (g *Gossip) expire() {
+	var dead []string
+	g.mu.Lock()
+	for addr, m := range g.members {
+		switch {
+		case m.State == GOSSIP_SUSPECT && time.Since(m.since) > GossipSuspect:
+			dead = append(dead, addr)
+		case m.State == GOSSIP_DEAD && time.Since(m.since) > GossipDeadKeep:
+			delete(g.members, addr)
+		}
+	}
+	g.mu.Unlock()
+	for _, addr := range dead {
+		g.mark(addr, GOSSIP_DEAD)
+	}
+}
+
+// 轮流选择探测目标，每轮打乱顺序
+func (g *Gossip) nextProbe() string {
+	if len(g.probes) == 0 {
+		g.probes = g.Members()
+		for i := range g.probes {
+			j := rand.Intn(i + 1)
+			g.probes[i], g.probes[j] = g.probes[j], g.probes[i]
+		}
+	}
+	if len(g.probes) == 0 {
+		return ""
+	}
+	target := g.probes[0]
+	g.probes = g.probes[1:]
+	return target
+}
+
+// 直接探测，超时后间接探测，仍失败时标记为suspect
+func (g *Gossip) probe(target string) {
+	var (
+		seq = g.nextSeq()
+		ack = make(chan struct{}, 1)
+	)
+	g.mu.Lock()
+	g.acks[seq] = func() {
+		select {
+		case ack <- struct{}{}:
+		default:
+		}
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.acks, seq)
+		g.mu.Unlock()
+	}()
+
+	g.send(target, &packet{Type: PKT_PING, Seq: seq})
+	select {
+	case <-ack:
+		return
+	case <-time.After(GossipProbeTimeout):
+	}
+	others := g.Members()
+	for i := range others {
+		j := rand.Intn(i + 1)
+		others[i], others[j] = others[j], others[i]
+	}
+	n := 0
+	for _, addr := range others {
+		if addr == target || n >= GossipIndirect {
+			continue
+		}
+		g.send(addr, &packet{Type: PKT_PING_REQ, Seq: seq, Target: target})
+		n++
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(GossipProbeInterval - GossipProbeTimeout):
+	}
+	g.mark(target, GOSSIP_SUSPECT)
+}
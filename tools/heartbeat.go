@@ -1,87 +1,239 @@
 package tools
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 )
 
-// 心跳相关信息
+// 心跳消息:
+//
+//	v1: JSON格式的HBMsg，带节点状态
+//	v0(旧格式): "<unixnano>,<addr>"，Legacy为true时仍按旧格式发送，用于滚动升级
+const (
+	HB_VERSION = 1 // 心跳消息版本
+)
+
+var (
+	Version     = "dev"           // 构建版本，编译时通过-ldflags "-X"设置
+	NSQRetry    = 5 * time.Second // 连接nsqd失败时的重试间隔
+	ErrHBFormat = errors.New("心跳消息格式有误")
+)
+
+// 心跳配置，各membership后端共用
+type HBConf struct {
+	ProdTopic    string          // 需要发送至哪个topic
+	ProdMsg      string          // 发送的消息(节点地址)
+	WarnCount    int             // 触发警报次数
+	ProdInterval time.Duration   // 发送的时间间隔
+	Stat         func() NodeStat // 获取节点状态，为nil时只发送地址和版本
+	Legacy       bool            // 按旧格式发送
+
+	stop chan struct{} // 关闭后停止发送心跳，由各后端创建
+}
+
+// 心跳相关信息，nsq后端
 type HeartBeat struct {
-	NSQAddr      string        // nsq地址
-	ProdTopic    string        // 需要发送至哪个topic
-	ProdMsg      string        // 发送的消息
-	WarnCount    int           // 触发警报次数
-	ProdInterval time.Duration // 发送的时间间隔
+	HBConf
+	NSQAddr string // nsq地址
 
 	Config    *nsq.Config
 	Producer  *nsq.Producer
 	VaildTime int64 // 有效时间
+
+	consumers []*nsq.Consumer
+}
+
+// 心跳消息
+type HBMsg struct {
+	V     int   `json:"v"`               // 消息版本，旧格式为0
+	Time  int64 `json:"time"`            // 发送时间(unixnano)
+	Leave bool  `json:"leave,omitempty"` // 节点退出，收到后立即剔除该节点
+	NodeStat
+}
+
+// 解析心跳消息，兼容旧格式
+func ParseHB(body []byte) (*HBMsg, error) {
+	var m = &HBMsg{}
+	if len(body) != 0 && body[0] == '{' {
+		if err := json.Unmarshal(body, m); err != nil || len(m.Addr) == 0 {
+			return nil, ErrHBFormat
+		}
+		return m, nil
+	}
+	parts := strings.SplitN(string(body), ",", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, ErrHBFormat
+	}
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrHBFormat
+	}
+	m.Time = t
+	m.Addr = parts[1]
+	return m, nil
+}
+
+// 生成一条心跳消息
+func (h *HBConf) message(leave bool) string {
+	var (
+		m    = HBMsg{V: HB_VERSION, Time: time.Now().UnixNano(), Leave: leave}
+		body []byte
+	)
+	if h.Legacy {
+		return fmt.Sprintf("%d,%s", m.Time, h.ProdMsg)
+	}
+	if h.Stat != nil && !leave {
+		m.NodeStat = h.Stat()
+	}
+	m.Addr = h.ProdMsg
+	if len(m.Version) == 0 {
+		m.Version = Version
+	}
+	body, _ = json.Marshal(&m)
+	return string(body)
 }
 
 // 初始化心跳信息
 // 生产者: nsq为nsq地址，prodMsg一般为需要发送的消息, interval为发送消息的时间间隔
-func NewHeartBeat(nsqAddr, prodTopic, prodMsg string, warnCount int, prodInterval time.Duration) *HeartBeat {
+func NewHeartBeat(nsqAddr, prodTopic, prodMsg string, warnCount int, prodInterval time.Duration) (*HeartBeat, error) {
 	var (
 		conf = nsq.NewConfig()
 		err  error
 		prod *nsq.Producer
 	)
 	if prod, err = nsq.NewProducer(nsqAddr, conf); err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return &HeartBeat{
-		NSQAddr:      nsqAddr,
-		ProdTopic:    prodTopic,
-		ProdMsg:      prodMsg,
-		WarnCount:    warnCount,
-		ProdInterval: prodInterval,
-		Config:       conf,
-		Producer:     prod,
-	}
+		HBConf: HBConf{
+			ProdTopic:    prodTopic,
+			ProdMsg:      prodMsg,
+			WarnCount:    warnCount,
+			ProdInterval: prodInterval,
+			stop:         make(chan struct{}),
+		},
+		NSQAddr:  nsqAddr,
+		Config:   conf,
+		Producer: prod,
+	}, nil
 }
 
 // 发送心跳信息
 func (h *HeartBeat) SendHeart() {
+	h.sendLoop(h.Send)
+}
+
+// 循环发送心跳，publish失败时缩短间隔重试，leave后返回
+func (h *HBConf) sendLoop(publish func(topic, msg string) error) {
 	var (
-		msg  string // 要发布的信息
-		fail int
-		err  error
+		msg   string // 要发布的信息
+		fail  int
+		sleep time.Duration
+		err   error
 	)
 	for {
-		msg = fmt.Sprintf("%d,%s", time.Now().UnixNano(), h.ProdMsg)
-		//	log.Println("发布HB信息:", h.ProdTopic, " <- ", msg)
-		if err = h.Producer.Publish(h.ProdTopic, []byte(msg)); err != nil {
+		msg = h.message(false)
+		Debugln("发布HB信息:", h.ProdTopic, " <- ", msg)
+		if err = publish(h.ProdTopic, msg); err != nil {
 			fail++
 			if fail >= h.WarnCount {
 				log.Println("HB发布失败: ", fail)
 			}
-			time.Sleep(h.ProdInterval / 2)
-			continue
+			sleep = h.ProdInterval / 2
+		} else {
+			sleep = h.ProdInterval
+			fail = 0
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(sleep):
 		}
-		time.Sleep(h.ProdInterval)
-		fail = 0
 	}
 }
 
+// 停止发送心跳，并发送一条离开消息(旧格式无法表示离开，由其他节点超时剔除)
+func (h *HBConf) leave(publish func(topic, msg string) error) error {
+	select {
+	case <-h.stop:
+		return nil
+	default:
+	}
+	close(h.stop)
+	if h.Legacy {
+		return nil
+	}
+	return publish(h.ProdTopic, h.message(true))
+}
+
 // 发送任意主题的信息
 func (h *HeartBeat) Send(topic, msg string) error {
 	return h.Producer.Publish(topic, []byte(msg))
 }
 
+// 发送离开消息，停止生产者和所有消费者
+func (h *HeartBeat) Leave() error {
+	err := h.leave(h.Send)
+	for _, c := range h.consumers {
+		c.Stop()
+	}
+	h.Producer.Stop()
+	return err
+}
+
 // 已经实现的handle,api和data中的handle可能不一致
-func (h *HeartBeat) AddConsumer(topic, channel string, handler nsq.Handler) {
+// nsqd不可用时不退出，在后台重试连接
+func (h *HeartBeat) AddConsumer(topic, channel string, handler Handler) error {
 	var (
 		consumer *nsq.Consumer
 		err      error
 	)
 	if consumer, err = nsq.NewConsumer(topic, channel, h.Config); err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	consumer.AddHandler(handler)
+	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		return handler.HandleMessage(m.Body)
+	}))
+	h.consumers = append(h.consumers, consumer)
 	if err = consumer.ConnectToNSQD(h.NSQAddr); err != nil {
-		log.Fatalln(err)
+		log.Printf("连接nsqd失败，%s后重试: %s %s\n", NSQRetry, h.NSQAddr, err.Error())
+		go func() {
+			for {
+				time.Sleep(NSQRetry)
+				if err := consumer.ConnectToNSQD(h.NSQAddr); err == nil {
+					log.Println("连接nsqd成功: ", h.NSQAddr, topic)
+					return
+				}
+			}
+		}()
 	}
+	return nil
+}
+
+// 节点状态，随心跳发送，api用于放置切片
+type NodeStat struct {
+	Addr     string `json:"addr"`
+	Version  string `json:"version"`   // 构建版本
+	Zone     string `json:"zone"`      // 可用区标签，未配置时为空
+	Rack     string `json:"rack"`      // 机架标签，未配置时为空
+	Free     int64  `json:"free"`      // 剩余空间(字节)
+	Total    int64  `json:"total"`     // 总空间(字节)，为0时表示未知
+	Shards   int64  `json:"shards"`    // 切片数
+	InFlight int64  `json:"in_flight"` // 正在处理的请求数
+}
+
+// data节点上报的损坏切片
+type ShardReport struct {
+	Server  string `json:"server"`   // data节点地址
+	Md5     string `json:"md5"`      // 切片md5
+	SerPath string `json:"ser_path"` // 切片在data中的路径
+	FileMd5 string `json:"file_md5"` // 切片所属文件的md5，旧切片没有记录时为空
+	Reason  string `json:"reason"`
 }
@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// 节点间(api->data)的http请求:
+//   ①TLS: 配置tls_cert/tls_key后data使用https，api使用该证书作为客户端证书；
+//     配置tls_ca后data只接受该CA签发的客户端证书(mTLS)，api用该CA校验data的证书
+//   ②签名: 配置cluster_secret后，api的每个请求带X-Obj-Internal-Date和X-Obj-Internal-Signature头部，
+//     签名为HMAC-SHA256(secret, method\npath\n排序后的query\n时间)，data拒绝没有签名或签名有误的请求
+//     请求体不参与签名，md5/path等参数须放在query中(上传的切片内容由data校验md5)
+
+const (
+	H_INTERNAL_DATE      = "X-Obj-Internal-Date"
+	H_INTERNAL_SIGNATURE = "X-Obj-Internal-Signature"
+	INTERNAL_DATE_FORMAT = "20060102T150405Z"
+)
+
+var (
+	InternalMaxSkew = 5 * time.Minute // 请求时间的最大偏差
+)
+
+var (
+	ErrInternalSign = errors.New("内部请求签名有误")
+	ErrInternalTime = errors.New("内部请求时间偏差过大")
+	ErrTLSConfig    = errors.New("tls_cert和tls_key须同时设置")
+)
+
+// 为请求签名
+func SignInternal(req *http.Request, secret string) {
+	var date = time.Now().UTC().Format(INTERNAL_DATE_FORMAT)
+	req.Header.Set(H_INTERNAL_DATE, date)
+	req.Header.Set(H_INTERNAL_SIGNATURE, internalMAC(req, secret, date))
+}
+
+// 校验请求签名
+func VerifyInternal(req *http.Request, secret string) error {
+	var date = req.Header.Get(H_INTERNAL_DATE)
+	t, err := time.Parse(INTERNAL_DATE_FORMAT, date)
+	if err != nil {
+		return ErrInternalSign
+	}
+	if !hmac.Equal([]byte(internalMAC(req, secret, date)), []byte(req.Header.Get(H_INTERNAL_SIGNATURE))) {
+		return ErrInternalSign
+	}
+	if d := time.Since(t); d > InternalMaxSkew || d < -InternalMaxSkew {
+		return ErrInternalTime
+	}
+	return nil
+}
+
+func internalMAC(req *http.Request, secret, date string) string {
+	var m = hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(req.Method + "\n" + req.URL.Path + "\n" + req.URL.Query().Encode() + "\n" + date))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// data服务端的TLS配置，ca不为空时要求并校验客户端证书
+func ServerTLS(cert, key, ca string) (*tls.Config, error) {
+	var (
+		conf = &tls.Config{MinVersion: tls.VersionTLS12}
+		err  error
+	)
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, ErrTLSConfig
+	}
+	if conf.Certificates, err = loadCert(cert, key); err != nil {
+		return nil, err
+	}
+	if len(ca) != 0 {
+		if conf.ClientCAs, err = loadCA(ca); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// api客户端的TLS配置，ca为空时使用系统根证书校验data的证书
+func ClientTLS(cert, key, ca string) (*tls.Config, error) {
+	var (
+		conf = &tls.Config{MinVersion: tls.VersionTLS12}
+		err  error
+	)
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, ErrTLSConfig
+	}
+	if conf.Certificates, err = loadCert(cert, key); err != nil {
+		return nil, err
+	}
+	if len(ca) != 0 {
+		if conf.RootCAs, err = loadCA(ca); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+func loadCert(cert, key string) ([]tls.Certificate, error) {
+	c, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{c}, nil
+}
+
+func loadCA(ca string) (*x509.CertPool, error) {
+	var pool = x509.NewCertPool()
+	body, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(body) {
+		return nil, errors.New("CA证书格式有误: " + ca)
+	}
+	return pool, nil
+}
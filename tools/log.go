@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// 日志级别: 默认info，debug时额外打印每个请求、每条心跳等详细日志
+// 其余日志仍直接使用log包
+
+const (
+	LOG_DEBUG = "debug"
+	LOG_INFO  = "info"
+)
+
+var debugLog int32 // 为1时打印debug日志
+
+func ValidLogLevel(level string) bool {
+	return level == LOG_DEBUG || level == LOG_INFO
+}
+
+func SetLogLevel(level string) {
+	if level == LOG_DEBUG {
+		atomic.StoreInt32(&debugLog, 1)
+	} else {
+		atomic.StoreInt32(&debugLog, 0)
+	}
+}
+
+func Debugln(v ...interface{}) {
+	if atomic.LoadInt32(&debugLog) == 1 {
+		log.Output(2, fmt.Sprintln(v...))
+	}
+}
+
+func Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugLog) == 1 {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
@@ -0,0 +1,247 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 集群成员: 节点之间的心跳及消息(异常切片上报等)都通过Membership发送
+// 目前实现:
+//   nsq: 通过nsqd发布/订阅(HeartBeat)
+//   static: 固定的节点列表，通过UDP直接发送给列表中的所有节点，不依赖nsqd
+//   gossip: 从种子节点加入，通过UDP按SWIM协议探测节点存活并传播成员变化，消息直接发送给所有存活节点
+// UDP后端使用与http服务相同的地址和端口号(UDP与TCP端口互不影响)
+// UDP后端没有nsq的channel语义，同一个topic的消息会发给所有订阅的节点
+
+const (
+	MEMBER_NSQ    = "nsq"
+	MEMBER_STATIC = "static"
+	MEMBER_GOSSIP = "gossip"
+
+	UDP_MAX_PACKET = 64 << 10 // UDP包的最大长度
+
+	PKT_MSG      = "msg"      // 主题消息
+	PKT_PING     = "ping"     // 探测
+	PKT_ACK      = "ack"      // 探测响应
+	PKT_PING_REQ = "ping-req" // 请求其他节点代为探测
+	PKT_LEAVE    = "leave"    // 节点退出
+)
+
+var (
+	ErrMemberBackend = errors.New("未知的membership类型")
+	ErrNoMember      = errors.New("没有可发送的节点")
+)
+
+type Membership interface {
+	// 循环发送心跳(阻塞)
+	SendHeart()
+	// 发送任意主题的消息
+	Send(topic, msg string) error
+	// 订阅主题，channel只对nsq有效
+	AddConsumer(topic, channel string, handler Handler) error
+	// 停止心跳并通知其他节点本节点离开，之后不再收发消息
+	Leave() error
+}
+
+// 消息处理
+type Handler interface {
+	HandleMessage(body []byte) error
+}
+
+// 根据backend生成Membership
+// nsqAddr: nsqd地址，bind: UDP监听地址(同时作为本节点地址)，seeds: static的所有节点或gossip的种子节点
+func NewMembership(backend string, conf HBConf, nsqAddr, bind string, seeds []string) (Membership, error) {
+	switch backend {
+	case MEMBER_NSQ, "":
+		log.Println("集群成员使用nsq: ", nsqAddr)
+		hb, err := NewHeartBeat(nsqAddr, conf.ProdTopic, conf.ProdMsg, conf.WarnCount, conf.ProdInterval)
+		if err != nil {
+			return nil, err
+		}
+		hb.Stat = conf.Stat
+		hb.Legacy = conf.Legacy
+		return hb, nil
+	case MEMBER_STATIC:
+		log.Println("集群成员使用静态节点列表: ", seeds)
+		return NewStatic(conf, bind, seeds)
+	case MEMBER_GOSSIP:
+		log.Println("集群成员使用gossip, 种子节点: ", seeds)
+		return NewGossip(conf, bind, seeds)
+	}
+	return nil, ErrMemberBackend
+}
+
+// UDP包
+type packet struct {
+	Type    string   `json:"t"`
+	From    string   `json:"f"`           // 发送方地址
+	Seq     uint32   `json:"s,omitempty"` // ping/ack序号
+	Target  string   `json:"a,omitempty"` // ping-req的探测目标
+	Topic   string   `json:"p,omitempty"`
+	Body    []byte   `json:"b,omitempty"`
+	Updates []update `json:"u,omitempty"` // 捎带的成员变化(gossip)
+}
+
+// UDP收发，按topic分发消息
+type udpBus struct {
+	addr     string
+	conn     *net.UDPConn
+	closed   int32 // 为1时已关闭
+	mu       *sync.RWMutex
+	handlers map[string][]Handler
+	onPacket func(p *packet) // 收到任意包后的回调(gossip协议处理)
+}
+
+func newUDPBus(bind string) (*udpBus, error) {
+	var (
+		laddr *net.UDPAddr
+		conn  *net.UDPConn
+		err   error
+	)
+	if laddr, err = net.ResolveUDPAddr("udp", bind); err != nil {
+		return nil, err
+	}
+	if conn, err = net.ListenUDP("udp", laddr); err != nil {
+		return nil, err
+	}
+	b := &udpBus{
+		addr:     bind,
+		conn:     conn,
+		mu:       &sync.RWMutex{},
+		handlers: map[string][]Handler{},
+	}
+	go b.loop()
+	return b, nil
+}
+
+func (b *udpBus) send(addr string, p *packet) error {
+	var (
+		raddr *net.UDPAddr
+		body  []byte
+		err   error
+	)
+	if raddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return err
+	}
+	p.From = b.addr
+	if body, err = json.Marshal(p); err != nil {
+		return err
+	}
+	_, err = b.conn.WriteToUDP(body, raddr)
+	return err
+}
+
+// 发送主题消息给所有节点，全部失败时返回错误
+func (b *udpBus) publish(addrs []string, topic, msg string) error {
+	var (
+		succ int
+		err  error
+	)
+	for _, addr := range addrs {
+		if addr == b.addr {
+			continue
+		}
+		if e := b.send(addr, &packet{Type: PKT_MSG, Topic: topic, Body: []byte(msg)}); e != nil {
+			err = e
+		} else {
+			succ++
+		}
+	}
+	if succ == 0 && err == nil {
+		err = ErrNoMember
+	}
+	if succ != 0 {
+		return nil
+	}
+	return err
+}
+
+func (b *udpBus) subscribe(topic string, h Handler) {
+	b.mu.Lock()
+	b.handlers[topic] = append(b.handlers[topic], h)
+	b.mu.Unlock()
+}
+
+func (b *udpBus) close() {
+	atomic.StoreInt32(&b.closed, 1)
+	b.conn.Close()
+}
+
+func (b *udpBus) loop() {
+	var buf = make([]byte, UDP_MAX_PACKET)
+	for {
+		n, _, err := b.conn.ReadFromUDP(buf)
+		if err != nil && atomic.LoadInt32(&b.closed) == 1 {
+			return
+		}
+		if err != nil {
+			log.Println("读取UDP包出错: ", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		p := &packet{}
+		if err = json.Unmarshal(buf[:n], p); err != nil || len(p.From) == 0 {
+			continue
+		}
+		if b.onPacket != nil {
+			b.onPacket(p)
+		}
+		if p.Type != PKT_MSG {
+			continue
+		}
+		b.mu.RLock()
+		hs := b.handlers[p.Topic]
+		b.mu.RUnlock()
+		for _, h := range hs {
+			if err = h.HandleMessage(p.Body); err != nil {
+				log.Println("处理消息出错: ", p.Topic, err.Error())
+			}
+		}
+	}
+}
+
+// 静态节点列表
+type Static struct {
+	HBConf
+	bus   *udpBus
+	seeds []string
+}
+
+func NewStatic(conf HBConf, bind string, seeds []string) (*Static, error) {
+	var (
+		bus *udpBus
+		err error
+	)
+	if len(seeds) == 0 {
+		return nil, ErrNoMember
+	}
+	if bus, err = newUDPBus(bind); err != nil {
+		return nil, err
+	}
+	conf.stop = make(chan struct{})
+	return &Static{HBConf: conf, bus: bus, seeds: seeds}, nil
+}
+
+func (s *Static) SendHeart() {
+	s.sendLoop(s.Send)
+}
+
+func (s *Static) Send(topic, msg string) error {
+	return s.bus.publish(s.seeds, topic, msg)
+}
+
+func (s *Static) AddConsumer(topic, channel string, handler Handler) error {
+	s.bus.subscribe(topic, handler)
+	return nil
+}
+
+func (s *Static) Leave() error {
+	err := s.leave(s.Send)
+	s.bus.close()
+	return err
+}
@@ -6,13 +6,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/klauspost/reedsolomon"
 )
 
 const (
-	REBUILD    = 3 // 重建时，重试次数
-	SHARDERROR = 2 // shard切片容忍误差: 2byte
+	REBUILD      = 3       // 重建时，重试次数
+	SHARDERROR   = 2       // shard切片容忍误差: 2byte
+	STREAM_BLOCK = 1 << 18 // 流式还原时，每次从各分片读取的字节数
 )
 
 // 需要注意的问题是： 数据块大小不一致时(不是数据缺失)，还是能还原，但是还原出来的数据也是损坏的
@@ -30,51 +32,70 @@ type rsFile struct {
 
 // srcPath: 源文件
 // destBaseDir: 目标基础目录
+// 整个文件作为一个条带切片，切片名为 文件名.序号
 func (rs *rsFile) RSSplit() ([]string, error) {
+	finfo, err := os.Stat(rs.srcPath)
+	if err != nil {
+		return make([]string, rs.dataCount+rs.parityCount), err
+	}
+	return rs.RSSplitStripe(0, finfo.Size())
+}
+
+// 切出第i个条带的切片: 文件中[i*stripeSize, (i+1)*stripeSize)的数据单独编码，
+// 切片序号从i*(dataCount+parityCount)开始，各条带互不依赖，可以并行切片
+func (rs *rsFile) RSSplitStripe(i int, stripeSize int64) ([]string, error) {
 	var (
+		width        = rs.dataCount + rs.parityCount
 		shardName    string // 切片名
 		src          *os.File
 		size         int64
-		shardNameArr = make([]string, rs.dataCount+rs.parityCount)
-		fileArr      = make([]*os.File, rs.dataCount+rs.parityCount)
+		shardNameArr = make([]string, width)
+		fileArr      = make([]*os.File, width)
 		err          error
 	)
 	if src, err = os.Open(rs.srcPath); err != nil {
 		return shardNameArr, err
 	}
+	defer src.Close()
 	finfo, _ := src.Stat()
-	size = finfo.Size() // 文件大小
+	size = finfo.Size() - int64(i)*stripeSize // 条带大小
+	if size > stripeSize {
+		size = stripeSize
+	}
+	if size < 0 {
+		size = 0
+	}
 	// 初始化所有文件
-	for i := 0; i < rs.dataCount+rs.parityCount; i++ {
-		shardName = fmt.Sprintf("%s.%d", filepath.Join(rs.destBaseDir, filepath.Base(rs.srcPath)), i)
-		shardNameArr[i] = shardName
+	for j := 0; j < width; j++ {
+		shardName = rs.ShardName(i*width + j)
+		shardNameArr[j] = shardName
 		DirExist(filepath.Dir(shardName))
 		f, _ := os.OpenFile(shardName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-		fileArr[i] = f
+		fileArr[j] = f
 		defer f.Close()
 	}
 	var w1 = make([]io.Writer, rs.dataCount)
-	for i := range w1 {
-		w1[i] = fileArr[i]
+	for j := range w1 {
+		w1[j] = fileArr[j]
 	}
 	// 处理data
-	if err = rs.enc.Split(src, w1, size); err != nil {
+	if err = rs.enc.Split(io.NewSectionReader(src, int64(i)*stripeSize, size), w1, size); err != nil {
 		return shardNameArr, err
 	}
 	// 重置data切片的偏移量
-	for i := 0; i < rs.dataCount; i++ {
-		fileArr[i].Seek(0, 0)
+	for j := 0; j < rs.dataCount; j++ {
+		fileArr[j].Seek(0, 0)
 	}
 	// 生成校验块
 	var (
 		w = make([]io.Writer, rs.parityCount)
 		r = make([]io.Reader, rs.dataCount)
 	)
-	for i := range w {
-		w[i] = fileArr[rs.dataCount+i]
+	for j := range w {
+		w[j] = fileArr[rs.dataCount+j]
 	}
-	for i := range r {
-		r[i] = fileArr[i]
+	for j := range r {
+		r[j] = fileArr[j]
 	}
 	if err = rs.enc.Encode(r, w); err != nil {
 		return shardNameArr, err
@@ -82,6 +103,11 @@ func (rs *rsFile) RSSplit() ([]string, error) {
 	return shardNameArr, nil
 }
 
+// 第k个切片的路径
+func (rs *rsFile) ShardName(k int) string {
+	return fmt.Sprintf("%s.%d", filepath.Join(rs.destBaseDir, filepath.Base(rs.srcPath)), k)
+}
+
 // 还原数据，发生错误时，重建数据
 // rebuildCount 重建次数
 func (rs *rsFile) RSReBuild(count int) error {
@@ -200,3 +226,108 @@ func NewrsFile(filePath, destDir string, dataCount, parityCount int) *rsFile {
 		enc:         enc,
 	}
 }
+
+// 流式还原分片，不落盘
+// readers为所有分片在同一区间上的数据流(缺失为nil)，按block读取，
+// 每块并行读取各分片后调用ReconstructData还原，内存占用为block*(dataCount+parityCount)
+// idx为校验分片时，需要同时还原数据分片和校验分片
+type rsStream struct {
+	enc       reedsolomon.Encoder
+	readers   []io.Reader
+	bufs      [][]byte // 每个分片的块缓存
+	shards    [][]byte
+	dataCount int
+	idx       int    // 需要输出的分片
+	dataBuf   []byte // 已还原但未读取的数据
+	left      int64  // 剩余需要输出的字节
+	block     int64
+	err       error
+}
+
+// readers: 各分片的数据流，idx: 需要输出的分片序号，size: 需要输出的字节数
+func NewrsStream(readers []io.Reader, dataCount, parityCount, idx int, size int64) (io.Reader, error) {
+	var (
+		enc reedsolomon.Encoder
+		err error
+	)
+	if enc, err = reedsolomon.New(dataCount, parityCount); err != nil {
+		return nil, err
+	}
+	s := &rsStream{
+		enc:       enc,
+		readers:   readers,
+		bufs:      make([][]byte, len(readers)),
+		shards:    make([][]byte, len(readers)),
+		dataCount: dataCount,
+		idx:       idx,
+		left:      size,
+		block:     STREAM_BLOCK,
+	}
+	for i := range s.bufs {
+		s.bufs[i] = make([]byte, STREAM_BLOCK)
+	}
+	return s, nil
+}
+
+func (s *rsStream) Read(p []byte) (int, error) {
+	if len(s.dataBuf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.left <= 0 {
+			return 0, io.EOF
+		}
+		if s.err = s.next(); s.err != nil {
+			return 0, s.err
+		}
+	}
+	n := copy(p, s.dataBuf)
+	s.dataBuf = s.dataBuf[n:]
+	return n, nil
+}
+
+// 并行读取下一块并还原
+func (s *rsStream) next() error {
+	var (
+		n    = s.block
+		wg   sync.WaitGroup
+		errs = make([]error, len(s.readers))
+	)
+	if s.left < n {
+		n = s.left
+	}
+	for i := range s.readers {
+		s.shards[i] = s.bufs[i][:0]
+		if s.readers[i] == nil || i == s.idx {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = io.ReadFull(s.readers[i], s.bufs[i][:n])
+		}(i)
+	}
+	wg.Wait()
+	for i := range s.readers {
+		if s.readers[i] == nil || i == s.idx {
+			continue
+		}
+		if errs[i] != nil {
+			log.Printf("读取分片%d失败，不再使用该分片: %s\n", i, errs[i])
+			s.readers[i] = nil
+			continue
+		}
+		s.shards[i] = s.bufs[i][:n]
+	}
+	if s.idx >= s.dataCount {
+		// 校验分片需要完整还原
+		if err := s.enc.Reconstruct(s.shards); err != nil {
+			return err
+		}
+	} else if err := s.enc.ReconstructData(s.shards); err != nil {
+		return err
+	}
+	s.dataBuf = s.shards[s.idx]
+	s.left -= n
+	return nil
+}
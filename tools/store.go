@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"errors"
+	"log"
+)
+
+// 元数据存储，api和data中所有对文档的增删改查都通过该接口完成
+// 目前实现: ES(elasticsearch)、Bolt(本地BoltDB文件，适用于小集群和CI)
+
+const (
+	STORE_ES   = "es"   // elasticsearch后端
+	STORE_BOLT = "bolt" // 本地BoltDB后端
+)
+
+var (
+	ErrDocNotFound = errors.New("不存在该文档")
+	ErrConflict    = errors.New("文档已被修改")
+)
+
+type MetadataStore interface {
+	// 增加: 整个doc增加, id一般为md5
+	Add(docType, id string, doc interface{}) (string, error)
+	// 增加: doc不存在时才增加，已存在时返回ErrConflict
+	Create(docType, id string, doc interface{}) error
+	// 删除: 根据id
+	Delete(docType, id string) (string, error)
+	// 改: 修改整个doc(与原doc合并)
+	UpdateDoc(docType, id string, doc interface{}) (string, error)
+	// 改: 修改部分field
+	UpdateField(docType, id, field string, value interface{}) (string, error)
+	// 查找: 返回doc的json内容
+	Get(docType, id string) ([]byte, error)
+	// 判断是否存在
+	IsExists(docType, id string) bool
+	// 查找: 同时返回doc的版本号，用于UpdateIf
+	GetVersion(docType, id string) ([]byte, int64, error)
+	// 改: doc的版本号仍为version时替换整个doc，否则返回ErrConflict
+	UpdateIf(docType, id string, version int64, doc interface{}) error
+	// 删除: doc的版本号仍为version时删除，否则返回ErrConflict
+	DeleteIf(docType, id string, version int64) error
+	// 遍历: 按id前缀遍历某类文档，fn返回false时停止遍历
+	Scan(docType, prefix string, fn func(id string, doc []byte) bool) error
+	// 遍历: 按id升序遍历前缀为prefix且大于after的文档，最多limit个，fn返回false时停止遍历
+	ScanAfter(docType, prefix, after string, limit int, fn func(id string, doc []byte) bool) error
+}
+
+// 根据backend生成元数据存储
+// esURL/index: ES的地址和索引名，dbPath: Bolt的文件路径
+func NewStore(backend, esURL, index, dbPath string) MetadataStore {
+	switch backend {
+	case STORE_BOLT:
+		log.Println("元数据存储使用Bolt: ", dbPath)
+		return NewBolt(dbPath)
+	case STORE_ES, "":
+		log.Println("元数据存储使用ES: ", esURL)
+		return NewES(esURL, index)
+	}
+	log.Fatalln("未知的元数据存储类型: ", backend)
+	return nil
+}
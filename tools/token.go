@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 下载切片的token，不在内存中保存状态:
+//   格式为 过期时间(unix秒).签名(hex)，签名为HMAC-SHA256(secret, md5\npath\n过期时间)
+// api和data配置相同的cluster_secret后，api直接签发token，下载切片只需一次请求；
+// token只与md5、path及过期时间有关，data重启或切片所在节点变化后仍然有效
+
+var (
+	ErrTokenInvalid = errors.New("无效token")
+	ErrTokenExpired = errors.New("token已过期")
+)
+
+// 签发token
+func SignShardToken(secret, md5, path string, expires time.Time) string {
+	var exp = strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + shardTokenMAC(secret, md5, path, exp)
+}
+
+// 校验token
+func VerifyShardToken(secret, md5, path, token string) error {
+	var i = strings.IndexByte(token, '.')
+	if len(secret) == 0 || i <= 0 {
+		return ErrTokenInvalid
+	}
+	exp, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return ErrTokenInvalid
+	}
+	if !hmac.Equal([]byte(shardTokenMAC(secret, md5, path, token[:i])), []byte(token[i+1:])) {
+		return ErrTokenInvalid
+	}
+	if time.Now().Unix() > exp {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+func shardTokenMAC(secret, md5, path, exp string) string {
+	var m = hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(md5 + "\n" + path + "\n" + exp))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// 生成随机密钥(hex)，未配置cluster_secret时data使用，只在本进程内有效
+func RandomSecret() string {
+	var b = make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
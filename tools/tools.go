@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -100,24 +101,13 @@ func MD5Diff(md5Sum, filePath string) bool {
 	return md5Sum == fmt.Sprintf("%x", m.Sum(nil))
 }
 
-// 存文件，返回md5校验码
-func Storage(r io.Reader, w io.Writer) string {
-	var (
-		m    = md5.New()
-		bs   = 4096
-		pool = make([]byte, bs)
-		buf  = bufio.NewReaderSize(r, bs)
-		i    int
-		err  error
-	)
-	for {
-		if i, err = buf.Read(pool); err == io.EOF {
-			break
-		}
-		w.Write(pool[:i])
-		m.Write(pool[:i])
+// 存文件，返回md5校验码，读写出错时返回错误
+func Storage(r io.Reader, w io.Writer) (string, error) {
+	var m = md5.New()
+	if _, err := io.Copy(io.MultiWriter(w, m), r); err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%x", m.Sum(nil))
+	return fmt.Sprintf("%x", m.Sum(nil)), nil
 }
 
 // 从中读取文件，边写文件边校验
@@ -178,6 +168,19 @@ func Json2Byte(code uint16, msg string) []byte {
 	return b
 }
 
+// msg为任意可序列化的对象，如: {"code":200,"msg":{...}}
+func Json2ByteObj(code uint16, msg interface{}) []byte {
+	var b = []byte{}
+	b, _ = json.Marshal(struct {
+		Code uint16      `json:"code"`
+		Msg  interface{} `json:"msg"`
+	}{
+		Code: code,
+		Msg:  msg,
+	})
+	return b
+}
+
 // 移动文件，不同文件分区时，调用其他方法移动文件
 func MoveFile(src, dest string) error {
 	var (
@@ -200,3 +203,18 @@ func MoveFile(src, dest string) error {
 	os.Remove(src)
 	return nil
 }
+
+// 等待wg结束，超时时返回false
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	var done = make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}